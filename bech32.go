@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Bech32 (BIP173) and bech32m (BIP350) encode an address as a human-readable
+// prefix, the separator '1', and base32 data ending with a 6-character
+// checksum. The checksum detects any error in up to 4 characters, and an
+// address is either all lowercase or all uppercase, which QR codes encode
+// more compactly.
+//
+// The data is a witness version and a program, as in Bitcoin:
+//
+//   - version 0, 20-byte public key hash, bech32: bc1q...
+//   - version 1, 32-byte x-only public key, bech32m: bc1p...
+//
+// see https://github.com/bitcoin/bips/blob/master/bip-0173.mediawiki
+// and https://github.com/bitcoin/bips/blob/master/bip-0350.mediawiki
+
+const (
+	bech32Charset   = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+	bech32Const     = 1
+	bech32mConst    = 0x2bc830a3
+	bech32MaxLen    = 90
+	bech32ChecksumN = 6
+)
+
+var bech32Generator = [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+func bech32Polymod(values []byte) uint32 {
+	chk := uint32(1)
+
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				chk ^= bech32Generator[i]
+			}
+		}
+	}
+
+	return chk
+}
+
+// expand `hrp` for the checksum: the high bits of each character, a zero,
+// then the low bits
+func bech32HRPExpand(hrp string) []byte {
+	var expanded []byte
+
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]>>5)
+	}
+	expanded = append(expanded, 0)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]&31)
+	}
+
+	return expanded
+}
+
+func bech32Checksum(hrp string, data []byte, constant uint32) []byte {
+	values := append(bech32HRPExpand(hrp), data...)
+	values = append(values, make([]byte, bech32ChecksumN)...)
+	polymod := bech32Polymod(values) ^ constant
+
+	checksum := make([]byte, bech32ChecksumN)
+	for i := range checksum {
+		checksum[i] = byte(polymod>>(5*(5-i))) & 31
+	}
+
+	return checksum
+}
+
+// encode 5-bit groups `data` with `hrp`, using the checksum constant of
+// bech32 or bech32m
+func bech32Encode(hrp string, data []byte, constant uint32) string {
+	var sb strings.Builder
+
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+	for _, b := range append(data, bech32Checksum(hrp, data, constant)...) {
+		sb.WriteByte(bech32Charset[b])
+	}
+
+	return sb.String()
+}
+
+// decode a bech32 or bech32m string
+//
+// returns: (hrp, 5-bit groups of data, checksum constant)
+func bech32Decode(s string) (string, []byte, uint32, error) {
+	if len(s) > bech32MaxLen {
+		return "", nil, 0, errors.New("bech32 string is too long")
+	}
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, 0, errors.New("bech32 string mixes cases")
+	}
+	s = strings.ToLower(s)
+
+	sep := strings.LastIndexByte(s, '1')
+	if sep < 1 || sep+1+bech32ChecksumN > len(s) {
+		return "", nil, 0, errors.New("bech32 separator is misplaced")
+	}
+	hrp := s[:sep]
+	for i := 0; i < len(hrp); i++ {
+		if hrp[i] < 33 || hrp[i] > 126 {
+			return "", nil, 0, errors.New("bech32 prefix has an invalid character")
+		}
+	}
+
+	var data []byte
+	for i := sep + 1; i < len(s); i++ {
+		v := strings.IndexByte(bech32Charset, s[i])
+		if v < 0 {
+			return "", nil, 0, errors.New("bech32 data has an invalid character")
+		}
+		data = append(data, byte(v))
+	}
+
+	constant := bech32Polymod(append(bech32HRPExpand(hrp), data...))
+	if constant != bech32Const && constant != bech32mConst {
+		return "", nil, 0, errors.New("bech32 checksum is wrong")
+	}
+
+	return hrp, data[:len(data)-bech32ChecksumN], constant, nil
+}
+
+// regroup the bits of `data` from `fromBits` to `toBits` per byte. Without
+// `pad` the leftover bits must be zero padding.
+func convertBits(data []byte, fromBits, toBits uint, pad bool) ([]byte, error) {
+	var result []byte
+	acc, bits := uint32(0), uint(0)
+	maxv := uint32(1)<<toBits - 1
+
+	for _, b := range data {
+		if uint32(b)>>fromBits != 0 {
+			return nil, errors.New("value out of range")
+		}
+		acc = acc<<fromBits | uint32(b)
+		bits += fromBits
+		for bits >= toBits {
+			bits -= toBits
+			result = append(result, byte(acc>>bits&maxv))
+		}
+	}
+
+	if pad {
+		if bits > 0 {
+			result = append(result, byte(acc<<(toBits-bits)&maxv))
+		}
+	} else if bits >= fromBits || acc<<(toBits-bits)&maxv != 0 {
+		return nil, errors.New("invalid padding")
+	}
+
+	return result, nil
+}
+
+// encode `payload` (a public key hash, or an x-only public key) into a
+// bech32 address, or a bech32m address for an x-only public key
+func encodeBech32Address(payload []byte) string {
+	version, constant := byte(0), uint32(bech32Const)
+	if len(payload) == 32 {
+		version, constant = 1, bech32mConst
+	}
+
+	data, err := convertBits(payload, 8, 5, true)
+	logErr(err)
+
+	return bech32Encode(chainParams.Bech32HRP, append([]byte{version}, data...), constant)
+}
+
+// decode a bech32 or bech32m address into its payload: a public key hash, or
+// an x-only public key
+func decodeBech32Address(address string) ([]byte, error) {
+	hrp, data, constant, err := bech32Decode(address)
+	if err != nil {
+		return nil, err
+	}
+	if hrp != chainParams.Bech32HRP {
+		return nil, fmt.Errorf("address is not of %s", chainParams.Name)
+	}
+	if len(data) < 1 {
+		return nil, errors.New("address has no witness version")
+	}
+
+	version := data[0]
+	program, err := convertBits(data[1:], 5, 8, false)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case version == 0 && constant == bech32Const && len(program) == 20:
+		return program, nil
+	case version == 1 && constant == bech32mConst && len(program) == 32:
+		return program, nil
+	}
+	return nil, errors.New("address is not a public key hash (bech32, version 0) or an x-only public key (bech32m, version 1)")
+}
+
+// check if `address` looks like a bech32 address rather than a Base58Check one
+func isBech32Address(address string) bool {
+	return strings.HasPrefix(strings.ToLower(address), chainParams.Bech32HRP+"1")
+}
+
+// return `address` as the wallet stores it: a bech32 address may be written
+// in uppercase, but is encoded in lowercase
+func normalizeAddress(address string) string {
+	if isBech32Address(address) {
+		return strings.ToLower(address)
+	}
+	return address
+}
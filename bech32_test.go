@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// valid checksums of BIP173 (bech32) and BIP350 (bech32m)
+//
+// see https://github.com/bitcoin/bips/blob/master/bip-0173.mediawiki#test-vectors
+// and https://github.com/bitcoin/bips/blob/master/bip-0350.mediawiki#test-vectors
+var validBech32Strings = []struct {
+	s        string
+	constant uint32
+}{
+	{"A12UEL5L", bech32Const},
+	{"a12uel5l", bech32Const},
+	{"an83characterlonghumanreadablepartthatcontainsthenumber1andtheexcludedcharactersbio1tt5tgs", bech32Const},
+	{"abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw", bech32Const},
+	{"11qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqc8247j", bech32Const},
+	{"split1checkupstagehandshakeupstreamerranterredcaperred2y9e3w", bech32Const},
+	{"?1ezyfcl", bech32Const},
+	{"A1LQFN3A", bech32mConst},
+	{"a1lqfn3a", bech32mConst},
+	{"an83characterlonghumanreadablepartthatcontainsthetheexcludedcharactersbioandnumber11sg7hg6", bech32mConst},
+	{"abcdef1l7aum6echk45nj3s0wdvt2fg8x9yrzpqzd3ryx", bech32mConst},
+	{"11llllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllludsr8", bech32mConst},
+	{"split1checkupstagehandshakeupstreamerranterredcaperredlc445v", bech32mConst},
+	{"?1v759aa", bech32mConst},
+}
+
+var invalidBech32Strings = []string{
+	"\x201nwldj5", // prefix character out of range
+	"\x7f1axkwrx", // prefix character out of range
+	"\x801eym55h", // prefix character out of range
+	"an84characterslonghumanreadablepartthatcontainsthenumber1andtheexcludedcharactersbio1569pvx", // too long
+	"pzry9x0s0muk",  // no separator
+	"1pzry9x0s0muk", // empty prefix
+	"x1b4n0q5v",     // invalid data character
+	"li1dgmt3",      // too short checksum
+	"de1lg7wt\xff",  // invalid checksum character
+	"A1G7SGD8",      // checksum computed with an uppercase prefix
+	"10a06t8",       // empty prefix
+	"1qzzfhee",      // empty prefix
+}
+
+func TestBech32Checksum(t *testing.T) {
+	for _, v := range validBech32Strings {
+		hrp, data, constant, err := bech32Decode(v.s)
+		if err != nil {
+			t.Errorf("%s: %s", v.s, err)
+			continue
+		}
+		if constant != v.constant {
+			t.Errorf("%s: checksum constant is %x", v.s, constant)
+		}
+		if s := bech32Encode(hrp, data, constant); s != strings.ToLower(v.s) {
+			t.Errorf("%s is encoded back into %s", v.s, s)
+		}
+	}
+
+	for _, s := range invalidBech32Strings {
+		if _, _, _, err := bech32Decode(s); err == nil {
+			t.Errorf("%q is decoded", s)
+		}
+	}
+}
+
+// set the network whose addresses start with `hrp`
+func useBech32Network(t *testing.T, hrp string) {
+	params := chainParams
+	t.Cleanup(func() { chainParams = params })
+
+	chainParams = &mainNetParams
+	if hrp == testNetParams.Bech32HRP {
+		chainParams = &testNetParams
+	}
+}
+
+// the addresses of BIP173 and BIP350 which are a public key hash (version 0,
+// 20 bytes) or an x-only public key (version 1, 32 bytes)
+func TestBech32AddressVectors(t *testing.T) {
+	valid := []struct{ address, payload string }{
+		{"BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4", "751e76e8199196d454941c45d1b3a323f1433bd6"},
+		{"tb1pqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesf3hn0c", "000000c4a5cad46221b2a187905e5266362b99d5e91c6ce24d165dab93e86433"},
+		{"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0", "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"},
+	}
+	for _, v := range valid {
+		useBech32Network(t, strings.ToLower(v.address[:2]))
+		payload, err := decodeBech32Address(v.address)
+		if err != nil {
+			t.Errorf("%s: %s", v.address, err)
+			continue
+		}
+		if hex.EncodeToString(payload) != v.payload {
+			t.Errorf("%s: payload is %x", v.address, payload)
+		}
+		if address := encodeBech32Address(payload); address != strings.ToLower(v.address) {
+			t.Errorf("%s is encoded back into %s", v.address, address)
+		}
+	}
+
+	invalid := []string{
+		"tc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq5zuyut", // invalid prefix
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqh2y7hd", // version 1 with a bech32 checksum
+		"tb1z0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqglt7rf", // version 2 with a bech32 checksum
+		"BC1S0XLXVLHEMJA6C4DQV22UAPCTQUPFHLXM9H8Z3K2E72Q4K9HCZ7VQ54WELL", // version 16 with a bech32 checksum
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kemeuha",                     // version 0 with a bech32m checksum
+		"tb1q0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq24jc47", // version 0 with a bech32m checksum
+		"bc1p38j9r5y49hruaue7wxjce0updqjuyyx0kh56v8s25huc6995vvpql3jow4", // invalid data character
+		"BC130XLXVLHEMJA6C4DQV22UAPCTQUPFHLXM9H8Z3K2E72Q4K9HCZ7VQ7ZWS8R", // invalid version
+		"bc1pw5dgrnzv", // 1-byte program
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7v8n0nx0muaewav253zgeav", // 41-byte program
+		"BC1QR508D6QEJXTDG4Y5R3ZARVARYV98GJ9P",                                         // 16-byte program of version 0
+		"tb1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq47Zagq",               // mixed case
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7v07qwwzcrf",             // more than 4 padding bits
+		"tb1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vpggkg4j",               // non-zero padding
+		"bc1gmk9yu", // empty data
+	}
+	for _, address := range invalid {
+		useBech32Network(t, strings.ToLower(address[:2]))
+		if ValidateAddress(address) {
+			t.Errorf("%s is valid", address)
+		}
+	}
+}
+
+// an address written in uppercase finds the key of its lowercase form
+func TestNormalizeBech32Address(t *testing.T) {
+	useBech32Network(t, "bc")
+	wallet := NewWallet(false)
+	wallet.Bech32 = true
+	addr := string(wallet.GetAddress())
+	ws := Wallets{Wallets: map[string]*Wallet{addr: wallet}}
+
+	if !ValidateAddress(strings.ToUpper(addr)) {
+		t.Fatalf("%s is invalid", strings.ToUpper(addr))
+	}
+	if ws.GetPubKey(strings.ToUpper(addr)) == nil {
+		t.Error("the key of an uppercase address isn't found")
+	}
+	if normalizeAddress(encodeAddress(HashPubKey(wallet.PublicKey))) != encodeAddress(HashPubKey(wallet.PublicKey)) {
+		t.Error("a Base58Check address is changed")
+	}
+}
@@ -16,9 +16,13 @@ type Block struct {
 	Height        int
 }
 
-// return a new block
+// return a new block. The coinbase, which must be the first transaction, gets
+// the witness commitment of the block.
 func NewBlock(transactions []*Transaction, prevBlockHash []byte, height int) *Block {
 	block := &Block{time.Now().Unix(), transactions, prevBlockHash, []byte{}, 0, height}
+	if len(transactions) > 0 && transactions[0].IsCoinbase() {
+		transactions[0].SetWitnessCommitment(block.HashWitnesses())
+	}
 	pow := NewProofOfWork(block)
 	nonce, hash := pow.Run()
 
@@ -32,12 +36,29 @@ func NewGenesisBlock(coinbase *Transaction) *Block {
 	return NewBlock([]*Transaction{coinbase}, []byte{}, 0)
 }
 
-// return root of merkle tree built on all transactions in `b`
+// return root of merkle tree built on IDs of all transactions in `b`
 func (b *Block) HashTransactions() []byte {
 	var transactions [][]byte
 
 	for _, tx := range b.Transactions {
-		transactions = append(transactions, tx.Serialize())
+		transactions = append(transactions, tx.ID)
+	}
+	mTree := NewMerkleTree(transactions)
+
+	return mTree.RootNode.Data
+}
+
+// return root of merkle tree built on wtxids of all transactions in `b`.
+// wtxid of coinbase is taken as zeros, because coinbase holds the root itself.
+func (b *Block) HashWitnesses() []byte {
+	var transactions [][]byte
+
+	for _, tx := range b.Transactions {
+		if tx.IsCoinbase() {
+			transactions = append(transactions, make([]byte, 32))
+		} else {
+			transactions = append(transactions, tx.WitnessHash())
+		}
 	}
 	mTree := NewMerkleTree(transactions)
 
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	blockDownloadWindow = 128              // blocks past the blockchain which may be downloaded
+	maxBlocksInFlight   = 16               // blocks requested from one peer at once
+	blockStallTimeout   = 10 * time.Second // a peer holding up the next block for longer is disconnected
+	blockRequestTimeout = time.Minute      // a peer not sending another requested block for longer is disconnected
+)
+
+// blockRequest is a block requested from `peer` with `getdata`
+type blockRequest struct {
+	peer   *Peer
+	height int
+	sent   time.Time
+}
+
+// receivedBlock is a block downloaded before its parent
+type receivedBlock struct {
+	block *Block
+	peer  *Peer
+}
+
+// blockDownload downloads the blocks of the header chain from several peers
+// at once, the fastest ones first. Only the blocks less than
+// `blockDownloadWindow` past the blockchain are requested, so that the ones
+// arriving out of order don't wait for their parents long. A peer which
+// holds up the download is disconnected, and its blocks requested from the
+// others.
+//
+// Only the goroutine handling the messages uses it.
+type blockDownload struct {
+	requests map[string]*blockRequest // hex block hash -> request
+	received map[int]*receivedBlock   // height -> block
+}
+
+var downloader = newBlockDownload()
+
+func newBlockDownload() *blockDownload {
+	return &blockDownload{make(map[string]*blockRequest), make(map[int]*receivedBlock)}
+}
+
+// request the blocks of the window which aren't requested yet from the peers
+// which have them and can take more requests
+func (d *blockDownload) Schedule(hc *headerChain) {
+	var peers []*Peer
+	inFlight := make(map[*Peer]int)
+	for _, p := range peerManager.Peers() {
+		if p.HandshakeDone() && p.Connected() {
+			peers = append(peers, p)
+		}
+	}
+	for _, r := range d.requests {
+		inFlight[r.peer]++
+	}
+	// the peers with the shortest round-trip time first, the ones not
+	// measured yet last
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].PingTime == 0 || peers[j].PingTime == 0 {
+			return peers[j].PingTime == 0 && peers[i].PingTime != 0
+		}
+		return peers[i].PingTime < peers[j].PingTime
+	})
+
+	end := hc.connected + blockDownloadWindow
+	if end > hc.Height() {
+		end = hc.Height()
+	}
+	for height := hc.connected + 1; height <= end; height++ {
+		hash := hc.headers[height].Hash
+		if d.requests[hex.EncodeToString(hash)] != nil {
+			continue
+		}
+		if r := d.received[height]; r != nil && bytes.Equal(r.block.Hash, hash) {
+			continue
+		}
+
+		var peer *Peer
+		for _, p := range peers {
+			if inFlight[p] < maxBlocksInFlight && p.BestHeight >= height {
+				peer = p
+				break
+			}
+		}
+		if peer == nil {
+			// a peer having the block has the ones before too
+			return
+		}
+
+		sendGetData(peer, "block", hash)
+		d.requests[hex.EncodeToString(hash)] = &blockRequest{peer, height, time.Now()}
+		inFlight[peer]++
+	}
+}
+
+// take `block` from `p`, add the blocks which follow the blockchain to it
+// and request more
+func (d *blockDownload) BlockReceived(p *Peer, block *Block, hc *headerChain, bc *Blockchain) {
+	key := hex.EncodeToString(block.Hash)
+	if d.requests[key] == nil {
+		fmt.Printf("Ignoring block %x, which wasn't requested\n", block.Hash)
+		return
+	}
+	delete(d.requests, key)
+
+	height, ok := hc.HeightOf(block.Hash)
+	if !ok || height <= hc.connected {
+		// its header was replaced meanwhile
+		return
+	}
+	if block.Height != height {
+		fmt.Printf("Disconnecting %s: block %x has height %d instead of %d\n", p, block.Hash, block.Height, height)
+		p.Disconnect()
+		return
+	}
+
+	d.received[height] = &receivedBlock{block, p}
+	d.connectBlocks(hc, bc)
+	d.Schedule(hc)
+}
+
+// validate and add the received blocks which follow the blockchain
+func (d *blockDownload) connectBlocks(hc *headerChain, bc *Blockchain) {
+	for {
+		height := hc.connected + 1
+		r := d.received[height]
+		if r == nil {
+			return
+		}
+		delete(d.received, height)
+		if height > hc.Height() || !bytes.Equal(r.block.Hash, hc.headers[height].Hash) {
+			continue
+		}
+
+		UTXOSet := UTXOSet{bc}
+		if !bytes.Equal(r.block.PrevBlockHash, bc.tip) {
+			// the first block of a fork: the blocks after the fork leave
+			// the blockchain, and their outputs the UTXO set, so that
+			// the fork is validated against its own outputs
+			fmt.Printf("Reorganizing the blockchain from block %x to the fork at height %d\n", bc.tip, height-1)
+			bc.SetTip(r.block.PrevBlockHash)
+			UTXOSet.Reindex()
+		}
+
+		if err := bc.ValidateBlock(r.block); err != nil {
+			// the header is valid but not the block, so the header chain
+			// from there on is dropped
+			fmt.Printf("Rejected block %x: %s\n", r.block.Hash, err)
+			hc.truncate(height)
+			if hc.replaced != nil {
+				d.abandonFork(hc, bc)
+			}
+			fmt.Printf("Disconnecting %s: it sent an invalid block\n", r.peer)
+			r.peer.Disconnect()
+			return
+		}
+
+		bc.AddBlock(r.block)
+		bc.SetTip(r.block.Hash) // the block may be in the database already, from an abandoned fork
+		UTXOSet.Update(r.block)
+		hc.connect(height)
+
+		fmt.Printf("Added block %x at height %d\n", r.block.Hash, height)
+	}
+}
+
+// go back to the blocks replaced by the fork being connected, when the fork
+// has an invalid block or no peer sends its blocks
+func (d *blockDownload) abandonFork(hc *headerChain, bc *Blockchain) {
+	hc.restoreReplaced()
+	tip := hc.headers[hc.connected].Hash
+	fmt.Printf("Abandoning the fork, back to block %x at height %d\n", tip, hc.connected)
+
+	if !bytes.Equal(bc.tip, tip) {
+		bc.SetTip(tip)
+		UTXOSet{bc}.Reindex()
+	}
+}
+
+// give up the requests to disconnected peers, disconnect the peers holding up
+// the download, and request their blocks again. A fork whose next block no
+// peer can send is abandoned.
+func (d *blockDownload) CheckStalls(hc *headerChain, bc *Blockchain) {
+	now := time.Now()
+
+	for key, r := range d.requests {
+		if !r.peer.Connected() {
+			delete(d.requests, key)
+			continue
+		}
+
+		timeout := blockRequestTimeout
+		if r.height == hc.connected+1 {
+			timeout = blockStallTimeout
+		}
+		if now.Sub(r.sent) > timeout {
+			fmt.Printf("Disconnecting %s: block %d not received in %s\n", r.peer, r.height, timeout)
+			r.peer.Disconnect()
+			delete(d.requests, key)
+		}
+	}
+
+	d.Schedule(hc)
+
+	if hc.replaced != nil && len(d.requests) == 0 && d.received[hc.connected+1] == nil {
+		d.abandonFork(hc, bc)
+	}
+}
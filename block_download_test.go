@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// hand `blocks` to the download as if `p` had sent them
+func receiveBlocks(t *testing.T, d *blockDownload, hc *headerChain, bc *Blockchain, p *Peer, blocks ...*Block) {
+	var headers []BlockHeader
+	for _, b := range blocks {
+		headers = append(headers, b.Header())
+	}
+	if _, err := hc.Add(headers); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, b := range blocks {
+		d.received[b.Height] = &receivedBlock{b, p}
+	}
+	d.connectBlocks(hc, bc)
+}
+
+func newTestPeer() *Peer {
+	conn, _ := net.Pipe()
+	return newPeer(conn, "test", false)
+}
+
+func TestReorganization(t *testing.T) {
+	miner := NewWallet(false)
+	bc := newTestBlockchain(t, miner)
+	hc := newHeaderChain(bc)
+	d := newBlockDownload()
+	genesis, err := bc.GetBlock(bc.tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a1 := newBlockOn(&genesis, miner, "a1", 0)
+	receiveBlocks(t, d, hc, bc, newTestPeer(), a1)
+	if !bytes.Equal(bc.tip, a1.Hash) {
+		t.Fatal("the first block wasn't added")
+	}
+
+	// a longer fork whose second block spends the coinbase of its first
+	b1 := newBlockOn(&genesis, miner, "b1", 0)
+	b2 := newBlockOn(b1, miner, "b2", 0, newSpendingTX(b1.Transactions[0], miner, miner))
+	b3 := newBlockOn(b2, miner, "b3", 0)
+	receiveBlocks(t, d, hc, bc, newTestPeer(), b1, b2, b3)
+
+	if !bytes.Equal(bc.tip, b3.Hash) || hc.connected != 3 || hc.replaced != nil {
+		t.Fatalf("the blockchain didn't switch to the fork: tip %x, %d connected", bc.tip, hc.connected)
+	}
+	UTXOSet := UTXOSet{bc}
+	if UTXOSet.IsUnspent(a1.Transactions[0].ID, 0) {
+		t.Error("the coinbase of the replaced block is still unspent")
+	}
+	if UTXOSet.IsUnspent(b1.Transactions[0].ID, 0) || !UTXOSet.IsUnspent(b2.Transactions[1].ID, 0) {
+		t.Error("the UTXO set doesn't match the fork")
+	}
+
+	// a longer fork with an invalid second block is abandoned
+	c1 := newBlockOn(&genesis, miner, "c1", 0)
+	c2 := newBlockOn(c1, miner, "c2", 0, newSpendingTX(a1.Transactions[0], miner, miner))
+	c3 := newBlockOn(c2, miner, "c3", 0)
+	c4 := newBlockOn(c3, miner, "c4", 0)
+	receiveBlocks(t, d, hc, bc, newTestPeer(), c1, c2, c3, c4)
+
+	if !bytes.Equal(bc.tip, b3.Hash) || hc.Height() != 3 || !bytes.Equal(hc.headers[3].Hash, b3.Hash) {
+		t.Fatalf("the invalid fork wasn't abandoned: tip %x", bc.tip)
+	}
+	if !UTXOSet.IsUnspent(b2.Transactions[1].ID, 0) {
+		t.Error("the UTXO set wasn't restored")
+	}
+}
+
+// a fork whose blocks no peer sends doesn't hold up the node for good
+func TestAbandonStalledFork(t *testing.T) {
+	miner := NewWallet(false)
+	bc := newTestBlockchain(t, miner)
+	hc := newHeaderChain(bc)
+	d := newBlockDownload()
+	genesis, err := bc.GetBlock(bc.tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a1 := newBlockOn(&genesis, miner, "a1", 0)
+	receiveBlocks(t, d, hc, bc, newTestPeer(), a1)
+
+	b1 := newBlockOn(&genesis, miner, "b1", 0)
+	b2 := newBlockOn(b1, miner, "b2", 0)
+	if _, err := hc.Add([]BlockHeader{b1.Header(), b2.Header()}); err != nil {
+		t.Fatal(err)
+	}
+	if hc.connected != 0 || hc.replaced == nil {
+		t.Fatal("the fork didn't replace the header chain")
+	}
+
+	d.CheckStalls(hc, bc)
+	if hc.Height() != 1 || hc.connected != 1 || !bytes.Equal(hc.headers[1].Hash, a1.Hash) {
+		t.Errorf("the stalled fork wasn't abandoned: height %d, %d connected", hc.Height(), hc.connected)
+	}
+	if !bytes.Equal(bc.tip, a1.Hash) {
+		t.Errorf("the tip moved to %x", bc.tip)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/big"
+)
+
+// BlockHeader is a block without its transactions, which the merkle root
+// stands for: enough to check the proof of work of the block and its place
+// in the chain before downloading it
+type BlockHeader struct {
+	Timestamp     int64
+	PrevBlockHash []byte
+	MerkleRoot    []byte // root of the merkle tree of the transaction IDs
+	Hash          []byte
+	Nonce         int
+	Height        int
+}
+
+// return the header of `b`
+func (b *Block) Header() BlockHeader {
+	return BlockHeader{b.Timestamp, b.PrevBlockHash, b.HashTransactions(), b.Hash, b.Nonce, b.Height}
+}
+
+// check that the hash of `h` is its proof of work
+func (h *BlockHeader) ValidatePoW() bool {
+	var hashInt big.Int
+	hash := sha256.Sum256(powData(h.PrevBlockHash, h.MerkleRoot, h.Timestamp, h.Nonce))
+	hashInt.SetBytes(hash[:])
+
+	return hashInt.Cmp(powTarget()) == -1 && bytes.Equal(hash[:], h.Hash)
+}
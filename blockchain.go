@@ -3,7 +3,6 @@ package main
 
 import (
 	"bytes"
-	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -14,9 +13,8 @@ import (
 )
 
 const (
-	dbFile              = "blockchain.db"
-	blocksBucket        = "blocks"
-	genesisCoinbaseData = "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks"
+	dbFile       = "blockchain.db"
+	blocksBucket = "blocks"
 )
 
 type Blockchain struct {
@@ -24,35 +22,6 @@ type Blockchain struct {
 	db  *bolt.DB
 }
 
-// NewBlockchain creates a new Blockchain with genesis Block
-func NewBlockchain(nodeID string) *Blockchain {
-	dbFile := fmt.Sprintf(dbFile, nodeID)
-	if dbExists() == false {
-		fmt.Println("No existing blockchain found. Create one first.")
-		os.Exit(1)
-	}
-
-	var tip []byte
-	db, err := bolt.Open(dbFile, 0600, nil)
-	if err != nil {
-		log.Panic(err)
-	}
-
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		tip = b.Get([]byte("l"))
-
-		return nil
-	})
-	if err != nil {
-		log.Panic(err)
-	}
-
-	bc := Blockchain{tip, db}
-
-	return &bc
-}
-
 // finds a block by its hash and returns it
 func (bc *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 	var block Block
@@ -70,9 +39,8 @@ func (bc *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 
 		return nil
 	})
-	logErr(err)
 
-	return block, nil
+	return block, err
 }
 
 // GetBestHeight returns the height of the latest block
@@ -94,24 +62,6 @@ func (bc *Blockchain) GetBestHeight() int {
 	return lastBlock.Height
 }
 
-// return a list of hashes of all the blocks in the chain
-func (bc *Blockchain) GetBlockHashes() [][]byte {
-	var blocksHashes [][]byte
-	bci := bc.Iterator()
-
-	for {
-		block := bci.Next()
-
-		blocksHashes = append(blocksHashes, block.Hash)
-
-		if len(block.PrevBlockHash) == 0 {
-			break
-		}
-	}
-
-	return blocksHashes
-}
-
 // AddBlock saves the block into the blockchain
 func (bc *Blockchain) AddBlock(block *Block) {
 	err := bc.db.Update(func(tx *bolt.Tx) error {
@@ -147,18 +97,24 @@ func (bc *Blockchain) AddBlock(block *Block) {
 	}
 }
 
+// make the block of `hash`, which is in the database, the tip of the
+// blockchain. The blocks after it stay in the database.
+func (bc *Blockchain) SetTip(hash []byte) {
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+
+		return b.Put([]byte("l"), hash)
+	})
+	logErr(err)
+
+	bc.tip = hash
+}
+
 // mine a new block which contains `transactions`
 func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block {
 	var lastHash []byte
 	var lastHeight int
 
-	for _, tx := range transactions {
-		if bc.VerifyTransaction(tx) != true {
-			log.Println("ERROR: Invalid transaction when mining")
-			return nil
-		}
-	}
-
 	err := bc.db.View(func(tx *bolt.Tx) error { // get latest block from database. This is a read-only transaction.
 		b := tx.Bucket([]byte(blocksBucket))
 		lastHash = b.Get([]byte("l"))
@@ -172,6 +128,12 @@ func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block {
 	})
 	logErr(err)
 
+	// a block which `ValidateBlock` would reject isn't worth mining
+	if err := bc.verifyBlockTransactions(transactions, lastHeight+1); err != nil {
+		log.Printf("ERROR: Invalid transaction when mining: %s", err)
+		return nil
+	}
+
 	newBlock := NewBlock(transactions, lastHash, lastHeight+1)
 
 	err = bc.db.Update(func(tx *bolt.Tx) error { // add a new block into database
@@ -199,7 +161,7 @@ func LoadBlockchain() *Blockchain {
 	}
 
 	var tip []byte
-	db, err := bolt.Open(dbFile, 0600, nil)
+	db, err := bolt.Open(dataFile(dbFile), 0600, nil)
 	logErr(err)
 
 	err = db.Update(func(tx *bolt.Tx) error {
@@ -215,8 +177,10 @@ func LoadBlockchain() *Blockchain {
 	return &bc
 }
 
-// Create a new blockchain and send genesis block reward to `addr`
-func CreateBlockchain(addr string) *Blockchain {
+// Create a new blockchain and send genesis block reward to `addr`.
+// `data` is put into the genesis coinbase, so that chains created with
+// different data never share a genesis block.
+func CreateBlockchain(addr, data string) *Blockchain {
 	if dbExists() {
 		fmt.Println("Blockchain already exists.")
 		os.Exit(1)
@@ -224,10 +188,14 @@ func CreateBlockchain(addr string) *Blockchain {
 
 	var tip []byte // latest block hash
 
-	cbtx := NewCoinbaseTX(addr, genesisCoinbaseData)
+	if data == "" {
+		data = chainParams.GenesisCoinbaseData
+	}
+	cbtx := NewCoinbaseTX(addr, data, 0)
 	genesis := NewGenesisBlock(cbtx)
 
-	db, err := bolt.Open(dbFile, 0600, nil) // open BoltDB database file
+	ensureDataDir()
+	db, err := bolt.Open(dataFile(dbFile), 0600, nil) // open BoltDB database file
 	logErr(err)
 
 	err = db.Update(func(tx *bolt.Tx) error { // BobtDB has two kinds of transaction（事务）: read-only and read-write. Here we open a read-write transaction.
@@ -250,6 +218,31 @@ func CreateBlockchain(addr string) *Blockchain {
 	return &bc
 }
 
+// return the hex-encoded keys (public key hashes and x-only public keys) of
+// every output in the chain, spent or not
+func (bc *Blockchain) FindLockingKeys() map[string]bool {
+	keys := make(map[string]bool)
+	bci := bc.Iterator()
+
+	for {
+		block := bci.Next()
+
+		for _, tx := range block.Transactions {
+			for _, out := range tx.Vout {
+				for _, key := range out.LockingKeys() {
+					keys[hex.EncodeToString(key)] = true
+				}
+			}
+		}
+
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+
+	return keys
+}
+
 // find transaction by tx.ID
 func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 	bci := bc.Iterator()
@@ -284,6 +277,10 @@ func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
 
 		Outputs:
 			for outIdx, out := range tx.Vout { // `outIdx` is index of output `out` in transaction `tx`
+				if out.IsWitnessCommitment() { // it can't be spent
+					continue
+				}
+
 				// Was the output spent?
 				if spentTXOs[txID] != nil {
 					for _, spentOutIdx := range spentTXOs[txID] {
@@ -299,7 +296,7 @@ func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
 				// If it comes to here, then output `out` in transaction `tx` is
 				// unspent, and it should be added into UTXO set.
 				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out) // add `out` to `UXTO[txID]`
+				outs.Add(outIdx, out) // add `out` to `UXTO[txID]`
 				UTXO[txID] = outs
 			}
 
@@ -326,8 +323,8 @@ func (bc *Blockchain) Iterator() *BlockchainIterator {
 	bci := &BlockchainIterator{bc.tip, bc.db}
 
 	return bci
-} // sign `tx` by `privKey`
-func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
+} // sign `tx` by `wallet`
+func (bc *Blockchain) SignTransaction(tx *Transaction, wallet Wallet) {
 	prevTXs := make(map[string]Transaction)
 
 	for _, vin := range tx.Vin {
@@ -335,29 +332,186 @@ func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey)
 		logErr(err)
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
-	tx.Sign(privKey, prevTXs)
+	tx.Sign(wallet, prevTXs)
+}
+
+// sign input `inID` of `tx` by `wallet`, covering the parts of `tx`
+// selected by `hashType`
+func (bc *Blockchain) SignTransactionInput(tx *Transaction, inID int, wallet Wallet, hashType byte) {
+	prevTX, err := bc.FindTransaction(tx.Vin[inID].Txid)
+	logErr(err)
+	prevTXs := map[string]Transaction{hex.EncodeToString(prevTX.ID): prevTX}
+
+	tx.SignInput(inID, wallet, prevTXs, hashType)
+}
+
+// return the fee paid by `tx` to the miner, or an error if an input spends
+// an output which doesn't exist
+func (bc *Blockchain) TransactionFee(tx *Transaction) (int, error) {
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
+	prevTXs, err := bc.prevTransactions(tx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return tx.Fee(prevTXs), nil
 }
 
 // Check if `tx` could be verified by old transactions in blockchain
-func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
+//
+// returns: error telling why `tx` is invalid, nil if it's valid
+func (bc *Blockchain) VerifyTransaction(tx *Transaction) error {
+	batch := &schnorrBatch{}
+
+	if _, err := bc.verifyTransaction(tx, bc.GetBestHeight()+1, batch, nil); err != nil {
+		return err
+	}
+	if !batch.Verify() {
+		return errors.New("its schnorr signatures are invalid")
+	}
+	return nil
+}
 
+// Check if `tx` could be verified by old transactions in blockchain, or
+// `pending` ones not in it yet (by hex ID), and be mined into a block at
+// `height`. Schnorr signatures are added to `batch` and have to be verified
+// by the caller.
+//
+// returns: (fee of `tx`, error if it's invalid)
+func (bc *Blockchain) verifyTransaction(tx *Transaction, height int, batch *schnorrBatch, pending map[string]Transaction) (int, error) {
 	if tx.IsCoinbase() {
-		return true
+		return 0, nil
+	}
+	if tx.LockTime > height {
+		return 0, errors.New("it's not final yet")
+	}
+	prevTXs, err := bc.prevTransactions(tx, pending)
+	if err != nil {
+		return 0, err
+	}
+
+	if !tx.verify(prevTXs, batch) {
+		return 0, errors.New("it has a negative output, spends more than its inputs, or its inputs aren't unlocked")
 	}
+	return tx.Fee(prevTXs), nil
+}
+
+// find the transactions whose outputs the inputs of `tx` spend, in `pending`
+// (by hex ID, may be nil) or else in the blockchain
+//
+// returns: (Transaction.ID->Transaction, error if an input spends an output
+// which doesn't exist)
+func (bc *Blockchain) prevTransactions(tx *Transaction, pending map[string]Transaction) (map[string]Transaction, error) {
 	prevTXs := make(map[string]Transaction)
 
-	for _, vin := range tx.Vin {
-		prevTX, err := bc.FindTransaction(vin.Txid)
-		logErr(err)
+	for i, vin := range tx.Vin {
+		prevTX, ok := pending[hex.EncodeToString(vin.Txid)]
+		if !ok {
+			var err error
+			if prevTX, err = bc.FindTransaction(vin.Txid); err != nil {
+				return nil, fmt.Errorf("input %d spends unknown transaction %x", i, vin.Txid)
+			}
+		}
+		if vin.Vout < 0 || vin.Vout >= len(prevTX.Vout) {
+			return nil, fmt.Errorf("input %d spends output %d, which transaction %x doesn't have", i, vin.Vout, vin.Txid)
+		}
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
 
-	return tx.Verify(prevTXs)
+	return prevTXs, nil
+}
+
+// check if `block` is valid on top of the blockchain: proof of work,
+// transaction IDs, witness commitment and all transactions. Schnorr
+// signatures of all transactions are verified together in one batch.
+func (bc *Blockchain) ValidateBlock(block *Block) error {
+	if !bytes.Equal(block.PrevBlockHash, bc.tip) {
+		return errors.New("Block doesn't follow the tip of the blockchain")
+	}
+	if len(block.Transactions) == 0 || !block.Transactions[0].IsCoinbase() {
+		return errors.New("First transaction is not coinbase")
+	}
+	for i, tx := range block.Transactions {
+		if i > 0 && tx.IsCoinbase() {
+			return errors.New("Block contains more than one coinbase")
+		}
+		// txid doesn't cover witness, and wtxid is checked by the commitment
+		if bytes.Compare(tx.ID, tx.Hash()) != 0 {
+			return fmt.Errorf("Transaction %x has a wrong ID", tx.ID)
+		}
+		for _, out := range tx.Vout {
+			if out.Value < 0 {
+				return fmt.Errorf("Transaction %x has a negative output", tx.ID)
+			}
+		}
+	}
+
+	// PoW covers the merkle root of transaction IDs
+	if !NewProofOfWork(block).Validate() {
+		return errors.New("Proof of work is invalid")
+	}
+
+	commitment := block.Transactions[0].WitnessCommitment()
+	if bytes.Compare(commitment, block.HashWitnesses()) != 0 {
+		return errors.New("Witness commitment doesn't match")
+	}
+
+	return bc.verifyBlockTransactions(block.Transactions, block.Height)
+}
+
+// check the transactions of a block at `height` on the tip, the first one
+// being its coinbase, against the UTXO set and each other
+func (bc *Blockchain) verifyBlockTransactions(transactions []*Transaction, height int) error {
+	// every input spends an output of the UTXO set, or of a transaction
+	// before it in the block, which no input before it spends
+	UTXOSet := UTXOSet{bc}
+	spent := make(map[string]bool) // "txid:vout"
+	blockTXs := make(map[string]Transaction)
+	for _, tx := range transactions[1:] {
+		for _, vin := range tx.Vin {
+			outpoint := fmt.Sprintf("%x:%d", vin.Txid, vin.Vout)
+			if spent[outpoint] {
+				return fmt.Errorf("Output %s is spent twice", outpoint)
+			}
+			_, inBlock := blockTXs[hex.EncodeToString(vin.Txid)]
+			if !inBlock && !UTXOSet.IsUnspent(vin.Txid, vin.Vout) {
+				return fmt.Errorf("Transaction %x spends %s, which is not in the UTXO set", tx.ID, outpoint)
+			}
+			spent[outpoint] = true
+		}
+		blockTXs[hex.EncodeToString(tx.ID)] = *tx
+	}
+
+	batch := &schnorrBatch{}
+	fees := 0
+	for _, tx := range transactions[1:] {
+		fee, err := bc.verifyTransaction(tx, height, batch, blockTXs)
+		if err != nil {
+			return fmt.Errorf("Transaction %x is invalid: %s", tx.ID, err)
+		}
+		fees += fee
+	}
+
+	// the coinbase may claim the subsidy and the fees, no more
+	reward := 0
+	for _, out := range transactions[0].Vout {
+		reward += out.Value
+	}
+	if reward > chainParams.Subsidy+fees {
+		return fmt.Errorf("Coinbase pays %d, more than the subsidy and the fees, %d", reward, chainParams.Subsidy+fees)
+	}
+	if !batch.Verify() {
+		return errors.New("Schnorr signatures are invalid")
+	}
+
+	return nil
 }
 
 // return true if db file exisit, otherwise false
 func dbExists() bool {
-	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
+	if _, err := os.Stat(dataFile(dbFile)); os.IsNotExist(err) {
 		return false
 	}
 	return true
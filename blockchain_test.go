@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// create a regtest blockchain in a temporary data directory, with the
+// genesis block paying `miner`
+func newTestBlockchain(t *testing.T, miner *Wallet) *Blockchain {
+	params, dir := chainParams, dataDir
+	chainParams, dataDir = &regTestParams, t.TempDir()
+	t.Cleanup(func() { chainParams, dataDir = params, dir })
+
+	bc := CreateBlockchain(string(miner.GetAddress()), "")
+	t.Cleanup(func() { bc.db.Close() })
+	UTXOSet{bc}.Reindex()
+
+	return bc
+}
+
+// return a block on top of `prev` with a coinbase, with data `label`, paying
+// `miner` `fees` and then `txs`
+func newBlockOn(prev *Block, miner *Wallet, label string, fees int, txs ...*Transaction) *Block {
+	cbTx := NewCoinbaseTX(string(miner.GetAddress()), label, fees)
+
+	return NewBlock(append([]*Transaction{cbTx}, txs...), prev.Hash, prev.Height+1)
+}
+
+// return a block on top of `bc` with a coinbase paying `miner` `fees` and
+// then `txs`
+func newTestBlock(bc *Blockchain, miner *Wallet, fees int, txs ...*Transaction) *Block {
+	tip, err := bc.GetBlock(bc.tip)
+	logErr(err)
+
+	return newBlockOn(&tip, miner, strings.Repeat("x", tip.Height+1), fees, txs...)
+}
+
+// return a transaction paying `value` of output 0 of `prevTX`, which belongs
+// to `owner`, to `to`
+func newPaymentTX(prevTX *Transaction, owner, to *Wallet, value int) *Transaction {
+	in := TXInput{prevTX.ID, 0, nil, TXWitness{nil, owner.PublicKey, nil}}
+	tx := &Transaction{nil, []TXInput{in}, []TXOutput{*NewTXOutput(value, string(to.GetAddress()))}, 0}
+	tx.ID = tx.Hash()
+	tx.Sign(*owner, map[string]Transaction{hex.EncodeToString(prevTX.ID): *prevTX})
+
+	return tx
+}
+
+// return a transaction paying output 0 of `prevTX`, which belongs to `owner`,
+// to `to` without a fee
+func newSpendingTX(prevTX *Transaction, owner, to *Wallet) *Transaction {
+	return newPaymentTX(prevTX, owner, to, prevTX.Vout[0].Value)
+}
+
+// add valid `block` on top of `bc`
+func connectTestBlock(t *testing.T, bc *Blockchain, block *Block) {
+	if err := bc.ValidateBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	bc.AddBlock(block)
+	UTXOSet{bc}.Update(block)
+}
+
+// a peer can send a block spending outputs which don't exist
+func TestValidateBlockRejectsUnknownInput(t *testing.T) {
+	miner := NewWallet(false)
+	bc := newTestBlockchain(t, miner)
+
+	unknown := &Transaction{nil, []TXInput{{make([]byte, 32), 0, nil, TXWitness{}}}, []TXOutput{*NewTXOutput(5, string(miner.GetAddress()))}, 0}
+	unknown.ID = unknown.Hash()
+	if err := bc.ValidateBlock(newTestBlock(bc, miner, 0, unknown)); err == nil {
+		t.Error("a block spending an unknown transaction is valid")
+	}
+
+	genesis, err := bc.GetBlock(bc.tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outOfRange := &Transaction{nil, []TXInput{{genesis.Transactions[0].ID, 9, nil, TXWitness{}}}, []TXOutput{*NewTXOutput(5, string(miner.GetAddress()))}, 0}
+	outOfRange.ID = outOfRange.Hash()
+	if err := bc.ValidateBlock(newTestBlock(bc, miner, 0, outOfRange)); err == nil {
+		t.Error("a block spending an output out of range is valid")
+	}
+}
+
+func TestValidateBlockChecksUTXOSet(t *testing.T) {
+	miner, alice, bob := NewWallet(false), NewWallet(false), NewWallet(false)
+	bc := newTestBlockchain(t, miner)
+	genesis, err := bc.GetBlock(bc.tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase := genesis.Transactions[0]
+	toAlice := newSpendingTX(coinbase, miner, alice)
+	toBob := newSpendingTX(coinbase, miner, bob)
+
+	if err := bc.ValidateBlock(newTestBlock(bc, miner, 0, toAlice, toBob)); err == nil {
+		t.Error("a block spending an output twice is valid")
+	}
+	// an input may spend an output of a transaction before it in the block
+	block := newTestBlock(bc, miner, 0, toAlice, newSpendingTX(toAlice, alice, bob))
+	if err := bc.ValidateBlock(block); err != nil {
+		t.Errorf("a block spending an output created in it is invalid: %s", err)
+	}
+
+	connectTestBlock(t, bc, newTestBlock(bc, miner, 0, toAlice))
+	if err := bc.ValidateBlock(newTestBlock(bc, miner, 0, toBob)); err == nil {
+		t.Error("a block spending a spent output is valid")
+	}
+}
+
+func TestWitnessCommitmentIsNotUnspent(t *testing.T) {
+	miner := NewWallet(false)
+	bc := newTestBlockchain(t, miner)
+	block := newTestBlock(bc, miner, 0)
+	connectTestBlock(t, bc, block)
+
+	coinbase := block.Transactions[0]
+	if !coinbase.Vout[1].IsWitnessCommitment() {
+		t.Fatal("the second output of the coinbase isn't the witness commitment")
+	}
+	UTXOSet := UTXOSet{bc}
+	if !UTXOSet.IsUnspent(coinbase.ID, 0) || UTXOSet.IsUnspent(coinbase.ID, 1) {
+		t.Error("the witness commitment is in the UTXO set after an update")
+	}
+	UTXOSet.Reindex()
+	if !UTXOSet.IsUnspent(coinbase.ID, 0) || UTXOSet.IsUnspent(coinbase.ID, 1) {
+		t.Error("the witness commitment is in the UTXO set after a reindex")
+	}
+}
+
+func TestValidateBlockChecksCoinbaseValue(t *testing.T) {
+	miner, alice := NewWallet(false), NewWallet(false)
+	bc := newTestBlockchain(t, miner)
+	genesis, err := bc.GetBlock(bc.tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase := genesis.Transactions[0]
+	payment := newPaymentTX(coinbase, miner, alice, coinbase.Vout[0].Value-3) // fee 3
+
+	if err := bc.ValidateBlock(newTestBlock(bc, miner, 3, payment)); err != nil {
+		t.Errorf("a coinbase claiming the subsidy and the fees is invalid: %s", err)
+	}
+	if err := bc.ValidateBlock(newTestBlock(bc, miner, 4, payment)); err == nil {
+		t.Error("a coinbase claiming more than the fees is valid")
+	}
+	if err := bc.ValidateBlock(newTestBlock(bc, miner, 1000000)); err == nil {
+		t.Error("a coinbase claiming 1000000 more than the subsidy is valid")
+	}
+
+	negative := newPaymentTX(coinbase, miner, alice, -5)
+	if err := bc.ValidateBlock(newTestBlock(bc, miner, 15, negative)); err == nil {
+		t.Error("a transaction with a negative output is valid")
+	}
+}
+
+// a negative output can't make another one larger than the inputs, on any
+// path which verifies transactions
+func TestMempoolRejectsNegativeOutput(t *testing.T) {
+	miner, alice := NewWallet(false), NewWallet(false)
+	bc := newTestBlockchain(t, miner)
+	genesis, err := bc.GetBlock(bc.tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase := genesis.Transactions[0]
+	value := coinbase.Vout[0].Value
+
+	in := TXInput{coinbase.ID, 0, nil, TXWitness{nil, miner.PublicKey, nil}}
+	outputs := []TXOutput{*NewTXOutput(value+1000, string(alice.GetAddress())), *NewTXOutput(-1000, string(alice.GetAddress()))}
+	tx := &Transaction{nil, []TXInput{in}, outputs, 0}
+	tx.ID = tx.Hash()
+	tx.Sign(*miner, map[string]Transaction{hex.EncodeToString(coinbase.ID): *coinbase})
+
+	if err := (Mempool{bc}).Add(tx); err == nil {
+		t.Error("a transaction with a negative output is added to the mempool")
+	}
+	if err := bc.VerifyTransaction(tx); err == nil {
+		t.Error("a transaction with a negative output is valid")
+	}
+}
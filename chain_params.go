@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ChainParams defines a network: chains of different networks never share a
+// genesis block, addresses or keys, and their nodes drop each other's
+// messages
+type ChainParams struct {
+	Name string
+
+	// genesis block and difficulty rules
+	GenesisCoinbaseData string // default coinbase data of the genesis block
+	TargetBits          int    // smaller targetBits, easier difficulty
+	Subsidy             int    // block reward paid by the coinbase, besides the fees
+	OnDemandMining      bool   // `generate` mines blocks, and broadcast transactions wait in the mempool for it
+
+	// address and key prefixes
+	AddressPrefix byte   // Base58Check address version
+	WIFPrefix     byte   // WIF private key version
+	Bech32HRP     string // human-readable part of bech32 addresses
+	XPrvVersion   []byte // extended private key version
+	XPubVersion   []byte // extended public key version
+
+	// network
+	DefaultPort int
+	Magic       [4]byte  // starts every message between nodes
+	SeedNodes   []string // nodes a new node connects to first
+	DataSubdir  string   // directory of the chain and wallet files, under the data directory
+}
+
+var mainNetParams = ChainParams{
+	Name:                "mainnet",
+	GenesisCoinbaseData: "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks",
+	TargetBits:          15,
+	Subsidy:             10,
+	AddressPrefix:       0x00,
+	WIFPrefix:           0x80,
+	Bech32HRP:           "bc",
+	XPrvVersion:         []byte{0x04, 0x88, 0xad, 0xe4}, // "xprv"
+	XPubVersion:         []byte{0x04, 0x88, 0xb2, 0x1e}, // "xpub"
+	DefaultPort:         3000,
+	Magic:               [4]byte{0xf9, 0xbe, 0xb4, 0xd9},
+	SeedNodes:           []string{"localhost:3000"},
+	DataSubdir:          "",
+}
+
+var testNetParams = ChainParams{
+	Name:                "testnet",
+	GenesisCoinbaseData: "Testnet genesis block",
+	TargetBits:          12,
+	Subsidy:             10,
+	AddressPrefix:       0x6f,
+	WIFPrefix:           0xef,
+	Bech32HRP:           "tb",
+	XPrvVersion:         []byte{0x04, 0x35, 0x83, 0x94}, // "tprv"
+	XPubVersion:         []byte{0x04, 0x35, 0x87, 0xcf}, // "tpub"
+	DefaultPort:         13000,
+	Magic:               [4]byte{0x0b, 0x11, 0x09, 0x07},
+	SeedNodes:           []string{"localhost:13000"},
+	DataSubdir:          "testnet",
+}
+
+// regtest is a private network for tests: a block is mined in a couple of
+// hashes, whenever `generate` is run
+var regTestParams = ChainParams{
+	Name:                "regtest",
+	GenesisCoinbaseData: "Regtest genesis block",
+	TargetBits:          1,
+	Subsidy:             10,
+	OnDemandMining:      true,
+	AddressPrefix:       0x6f,
+	WIFPrefix:           0xef,
+	Bech32HRP:           "bcrt",
+	XPrvVersion:         []byte{0x04, 0x35, 0x83, 0x94}, // "tprv"
+	XPubVersion:         []byte{0x04, 0x35, 0x87, 0xcf}, // "tpub"
+	DefaultPort:         23000,
+	Magic:               [4]byte{0xfa, 0xbf, 0xb5, 0xda},
+	SeedNodes:           []string{"localhost:23000"},
+	DataSubdir:          "regtest",
+}
+
+var networks = map[string]*ChainParams{
+	mainNetParams.Name: &mainNetParams,
+	testNetParams.Name: &testNetParams,
+	regTestParams.Name: &regTestParams,
+}
+
+// the network selected with --network
+var chainParams = &mainNetParams
+
+// directory holding the files of every network, set with --datadir so that
+// several nodes can run on one machine
+var dataDir = "."
+
+// take the flags every command accepts out of `tokens`: "--network <name>"
+// selects the network, "--datadir <dir>" the data directory
+func parseGlobalFlags(tokens []string) ([]string, error) {
+	var rest []string
+
+	for i := 0; i < len(tokens); i++ {
+		switch tokens[i] {
+		case "--network":
+			if i+1 == len(tokens) || networks[tokens[i+1]] == nil {
+				return nil, fmt.Errorf("--network takes one of %s", networkNames())
+			}
+			chainParams = networks[tokens[i+1]]
+			i++
+		case "--datadir":
+			if i+1 == len(tokens) || tokens[i+1] == "" {
+				return nil, errors.New("--datadir takes a directory")
+			}
+			dataDir = tokens[i+1]
+			i++
+		default:
+			rest = append(rest, tokens[i])
+		}
+	}
+
+	return rest, nil
+}
+
+func networkNames() string {
+	return strings.Join([]string{mainNetParams.Name, testNetParams.Name, regTestParams.Name}, ", ")
+}
+
+// return the path of file `name` of the selected network
+func dataFile(name string) string {
+	return filepath.Join(dataDir, chainParams.DataSubdir, name)
+}
+
+// create the directory of the files of the selected network
+func ensureDataDir() {
+	err := os.MkdirAll(filepath.Join(dataDir, chainParams.DataSubdir), 0700)
+	logErr(err)
+}
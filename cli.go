@@ -2,9 +2,19 @@
 package main
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ripemd160"
 )
 
 type CLI struct{}
@@ -12,12 +22,46 @@ type CLI struct{}
 // user manual
 func (cli CLI) usage() {
 	fmt.Println(`
-		createblockchain <address>  --  Create a blockchain and send genesis block reward to <address>
-		createwallet  --  Generates a new key-pair and saves it into the wallet file"
+		Every command takes --network mainnet|testnet|regtest (default: mainnet), which selects the chain, the wallet file and the address format, and --datadir <dir> (default: .), the directory of the chain and wallet files
+		createblockchain <address> [data]  --  Create a blockchain and send genesis block reward to <address>
+		createwallet [--schnorr] [--bech32] [--account <name>] [--passphrase <passphrase>]  --  Derives the next key-pair of an account (default: default) from the wallet seed and saves it into the wallet file. With --schnorr, coins are locked to the x-only public key and spent with Schnorr signatures. With --bech32, the address is in bech32 (bech32m with --schnorr) instead of Base58Check. The passphrase protects a new seed
+		createaccount <name>  --  Add an account, whose addresses and change addresses are derived apart from the others
+		wallet-backup  --  Print the mnemonic phrase of the wallet seed
+		wallet-restore <words>... [--passphrase <passphrase>]  --  Rebuild the wallet file from a mnemonic phrase and find its used addresses in the chain
+		getxpub [--schnorr] [--account <name>]  --  Print the extended public key of a wallet account
+		encryptwallet <passphrase>  --  Encrypt the private keys and seed in the wallet file with <passphrase>
+		walletpassphrase <passphrase> <seconds>  --  Unlock the encrypted wallet for <seconds>, so that transactions can be signed
+		walletlock  --  Lock the encrypted wallet again
+		scanwallet  --  Find the addresses of the wallet seed which hold coins, stopping after 20 unused addresses in a row
 		chain  --  Print all blocks of the blockchain
-		address  --  List all addresses from the wallet file
+		listaddresses [--balances]  --  List all addresses from the wallet file by account, with their labels and balances
+		setlabel <address> [label]  --  Label <address>, or remove its label
+		walletbalance  --  Print the balance of each account and of the whole wallet
 		balance <address>   --  Get balance of <address>
-		send <from> <to> <amount>  -- Send <amount> of coins from <from> to <to>
+		history <address>  --  List the transactions which sent or received coins of <address>
+		send <from> <to> <amount> [--fee <rate>] [--coins <strategy>]  -- Send <amount> of coins from <from> to <to>, paying <rate> coins per input and output (default 0). <strategy> picks the UTXOs: bnb (default, avoids change), largest, smallest or random
+		sendmany <from>[,<from>...] <address>:<amount>... [--fee <rate>] [--coins <strategy>]  --  Send to many addresses in one transaction, spending the UTXOs of one or more wallet addresses. The change goes back to the first <from>
+		dumpprivkey <address>  --  Print the private key of <address> in WIF
+		importprivkey <wif> [--schnorr]  --  Add a private key in WIF to the wallet and find its UTXOs. With --schnorr, its address is the x-only public key
+		importaddress <address>  --  Watch <address> without its private key
+		importxpub <xpub> [--schnorr]  --  Watch the addresses of an account extended public key. With --schnorr, its addresses are x-only public keys
+		listunspent  --  List the UTXOs of all wallet addresses, including watch-only ones
+		createrawtx <from> <to> <amount> [--fee <rate>] [--coins <strategy>]  --  Print an unsigned transaction sending <amount> from <from> to <to>, to be signed elsewhere
+		signrawtx <hex>  --  Sign the inputs of a transaction whose keys are in the wallet
+		sendrawtx <hex>  --  Mine a signed transaction, or on regtest add it to the mempool
+		createpsbt <from>[,<from>...] <address>:<amount>... [--fee <rate>] [--coins <strategy>]  --  Print a partially signed transaction (PSBT) making the payments, with the outputs it spends
+		signpsbt <psbt>  --  Sign the inputs of a PSBT whose keys are in the wallet. Needs only the wallet file, no blockchain
+		combinepsbt <psbt> <psbt>...  --  Merge the signatures of copies of a PSBT signed by different wallets
+		finalizepsbt <psbt>  --  Check that a PSBT is fully signed and print the raw transaction
+		broadcast <psbt>  --  Finalize a PSBT and mine its transaction, or on regtest add it to the mempool
+		generate <n> [address]  --  On regtest, mine <n> blocks at once paying <address> (default: a new wallet address), the first one with the mempool transactions, and print their hashes
+		htlcsecret  --  Generate a random HTLC secret and its hash
+		htlccreate <from> <to> <amount> <hash> <blocks>  --  Lock <amount> in a HTLC which <to> can claim with the secret of <hash>, or <from> can refund after <blocks> blocks
+		htlcclaim <txid> <secret>  --  Claim the HTLC in transaction <txid> by revealing <secret>
+		htlcrefund <txid>  --  Refund the expired HTLC in transaction <txid>
+		htlcextract <txid>  --  Print the secret revealed by whoever claimed the HTLC in transaction <txid>
+		startnode [--port <port>] [--miner <address>] [--datadir <dir>]  --  Start a node listening on <port> (default: the port of the network) with the chain in <dir>. With --miner, the node mines the transactions it receives and sends the rewards to <address>
+		getpeerinfo  --  List the peers of the node running on the data directory, with their round-trip time
 			`)
 }
 
@@ -42,20 +86,127 @@ func (cli CLI) init() {
 
 // handle command arguments
 func (cli CLI) handleCommands(tokens []string) {
+	tokens, err := parseGlobalFlags(tokens)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+	if len(tokens) == 0 {
+		cli.usage()
+		return
+	}
+
 	switch tokens[0] {
 	case "createblockchain":
-		if len(tokens) == 2 {
+		if len(tokens) == 2 || len(tokens) == 3 {
 			addr := tokens[1]
-			cli.createBlockchain(addr)
+			data := ""
+			if len(tokens) == 3 {
+				data = tokens[2]
+			}
+			cli.createBlockchain(addr, data)
 		} else {
-			fmt.Println("USAGE: creatleblockchain <address>")
+			fmt.Println("USAGE: createblockchain <address> [data]")
 		}
 	case "createwallet":
-		cli.createWallet()
+		schnorr, bech32 := false, false
+		account := defaultAccount
+		passphrase := ""
+		valid := true
+		for i := 1; i < len(tokens); i++ {
+			switch {
+			case tokens[i] == "--schnorr":
+				schnorr = true
+			case tokens[i] == "--bech32":
+				bech32 = true
+			case tokens[i] == "--account" && i+1 < len(tokens):
+				account = tokens[i+1]
+				i++
+			case tokens[i] == "--passphrase" && i+1 < len(tokens):
+				passphrase = tokens[i+1]
+				i++
+			default:
+				valid = false
+			}
+		}
+		if valid {
+			cli.createWallet(account, schnorr, bech32, passphrase)
+		} else {
+			fmt.Println("USAGE: createwallet [--schnorr] [--bech32] [--account <name>] [--passphrase <passphrase>]")
+		}
+	case "createaccount":
+		if len(tokens) == 2 {
+			cli.createAccount(tokens[1])
+		} else {
+			fmt.Println("USAGE: createaccount <name>")
+		}
+	case "wallet-backup":
+		cli.walletBackup()
+	case "wallet-restore":
+		words := tokens[1:]
+		passphrase := ""
+		if len(words) >= 2 && words[len(words)-2] == "--passphrase" {
+			passphrase = words[len(words)-1]
+			words = words[:len(words)-2]
+		}
+		if len(words) > 0 {
+			cli.walletRestore(strings.Join(words, " "), passphrase)
+		} else {
+			fmt.Println("USAGE: wallet-restore <words>... [--passphrase <passphrase>]")
+		}
+	case "getxpub":
+		schnorr := false
+		account := defaultAccount
+		valid := true
+		for i := 1; i < len(tokens); i++ {
+			switch {
+			case tokens[i] == "--schnorr":
+				schnorr = true
+			case tokens[i] == "--account" && i+1 < len(tokens):
+				account = tokens[i+1]
+				i++
+			default:
+				valid = false
+			}
+		}
+		if valid {
+			cli.getXPub(account, schnorr)
+		} else {
+			fmt.Println("USAGE: getxpub [--schnorr] [--account <name>]")
+		}
+	case "scanwallet":
+		cli.scanWallet()
+	case "encryptwallet":
+		if len(tokens) == 2 {
+			cli.encryptWallet(tokens[1])
+		} else {
+			fmt.Println("USAGE: encryptwallet <passphrase>")
+		}
+	case "walletpassphrase":
+		seconds, err := strconv.Atoi(tokens[len(tokens)-1])
+		if len(tokens) == 3 && err == nil && seconds > 0 {
+			cli.walletPassphrase(tokens[1], seconds)
+		} else {
+			fmt.Println("USAGE: walletpassphrase <passphrase> <seconds>")
+		}
+	case "walletlock":
+		cli.walletLock()
 	case "chain":
 		cli.printChain()
-	case "address":
-		cli.listAddresses()
+	case "address", "listaddresses":
+		if len(tokens) == 1 || (len(tokens) == 2 && tokens[1] == "--balances") {
+			cli.listAddresses(len(tokens) == 2)
+		} else {
+			fmt.Println("USAGE: listaddresses [--balances]")
+		}
+	case "setlabel":
+		if len(tokens) >= 2 {
+			cli.setLabel(tokens[1], strings.Join(tokens[2:], " "))
+		} else {
+			fmt.Println("USAGE: setlabel <address> [label]")
+		}
+	case "walletbalance":
+		cli.walletBalance()
 	case "balance":
 		if len(tokens) == 2 {
 			addr := tokens[1]
@@ -63,24 +214,269 @@ func (cli CLI) handleCommands(tokens []string) {
 		} else {
 			fmt.Println("USAGE: balance <address>")
 		}
+	case "history":
+		if len(tokens) == 2 {
+			cli.history(tokens[1])
+		} else {
+			fmt.Println("USAGE: history <address>")
+		}
 	case "send":
-		if len(tokens) == 4 {
+		if len(tokens) >= 4 {
 			from := tokens[1]
 			to := tokens[2]
 			amount, err := strconv.Atoi(tokens[3])
+			selection, valid := parseCoinSelection(tokens[4:])
+			if err == nil && valid {
+				cli.send(from, to, amount, selection)
+			} else {
+				fmt.Println("USAGE: send <from> <to> <amount> [--fee <rate>] [--coins <strategy>]")
+			}
+		} else {
+			fmt.Println("USAGE: send <from> <to> <amount> [--fee <rate>] [--coins <strategy>]")
+		}
+	case "dumpprivkey":
+		if len(tokens) == 2 {
+			cli.dumpPrivKey(tokens[1])
+		} else {
+			fmt.Println("USAGE: dumpprivkey <address>")
+		}
+	case "importprivkey":
+		if len(tokens) == 2 || (len(tokens) == 3 && tokens[2] == "--schnorr") {
+			cli.importPrivKey(tokens[1], len(tokens) == 3)
+		} else {
+			fmt.Println("USAGE: importprivkey <wif> [--schnorr]")
+		}
+	case "sendmany":
+		from, payments, selection, valid := parsePaymentCommand(tokens)
+		if valid {
+			cli.sendMany(from, payments, selection)
+		} else {
+			fmt.Println("USAGE: sendmany <from>[,<from>...] <address>:<amount>... [--fee <rate>] [--coins <strategy>]")
+		}
+	case "createpsbt":
+		from, payments, selection, valid := parsePaymentCommand(tokens)
+		if valid {
+			cli.createPSBT(from, payments, selection)
+		} else {
+			fmt.Println("USAGE: createpsbt <from>[,<from>...] <address>:<amount>... [--fee <rate>] [--coins <strategy>]")
+		}
+	case "signpsbt":
+		if len(tokens) == 2 {
+			cli.signPSBT(tokens[1])
+		} else {
+			fmt.Println("USAGE: signpsbt <psbt>")
+		}
+	case "combinepsbt":
+		if len(tokens) >= 3 {
+			cli.combinePSBT(tokens[1:])
+		} else {
+			fmt.Println("USAGE: combinepsbt <psbt> <psbt>...")
+		}
+	case "finalizepsbt":
+		if len(tokens) == 2 {
+			cli.finalizePSBT(tokens[1])
+		} else {
+			fmt.Println("USAGE: finalizepsbt <psbt>")
+		}
+	case "broadcast":
+		if len(tokens) == 2 {
+			cli.broadcast(tokens[1])
+		} else {
+			fmt.Println("USAGE: broadcast <psbt>")
+		}
+	case "importaddress":
+		if len(tokens) == 2 {
+			cli.importAddress(tokens[1])
+		} else {
+			fmt.Println("USAGE: importaddress <address>")
+		}
+	case "importxpub":
+		if len(tokens) == 2 || (len(tokens) == 3 && tokens[2] == "--schnorr") {
+			cli.importXPub(tokens[1], len(tokens) == 3)
+		} else {
+			fmt.Println("USAGE: importxpub <xpub> [--schnorr]")
+		}
+	case "listunspent":
+		cli.listUnspent()
+	case "createrawtx":
+		if len(tokens) >= 4 {
+			amount, err := strconv.Atoi(tokens[3])
+			selection, valid := parseCoinSelection(tokens[4:])
+			if err == nil && valid {
+				cli.createRawTx(tokens[1], tokens[2], amount, selection)
+			} else {
+				fmt.Println("USAGE: createrawtx <from> <to> <amount> [--fee <rate>] [--coins <strategy>]")
+			}
+		} else {
+			fmt.Println("USAGE: createrawtx <from> <to> <amount> [--fee <rate>] [--coins <strategy>]")
+		}
+	case "signrawtx":
+		if len(tokens) == 2 {
+			cli.signRawTx(tokens[1])
+		} else {
+			fmt.Println("USAGE: signrawtx <hex>")
+		}
+	case "sendrawtx":
+		if len(tokens) == 2 {
+			cli.sendRawTx(tokens[1])
+		} else {
+			fmt.Println("USAGE: sendrawtx <hex>")
+		}
+	case "generate":
+		if len(tokens) == 2 || len(tokens) == 3 {
+			n, err := strconv.Atoi(tokens[1])
 			if err == nil {
-				cli.send(from, to, amount)
+				addr := ""
+				if len(tokens) == 3 {
+					addr = tokens[2]
+				}
+				cli.generate(n, addr)
+			} else {
+				fmt.Println("USAGE: generate <n> [address]")
+			}
+		} else {
+			fmt.Println("USAGE: generate <n> [address]")
+		}
+	case "htlcsecret":
+		cli.htlcSecret()
+	case "htlccreate":
+		if len(tokens) == 6 {
+			amount, err1 := strconv.Atoi(tokens[3])
+			blocks, err2 := strconv.Atoi(tokens[5])
+			if err1 == nil && err2 == nil {
+				cli.htlcCreate(tokens[1], tokens[2], amount, tokens[4], blocks)
 			} else {
-				fmt.Println("USAGE: send <from> <to> <amount>")
+				fmt.Println("USAGE: htlccreate <from> <to> <amount> <hash> <blocks>")
 			}
 		} else {
-			fmt.Println("USAGE: send <from> <to> <amount>")
+			fmt.Println("USAGE: htlccreate <from> <to> <amount> <hash> <blocks>")
+		}
+	case "htlcclaim":
+		if len(tokens) == 3 {
+			cli.htlcSpend(tokens[1], tokens[2])
+		} else {
+			fmt.Println("USAGE: htlcclaim <txid> <secret>")
 		}
+	case "htlcrefund":
+		if len(tokens) == 2 {
+			cli.htlcSpend(tokens[1], "")
+		} else {
+			fmt.Println("USAGE: htlcrefund <txid>")
+		}
+	case "htlcextract":
+		if len(tokens) == 2 {
+			cli.htlcExtract(tokens[1])
+		} else {
+			fmt.Println("USAGE: htlcextract <txid>")
+		}
+	case "startnode":
+		port := chainParams.DefaultPort
+		miner := ""
+		valid := true
+		for i := 1; i < len(tokens); i++ {
+			switch {
+			case tokens[i] == "--port" && i+1 < len(tokens):
+				p, err := strconv.Atoi(tokens[i+1])
+				valid = valid && err == nil && p > 0 && p < 65536
+				port = p
+				i++
+			case tokens[i] == "--miner" && i+1 < len(tokens):
+				miner = tokens[i+1]
+				i++
+			default:
+				valid = false
+			}
+		}
+		if valid {
+			cli.startNode(port, miner)
+		} else {
+			fmt.Println("USAGE: startnode [--port <port>] [--miner <address>] [--datadir <dir>]")
+		}
+	case "getpeerinfo":
+		cli.getPeerInfo()
 	default:
 		cli.usage()
 	}
 }
 
+// start a node on `port`, mining to `miner` if it isn't empty
+func (cli *CLI) startNode(port int, miner string) {
+	if miner != "" && !ValidateAddress(miner) {
+		fmt.Println("ERROR: Miner address is not valid")
+		return
+	}
+	if !dbExists() {
+		fmt.Printf("ERROR: No blockchain in %s, create one or copy the %s of another node there\n", dataFile(""), dbFile)
+		return
+	}
+
+	fmt.Printf("Starting %s node localhost:%d with data in %s\n", chainParams.Name, port, dataFile(""))
+	if miner != "" {
+		fmt.Printf("Mining is on. Address to receive rewards: %s\n", miner)
+	}
+	StartServer(port, miner)
+}
+
+// print the peers saved by the node running on the data directory
+func (cli *CLI) getPeerInfo() {
+	saved, peers, err := LoadPeerInfo()
+	if err != nil {
+		fmt.Printf("ERROR: No peers saved in %s, start a node there first\n", dataFile(peerInfoFile))
+		return
+	}
+	if age := time.Since(saved); age > 3*peerInfoInterval {
+		fmt.Printf("Saved %s ago, the node may not be running\n", age.Round(time.Second))
+	}
+
+	for _, p := range peers {
+		direction := "outbound"
+		if p.Inbound {
+			direction = "inbound"
+		}
+		fmt.Printf("%s  %s  connected %s ago\n", p.Addr, direction, time.Since(p.ConnTime).Round(time.Second))
+		if !p.Handshake {
+			fmt.Println("    handshake in progress")
+			continue
+		}
+		fmt.Printf("    %s  version %d  services %d  height %d\n", p.UserAgent, p.Version, p.Services, p.BestHeight)
+		fmt.Printf("    ping %s  min ping %s", p.PingTime, p.MinPingTime)
+		if p.PingWait > 0 {
+			fmt.Printf("  waiting %s for pong", p.PingWait.Round(time.Millisecond))
+		}
+		fmt.Println()
+	}
+	fmt.Printf("%d peers\n", len(peers))
+}
+
+// parse the options `--fee <rate>` and `--coins <strategy>` of a command
+// sending coins
+func parseCoinSelection(args []string) (CoinSelection, bool) {
+	selection := CoinSelection{defaultCoinSelection, 0}
+
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return selection, false
+		}
+		switch args[i] {
+		case "--fee":
+			feeRate, err := strconv.Atoi(args[i+1])
+			if err != nil || feeRate < 0 {
+				return selection, false
+			}
+			selection.FeeRate = feeRate
+		case "--coins":
+			if !ValidCoinSelection(args[i+1]) {
+				return selection, false
+			}
+			selection.Strategy = args[i+1]
+		default:
+			return selection, false
+		}
+	}
+
+	return selection, true
+}
+
 // print chain
 func (cli *CLI) printChain() {
 	bc := LoadBlockchain()
@@ -105,23 +501,608 @@ func (cli *CLI) printChain() {
 		}
 	}
 }
-func (cli *CLI) createWallet() {
+func (cli *CLI) createWallet(account string, schnorr, bech32 bool, passphrase string) {
 	wallets, _ := NewWallets()
-	addr := wallets.CreateWallet()
+	if wallets.IsLocked() {
+		fmt.Printf("ERROR: %s\n", errWalletLocked)
+		return
+	}
+	index, err := wallets.AccountIndex(account)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+	if wallets.Seed == nil {
+		wallets.NewSeed(passphrase)
+	} else if passphrase != "" {
+		fmt.Println("ERROR: The wallet seed already exists, a passphrase only protects a new seed")
+		return
+	}
+	addr := wallets.CreateWallet(index, schnorr, bech32)
 	wallets.SaveToFile()
 
 	fmt.Printf("You new address: %s\n", addr)
 }
 
-func (cli *CLI) listAddresses() {
+// add account `name` to the wallet
+func (cli *CLI) createAccount(name string) {
+	wallets, _ := NewWallets()
+
+	index, err := wallets.CreateAccount(name)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+	wallets.SaveToFile()
+
+	fmt.Printf("Account '%s' created: %s\n", name, accountPath(index, false))
+}
+
+// print the extended public key of the account which `createwallet` derives
+// addresses from
+func (cli *CLI) getXPub(account string, schnorr bool) {
+	wallets, _ := NewWallets()
+	index, err := wallets.AccountIndex(account)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+
+	xpub, err := wallets.AccountXPub(index, schnorr)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+	fmt.Printf("%s: %s\n", accountPath(index, schnorr), xpub)
+}
+
+// print the mnemonic phrase which restores the wallet seed
+func (cli *CLI) walletBackup() {
+	wallets, _ := NewWallets()
+	if wallets.IsLocked() {
+		fmt.Printf("ERROR: %s\n", errWalletLocked)
+		return
+	}
+
+	if wallets.Mnemonic == "" {
+		fmt.Println("ERROR: The wallet has no mnemonic phrase, back up wallet.dat instead")
+		return
+	}
+	fmt.Println("Write down these words in order and keep them offline.")
+	fmt.Println("The passphrase, if you set one, is needed as well.")
+	fmt.Println()
+	fmt.Println(wallets.Mnemonic)
+}
+
+// rebuild the wallet file from `mnemonic`, adding the addresses which appear
+// in the chain
+func (cli *CLI) walletRestore(mnemonic, passphrase string) {
+	if _, err := os.Stat(dataFile(walletFile)); err == nil {
+		fmt.Printf("ERROR: %s already exists, move it away first\n", dataFile(walletFile))
+		return
+	}
+	wallets, err := RestoreWallets(mnemonic, passphrase)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+
+	if dbExists() {
+		bc := LoadBlockchain()
+		wallets.Scan(bc.FindLockingKeys())
+		bc.db.Close()
+	} else {
+		fmt.Println("No blockchain found, run scanwallet once it is created")
+	}
+	wallets.SaveToFile()
+
+	fmt.Printf("Restored %d addresses\n", len(wallets.Wallets))
+}
+
+// encrypt the wallet file with `passphrase`. The wallet stays locked until
+// walletpassphrase.
+func (cli *CLI) encryptWallet(passphrase string) {
+	wallets, err := NewWallets()
+	if err != nil {
+		fmt.Println("ERROR: No wallet file found. Create a wallet first.")
+		return
+	}
+	if err := wallets.Encrypt(passphrase); err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+	wallets.SaveToFile()
+	removeUnlockFile()
+
+	fmt.Println("Wallet encrypted. Unlock it with walletpassphrase to sign transactions.")
+	if _, err := os.Stat(dataFile(walletFile) + ".p256"); err == nil {
+		fmt.Printf("%s.p256 still holds plaintext keys from the P256 migration, delete it once you don't need it.\n", dataFile(walletFile))
+	}
+}
+
+// unlock the encrypted wallet for the commands run in the next `seconds`
+func (cli *CLI) walletPassphrase(passphrase string, seconds int) {
+	wallets, _ := NewWallets()
+
+	if err := wallets.Unlock(passphrase); err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+	wallets.writeUnlockFile(seconds)
+
+	fmt.Printf("Wallet unlocked for %d seconds\n", seconds)
+}
+
+func (cli *CLI) walletLock() {
+	removeUnlockFile()
+
+	fmt.Println("Wallet locked")
+}
+
+// add the addresses of the wallet seed which hold coins to the wallet file
+func (cli *CLI) scanWallet() {
+	wallets, _ := NewWallets()
+	if wallets.IsLocked() {
+		fmt.Printf("ERROR: %s\n", errWalletLocked)
+		return
+	}
+	bc := LoadBlockchain()
+	defer bc.db.Close()
+
+	// every key which ever received coins: an address emptied into a change
+	// address still counts as used
+	found := wallets.Scan(bc.FindLockingKeys())
+	wallets.SaveToFile()
+
+	fmt.Printf("Found %d new addresses\n", found)
+}
+
+// list the addresses of the wallet by account, with their labels and, if
+// `balances`, their balances
+func (cli *CLI) listAddresses(balances bool) {
+	wallets, err := NewWallets()
+	logErr(err)
+
+	var bc *Blockchain
+	if balances {
+		bc = LoadBlockchain()
+		defer bc.db.Close()
+	}
+
+	for _, account := range wallets.GroupByAccount() {
+		fmt.Printf("%s:\n", account.Name)
+		for _, addr := range account.Addresses {
+			line := "    " + addr
+			if balances {
+				line += fmt.Sprintf("  %d", UTXOSet{bc}.Balance(addr))
+			}
+			if label := wallets.Labels[addr]; label != "" {
+				line += fmt.Sprintf("  \"%s\"", label)
+			}
+			fmt.Println(line)
+		}
+	}
+}
+
+// label `addr`, or remove its label if `label` is empty
+func (cli *CLI) setLabel(addr, label string) {
+	wallets, _ := NewWallets()
+
+	if err := wallets.SetLabel(addr, label); err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+	wallets.SaveToFile()
+}
+
+// print the balance of each account and the total of the wallet. Watch-only
+// addresses aren't counted in the total.
+func (cli *CLI) walletBalance() {
+	wallets, err := NewWallets()
+	logErr(err)
+	bc := LoadBlockchain()
+	UTXOSet := UTXOSet{bc}
+	defer bc.db.Close()
+
+	total := 0
+	for _, account := range wallets.GroupByAccount() {
+		balance := 0
+		for _, addr := range account.Addresses {
+			balance += UTXOSet.Balance(addr)
+		}
+		if account.Name != watchOnlyAccount {
+			total += balance
+		}
+		fmt.Printf("%s: %d\n", account.Name, balance)
+	}
+	fmt.Printf("Total: %d\n", total)
+}
+
+// print the private key of `addr` in WIF
+func (cli *CLI) dumpPrivKey(addr string) {
+	wallets, _ := NewWallets()
+	if wallets.IsLocked() {
+		fmt.Printf("ERROR: %s\n", errWalletLocked)
+		return
+	}
+
+	wallet := wallets.Wallets[normalizeAddress(addr)]
+	if wallet == nil {
+		fmt.Println("ERROR: The wallet doesn't hold the key of this address")
+		return
+	}
+	if isLegacyPubKey(wallet.PublicKey) {
+		// a WIF key is a secp256k1 key, importing it would give another address
+		fmt.Println("ERROR: The key of this address is a legacy P256 key, which WIF can't hold")
+		return
+	}
+	if wallet.Schnorr {
+		fmt.Println("The address is an x-only public key, import it with importprivkey <wif> --schnorr")
+	}
+	fmt.Println(wallet.WIF())
+}
+
+// add the private key `wif` to the wallet, and rescan the UTXO set for the
+// coins it holds
+func (cli *CLI) importPrivKey(wif string, schnorr bool) {
+	privateKey, err := DecodeWIF(wif)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+	wallets, _ := NewWallets()
+
+	addr, err := wallets.ImportPrivateKey(privateKey, schnorr)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+	wallets.SaveToFile()
+	fmt.Printf("Imported '%s'\n", addr)
+
+	if !dbExists() {
+		return
+	}
+	bc := LoadBlockchain()
+	UTXOSet := UTXOSet{bc}
+	defer bc.db.Close()
+
+	balance := 0
+	UTXOs := UTXOSet.FindUnspent(decodeAddress(addr))
+	for _, utxo := range UTXOs {
+		balance += utxo.Output.Value
+	}
+	fmt.Printf("Found %d UTXOs, balance %d\n", len(UTXOs), balance)
+}
+
+// watch `addr` without its private key
+func (cli *CLI) importAddress(addr string) {
+	if !ValidateAddress(addr) {
+		log.Panic("ERROR: Address is not valid")
+	}
+	wallets, _ := NewWallets()
+
+	if err := wallets.ImportAddress(addr); err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+	wallets.SaveToFile()
+
+	fmt.Printf("Watching '%s'\n", addr)
+}
+
+// watch the addresses derived from `xpub` which appear in the chain, and the
+// unused ones after them
+func (cli *CLI) importXPub(xpub string, schnorr bool) {
+	wallets, _ := NewWallets()
+	bc := LoadBlockchain()
+	defer bc.db.Close()
+
+	found, err := wallets.ImportXPub(xpub, schnorr, bc.FindLockingKeys())
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+	wallets.SaveToFile()
+
+	fmt.Printf("Watching %d addresses of the extended public key\n", found)
+}
+
+// list the UTXOs of the wallet addresses, with or without their keys
+func (cli *CLI) listUnspent() {
 	wallets, err := NewWallets()
 	logErr(err)
+	bc := LoadBlockchain()
+	UTXOSet := UTXOSet{bc}
+	defer bc.db.Close()
 
-	addresses := wallets.GetAddresses()
+	var addresses []string
+	for addr := range wallets.Wallets {
+		addresses = append(addresses, addr)
+	}
+	for addr := range wallets.WatchOnly {
+		addresses = append(addresses, addr)
+	}
+	sort.Strings(addresses)
 
+	total := 0
 	for _, addr := range addresses {
-		fmt.Println(addr)
+		for _, utxo := range UTXOSet.FindUnspent(decodeAddress(addr)) {
+			watchOnly := ""
+			if wallets.WatchOnly[addr] != nil {
+				watchOnly = " (watch-only)"
+			}
+			fmt.Printf("%x:%d  %d  %s%s\n", utxo.Txid, utxo.Vout, utxo.Output.Value, addr, watchOnly)
+			total += utxo.Output.Value
+		}
+	}
+	fmt.Printf("Total: %d\n", total)
+}
+
+// print an unsigned transaction sending `amount` from `from` to `to`
+func (cli *CLI) createRawTx(from, to string, amount int, selection CoinSelection) {
+	if !ValidateAddress(from) {
+		log.Panic("ERROR: Sender address is not valid")
+	}
+	if !ValidateAddress(to) {
+		log.Panic("ERROR: Recipient address is not valid")
+	}
+	wallets, _ := NewWallets()
+	bc := LoadBlockchain()
+	UTXOSet := UTXOSet{bc}
+	defer bc.db.Close()
+
+	tx := NewUnsignedTransaction([]string{from}, []Payment{{to, amount}}, from, wallets, selection, &UTXOSet)
+	if tx == nil {
+		fmt.Println("Create Transaction Failed!")
+		return
+	}
+	fmt.Printf("%x\n", tx.Serialize())
+}
+
+// sign the inputs of raw transaction `txHex` which the wallet has keys for
+func (cli *CLI) signRawTx(txHex string) {
+	tx, err := decodeRawTransaction(txHex)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+	wallets, _ := NewWallets()
+	if wallets.IsLocked() {
+		fmt.Printf("ERROR: %s\n", errWalletLocked)
+		return
+	}
+	bc := LoadBlockchain()
+	defer bc.db.Close()
+
+	signed := wallets.SignTransaction(tx, bc)
+
+	fmt.Printf("Signed %d of %d inputs\n", signed, len(tx.Vin))
+	fmt.Printf("%x\n", tx.Serialize())
+}
+
+// verify raw transaction `txHex` and mine it, rewarding the owner of its
+// first input like send does
+func (cli *CLI) sendRawTx(txHex string) {
+	tx, err := decodeRawTransaction(txHex)
+	if err != nil || tx.IsCoinbase() || len(tx.Vin) == 0 {
+		fmt.Println("ERROR: Transaction is not valid")
+		return
+	}
+	cli.broadcastTransaction(tx)
+}
+
+// mine signed transaction `tx` after checking that its inputs are unspent.
+// The miner is the owner of the first input. With on-demand mining, `tx`
+// waits in the mempool for `generate` instead.
+func (cli *CLI) broadcastTransaction(tx *Transaction) {
+	bc := LoadBlockchain()
+	UTXOSet := UTXOSet{bc}
+	defer bc.db.Close()
+
+	spent := make(map[string]bool)
+	for _, vin := range tx.Vin {
+		outpoint := fmt.Sprintf("%x:%d", vin.Txid, vin.Vout)
+		if spent[outpoint] || !UTXOSet.IsUnspent(vin.Txid, vin.Vout) {
+			fmt.Printf("ERROR: Input %s is not found or already spent\n", outpoint)
+			return
+		}
+		spent[outpoint] = true
+	}
+
+	if chainParams.OnDemandMining {
+		if err := (Mempool{bc}).Add(tx); err != nil {
+			fmt.Printf("ERROR: %s\n", err)
+			return
+		}
+		fmt.Printf("Transaction %x added to the mempool\n", tx.ID)
+		return
+	}
+
+	prevTx, err := bc.FindTransaction(tx.Vin[0].Txid)
+	logErr(err)
+	miner := encodeAddress(prevTx.Vout[tx.Vin[0].Vout].LockingKeys()[0])
+
+	if cli.mineTransaction(&UTXOSet, tx, miner) == nil {
+		fmt.Println("Send Failed!")
+		return
+	}
+	fmt.Printf("Transaction %x mined\n", tx.ID)
+}
+
+// mine `n` blocks paying `addr`, or a new address of the wallet, and print
+// their hashes
+func (cli *CLI) generate(n int, addr string) {
+	if !chainParams.OnDemandMining {
+		fmt.Printf("ERROR: Blocks are only generated on regtest, not on %s\n", chainParams.Name)
+		return
+	}
+	if addr == "" {
+		wallets, _ := NewWallets()
+		if wallets.IsLocked() {
+			fmt.Printf("ERROR: %s\n", errWalletLocked)
+			return
+		}
+		addr = wallets.CreateWallet(0, false, false)
+		wallets.SaveToFile()
+	} else if !ValidateAddress(addr) {
+		fmt.Println("ERROR: Address is not valid")
+		return
+	}
+	bc := LoadBlockchain()
+	UTXOSet := UTXOSet{bc}
+	defer bc.db.Close()
+
+	hashes, err := UTXOSet.Generate(n, addr)
+	for _, hash := range hashes {
+		fmt.Printf("%x\n", hash)
+	}
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+	}
+}
+
+// print a PSBT of a transaction from the addresses `from` making `payments`.
+// The wallet may only watch the addresses.
+func (cli *CLI) createPSBT(from []string, payments []Payment, selection CoinSelection) {
+	for _, addr := range append(append([]string{}, from...), paymentAddresses(payments)...) {
+		if !ValidateAddress(addr) {
+			fmt.Printf("ERROR: Address '%s' is not valid\n", addr)
+			return
+		}
+	}
+	wallets, _ := NewWallets()
+	bc := LoadBlockchain()
+	UTXOSet := UTXOSet{bc}
+	defer bc.db.Close()
+
+	change := wallets.ChangeAddress(from[0])
+	tx := NewUnsignedTransaction(from, payments, change, wallets, selection, &UTXOSet)
+	if tx == nil {
+		fmt.Println("Create PSBT Failed!")
+		return
+	}
+	if change != from[0] {
+		wallets.SaveToFile() // keep the key of the change address
+	}
+
+	psbt, err := NewPSBT(tx, bc)
+	logErr(err)
+	fmt.Println(psbt.Encode())
+}
+
+// return the addresses paid by `payments`
+func paymentAddresses(payments []Payment) []string {
+	var addresses []string
+	for _, payment := range payments {
+		addresses = append(addresses, payment.Address)
+	}
+	return addresses
+}
+
+// sign the inputs of `psbtBase64` which the wallet has keys for, without the
+// blockchain
+func (cli *CLI) signPSBT(psbtBase64 string) {
+	psbt, err := DecodePSBT(psbtBase64)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+	wallets, _ := NewWallets()
+	if wallets.IsLocked() {
+		fmt.Printf("ERROR: %s\n", errWalletLocked)
+		return
+	}
+
+	// the signer sees what it signs
+	for i, out := range psbt.Tx.Vout {
+		fmt.Printf("Output %d: %d to %s\n", i, out.Value, encodeAddress(out.LockingKeys()[0]))
+	}
+	// the values of the previous outputs come from whoever made the PSBT, and
+	// the signature hash doesn't commit to them, so neither does the fee
+	fmt.Printf("Fee: %d, if the previous outputs in the PSBT hold what it claims\n", psbt.Fee())
+
+	signed := wallets.SignPSBT(psbt)
+	complete := 0
+	for inID := range psbt.Tx.Vin {
+		if psbt.IsSigned(inID) {
+			complete++
+		}
+	}
+	fmt.Printf("Signed %d inputs, %d of %d inputs have signatures\n", signed, complete, len(psbt.Tx.Vin))
+	fmt.Println(psbt.Encode())
+}
+
+// merge the signatures of copies of the same PSBT
+func (cli *CLI) combinePSBT(psbts []string) {
+	combined, err := DecodePSBT(psbts[0])
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+
+	for _, psbtBase64 := range psbts[1:] {
+		psbt, err := DecodePSBT(psbtBase64)
+		if err == nil {
+			err = combined.Combine(psbt)
+		}
+		if err != nil {
+			fmt.Printf("ERROR: %s\n", err)
+			return
+		}
+	}
+	fmt.Println(combined.Encode())
+}
+
+// print the raw transaction of a fully signed PSBT, for sendrawtx
+func (cli *CLI) finalizePSBT(psbtBase64 string) {
+	psbt, err := DecodePSBT(psbtBase64)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+
+	tx, err := psbt.Finalize()
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+	fmt.Printf("%x\n", tx.Serialize())
+}
+
+// finalize a PSBT and mine its transaction
+func (cli *CLI) broadcast(psbtBase64 string) {
+	psbt, err := DecodePSBT(psbtBase64)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+
+	tx, err := psbt.Finalize()
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+	cli.broadcastTransaction(tx)
+}
+
+// decode a hex-encoded serialized transaction
+func decodeRawTransaction(txHex string) (*Transaction, error) {
+	data, err := hex.DecodeString(txHex)
+	if err != nil {
+		return nil, errors.New("transaction is not valid hex")
+	}
+
+	var tx Transaction
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&tx); err != nil {
+		return nil, errors.New("transaction can't be decoded")
+	}
+	if bytes.Compare(tx.ID, tx.Hash()) != 0 {
+		return nil, errors.New("transaction ID doesn't match its content")
 	}
+
+	return &tx, nil
 }
 
 // get addr's balance
@@ -133,18 +1114,37 @@ func (cli *CLI) getBalance(addr string) {
 	UTXOSet := UTXOSet{bc}
 	defer bc.db.Close()
 
-	balance := 0
-	pubKeyHash := Base58Decode([]byte(addr))
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUTXO(pubKeyHash)
-	for _, out := range UTXOs {
-		balance += out.Value
-	}
+	balance := UTXOSet.Balance(addr)
 	fmt.Printf("Balance of '%s': %d\n", addr, balance)
 }
 
-// send `amount` from `from` to `to`
-func (cli *CLI) send(from, to string, amount int) {
+// list the transactions of `addr`, oldest first
+func (cli *CLI) history(addr string) {
+	if !ValidateAddress(addr) {
+		log.Panic("ERROR: Address is not valid")
+	}
+	bc := LoadBlockchain()
+	defer bc.db.Close()
+
+	bestHeight := bc.GetBestHeight()
+	history := AddressIndex{bc}.FindHistory(decodeAddress(addr))
+	for _, entry := range history {
+		counterparties := "-"
+		if len(entry.Counterparties) > 0 {
+			counterparties = strings.Join(entry.Counterparties, ", ")
+		}
+
+		fmt.Printf("%x\n", entry.Txid)
+		fmt.Printf("    %-8s %d  height %d  %s  %d confirmations\n", entry.Direction(), entry.Amount(),
+			entry.Height, time.Unix(entry.Timestamp, 0).Format("2006-01-02 15:04:05"), bestHeight-entry.Height+1)
+		fmt.Printf("    %s\n", counterparties)
+	}
+	fmt.Printf("%d transactions\n", len(history))
+}
+
+// send `amount` from `from` to `to`, picking the UTXOs and paying the fee as
+// `selection` says
+func (cli *CLI) send(from, to string, amount int, selection CoinSelection) {
 	if !ValidateAddress(from) {
 		log.Panic("ERROR: Sender address is not valid")
 	}
@@ -155,25 +1155,101 @@ func (cli *CLI) send(from, to string, amount int) {
 	UTXOSet := UTXOSet{bc}
 	defer bc.db.Close()
 
-	tx := NewUTXOTransaction(from, to, amount, &UTXOSet)
-	cbTx := NewCoinbaseTX(from, "")
+	tx := NewUTXOTransaction(from, to, amount, selection, &UTXOSet)
+	if tx == nil { // the reason is logged by NewUTXOTransaction
+		fmt.Println("Send Failed!")
+		return
+	}
+	fee, err := bc.TransactionFee(tx)
+	logErr(err)
+	cbTx := NewCoinbaseTX(from, "", fee)
 	txs := []*Transaction{cbTx, tx}
 
 	newBlock := bc.MineBlock(txs) // the mined block only contains a coinbase and transaction which `from` send `to`
-	UTXOSet.Update(newBlock)      //update UTXO database
 	if newBlock != nil {
+		UTXOSet.Update(newBlock) //update UTXO database
 		fmt.Println("Send Success!")
 	} else {
 		fmt.Println("Send Failed, Not Enough Amounts!")
 	}
 }
 
+// send all `payments` in one transaction from the addresses `from`
+func (cli *CLI) sendMany(from []string, payments []Payment, selection CoinSelection) {
+	for _, addr := range from {
+		if !ValidateAddress(addr) {
+			fmt.Printf("ERROR: Sender address '%s' is not valid\n", addr)
+			return
+		}
+	}
+	for _, payment := range payments {
+		if !ValidateAddress(payment.Address) {
+			fmt.Printf("ERROR: Recipient address '%s' is not valid\n", payment.Address)
+			return
+		}
+	}
+	bc := LoadBlockchain()
+	UTXOSet := UTXOSet{bc}
+	defer bc.db.Close()
+
+	tx := NewSendManyTransaction(from, payments, selection, &UTXOSet)
+	if tx == nil { // the reason is logged by NewSendManyTransaction
+		fmt.Println("Send Failed!")
+		return
+	}
+	if cli.mineTransaction(&UTXOSet, tx, from[0]) == nil {
+		fmt.Println("Send Failed!")
+		return
+	}
+	fmt.Printf("Sent %d payments in transaction %x\n", len(payments), tx.ID)
+}
+
+// parse the arguments `<from>[,<from>...] <address>:<amount>... [options]`
+// of a command making payments
+func parsePaymentCommand(tokens []string) ([]string, []Payment, CoinSelection, bool) {
+	options := len(tokens)
+	for i := 2; i < len(tokens); i++ {
+		if strings.HasPrefix(tokens[i], "--") {
+			options = i
+			break
+		}
+	}
+	if len(tokens) < 3 || options < 3 {
+		return nil, nil, CoinSelection{}, false
+	}
+
+	from := strings.Split(tokens[1], ",")
+	payments, validPayments := parsePayments(tokens[2:options])
+	selection, validOptions := parseCoinSelection(tokens[options:])
+
+	return from, payments, selection, validPayments && validOptions
+}
+
+// parse the payments `<address>:<amount>` of sendmany
+func parsePayments(args []string) ([]Payment, bool) {
+	var payments []Payment
+
+	for _, arg := range args {
+		i := strings.LastIndex(arg, ":")
+		if i < 0 {
+			return nil, false
+		}
+		amount, err := strconv.Atoi(arg[i+1:])
+		if err != nil {
+			return nil, false
+		}
+		payments = append(payments, Payment{arg[:i], amount})
+	}
+
+	return payments, len(payments) > 0
+}
+
 // create a new blockchain
-func (cli *CLI) createBlockchain(addr string) {
+func (cli *CLI) createBlockchain(addr, data string) {
 	if !ValidateAddress(addr) {
 		log.Panic("ERROR: Address is not valid")
 	}
-	bc := CreateBlockchain(addr)
+	bc := CreateBlockchain(addr, data)
 	defer bc.db.Close()
 
 	UTXOSet := UTXOSet{bc}
@@ -181,3 +1257,119 @@ func (cli *CLI) createBlockchain(addr string) {
 
 	fmt.Println("Create Blockchain Success!")
 }
+
+// generate a HTLC secret. The secret is kept by the swap initiator and only
+// the hash is given to the counterparty.
+func (cli *CLI) htlcSecret() {
+	secret, hash := NewHTLCSecret()
+
+	fmt.Printf("Secret: %x\n", secret)
+	fmt.Printf("Hash:   %x\n", hash)
+}
+
+// lock `amount` from `from` in a HTLC which expires `blocks` blocks later
+func (cli *CLI) htlcCreate(from, to string, amount int, hashHex string, blocks int) {
+	if !ValidateAddress(from) {
+		log.Panic("ERROR: Sender address is not valid")
+	}
+	if !ValidateAddress(to) {
+		log.Panic("ERROR: Recipient address is not valid")
+	}
+	if len(decodeAddress(from)) != ripemd160.Size || len(decodeAddress(to)) != ripemd160.Size {
+		log.Panic("ERROR: HTLC only supports public key hash addresses")
+	}
+	hash, err := hex.DecodeString(hashHex)
+	if err != nil || len(hash) != 32 {
+		log.Panic("ERROR: Hash is not valid")
+	}
+	bc := LoadBlockchain()
+	UTXOSet := UTXOSet{bc}
+	defer bc.db.Close()
+
+	timeout := bc.GetBestHeight() + blocks
+	tx, err := NewHTLCTransaction(from, to, amount, hash, timeout, &UTXOSet)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		fmt.Println("Create HTLC Failed!")
+		return
+	}
+
+	if cli.mineTransaction(&UTXOSet, tx, from) == nil {
+		fmt.Println("Create HTLC Failed!")
+		return
+	}
+	fmt.Printf("HTLC created in transaction %x, refundable from height %d\n", tx.ID, timeout)
+}
+
+// claim the HTLC in transaction `txidHex` with `secretHex`, or refund it if
+// `secretHex` is empty
+func (cli *CLI) htlcSpend(txidHex, secretHex string) {
+	txID, err := hex.DecodeString(txidHex)
+	if err != nil {
+		log.Panic("ERROR: Transaction ID is not valid")
+	}
+	var secret []byte
+	if secretHex != "" {
+		secret, err = hex.DecodeString(secretHex)
+		if err != nil {
+			log.Panic("ERROR: Secret is not valid")
+		}
+	}
+	bc := LoadBlockchain()
+	UTXOSet := UTXOSet{bc}
+	defer bc.db.Close()
+
+	tx, err := NewHTLCSpendTransaction(txID, secret, &UTXOSet)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+	if tx.LockTime > bc.GetBestHeight()+1 {
+		fmt.Printf("ERROR: HTLC can't be refunded before height %d\n", tx.LockTime)
+		return
+	}
+
+	wallets, err := NewWallets()
+	logErr(err)
+	addr := wallets.FindAddress(HashPubKey(tx.Vin[0].Witness.PubKey))
+	if cli.mineTransaction(&UTXOSet, tx, addr) == nil {
+		fmt.Println("Spend HTLC Failed!")
+		return
+	}
+	fmt.Printf("HTLC spent to '%s' in transaction %x\n", addr, tx.ID)
+}
+
+// print the secret revealed when the HTLC in transaction `txidHex` was claimed
+func (cli *CLI) htlcExtract(txidHex string) {
+	txID, err := hex.DecodeString(txidHex)
+	if err != nil {
+		log.Panic("ERROR: Transaction ID is not valid")
+	}
+	bc := LoadBlockchain()
+	defer bc.db.Close()
+
+	secret, err := bc.FindHTLCSecret(txID)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+	fmt.Printf("Secret: %x\n", secret)
+}
+
+// mine a block containing `tx` and a coinbase rewarding `miner`, then update
+// the UTXO set
+func (cli *CLI) mineTransaction(UTXOSet *UTXOSet, tx *Transaction, miner string) *Block {
+	fee, err := UTXOSet.Blockchain.TransactionFee(tx)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return nil
+	}
+	cbTx := NewCoinbaseTX(miner, "", fee)
+	txs := []*Transaction{cbTx, tx}
+
+	newBlock := UTXOSet.Blockchain.MineBlock(txs)
+	if newBlock != nil {
+		UTXOSet.Update(newBlock)
+	}
+	return newBlock
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+const (
+	defaultCoinSelection = "bnb"
+	bnbMaxTries          = 100000 // branch and bound gives up after visiting this many branches
+)
+
+// CoinSelection chooses how a transaction pays for itself
+type CoinSelection struct {
+	Strategy string // a key of coinSelectors
+	FeeRate  int    // fee in coins per input and per output of the transaction
+}
+
+// a coinSelector picks UTXOs whose effective values (value minus the fee of
+// spending it) add up to at least `target`, or returns nil
+type coinSelector func(utxos []UTXO, target, feeRate int) []UTXO
+
+var coinSelectors = map[string]coinSelector{
+	"bnb":      selectBranchAndBound,
+	"largest":  selectLargestFirst,
+	"smallest": selectSmallestFirst,
+	"random":   selectRandomImprove,
+}
+
+// check if `strategy` is a known coin selection strategy
+func ValidCoinSelection(strategy string) bool {
+	_, ok := coinSelectors[strategy]
+	return ok
+}
+
+// pick UTXOs from `utxos` paying `amount` to `outputs` recipients plus the
+// fee of the transaction at `selection.FeeRate`. "bnb" looks for a set which
+// needs no change, and falls back to "random" if there is none.
+//
+// returns: (selected UTXOs, change to send back, 0 for none)
+func SelectCoins(utxos []UTXO, amount, outputs int, selection CoinSelection) ([]UTXO, int, error) {
+	selector, ok := coinSelectors[selection.Strategy]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown coin selection strategy %q", selection.Strategy)
+	}
+	feeRate := selection.FeeRate
+	target := amount + outputs*feeRate
+
+	selected := selector(utxos, target, feeRate)
+	if selected == nil && selection.Strategy == "bnb" {
+		selected = selectRandomImprove(utxos, target, feeRate)
+	}
+	if selected == nil {
+		return nil, 0, fmt.Errorf("not enough funds: need %d plus fees", amount)
+	}
+
+	// a change output costs a fee now and another one when it's spent, so
+	// an excess up to that is left to the miner
+	excess := -target
+	for _, utxo := range selected {
+		excess += effectiveValue(utxo, feeRate)
+	}
+	if excess <= costOfChange(feeRate) {
+		return selected, 0, nil
+	}
+	return selected, excess - feeRate, nil
+}
+
+// value of `utxo` once the fee of spending it is paid
+func effectiveValue(utxo UTXO, feeRate int) int {
+	return utxo.Output.Value - feeRate
+}
+
+// fee of a change output, and of spending it later
+func costOfChange(feeRate int) int {
+	return 2 * feeRate
+}
+
+// return the UTXOs worth spending at `feeRate`, largest effective value first
+func spendableCoins(utxos []UTXO, feeRate int) []UTXO {
+	var coins []UTXO
+
+	for _, utxo := range utxos {
+		if effectiveValue(utxo, feeRate) > 0 {
+			coins = append(coins, utxo)
+		}
+	}
+	sort.SliceStable(coins, func(i, j int) bool {
+		return coins[i].Output.Value > coins[j].Output.Value
+	})
+
+	return coins
+}
+
+// take UTXOs from `coins` in order until they reach `target`
+func selectInOrder(coins []UTXO, target, feeRate int) []UTXO {
+	var selected []UTXO
+	accumulated := 0
+
+	for _, coin := range coins {
+		if accumulated >= target {
+			break
+		}
+		accumulated += effectiveValue(coin, feeRate)
+		selected = append(selected, coin)
+	}
+	if accumulated < target {
+		return nil
+	}
+
+	return selected
+}
+
+// largest first: the fewest inputs, leaving small UTXOs behind
+func selectLargestFirst(utxos []UTXO, target, feeRate int) []UTXO {
+	return selectInOrder(spendableCoins(utxos, feeRate), target, feeRate)
+}
+
+// smallest first: consolidates small UTXOs, at the cost of more inputs
+func selectSmallestFirst(utxos []UTXO, target, feeRate int) []UTXO {
+	coins := spendableCoins(utxos, feeRate)
+	for i, j := 0, len(coins)-1; i < j; i, j = i+1, j-1 {
+		coins[i], coins[j] = coins[j], coins[i]
+	}
+
+	return selectInOrder(coins, target, feeRate)
+}
+
+// branch and bound: search for UTXOs whose effective values reach `target`
+// without exceeding it by more than the cost of a change output, so the
+// transaction needs no change. The closest match found within bnbMaxTries
+// branches is returned.
+//
+// see https://murch.one/erhardt2016coinselection.pdf
+func selectBranchAndBound(utxos []UTXO, target, feeRate int) []UTXO {
+	coins := spendableCoins(utxos, feeRate)
+	upperBound := target + costOfChange(feeRate)
+
+	remaining := 0
+	for _, coin := range coins {
+		remaining += effectiveValue(coin, feeRate)
+	}
+	if remaining < target {
+		return nil
+	}
+
+	var best []UTXO
+	bestExcess := -1
+	var current []UTXO
+	tries := 0
+
+	var search func(i, value, remaining int)
+	search = func(i, value, remaining int) {
+		tries++
+		if tries > bnbMaxTries || bestExcess == 0 || value > upperBound {
+			return
+		}
+		if value >= target {
+			if best == nil || value-target < bestExcess {
+				best = append([]UTXO{}, current...)
+				bestExcess = value - target
+			}
+			return
+		}
+		if i == len(coins) || value+remaining < target {
+			return
+		}
+
+		ev := effectiveValue(coins[i], feeRate)
+		current = append(current, coins[i])
+		search(i+1, value+ev, remaining-ev)
+		current = current[:len(current)-1]
+
+		// leaving out coins[i] and taking an equal coin after it is a branch
+		// already searched, so skip the equal coins as well
+		j := i + 1
+		remaining -= ev
+		for j < len(coins) && effectiveValue(coins[j], feeRate) == ev {
+			remaining -= ev
+			j++
+		}
+		search(j, value, remaining)
+	}
+	search(0, 0, remaining)
+
+	return best
+}
+
+// random improve: pick random UTXOs until they reach `target`, then add
+// random UTXOs which bring the total closer to twice the target without
+// exceeding three times it, so the change is about the size of the payment
+// and can fund a similar payment later
+//
+// see https://cips.cardano.org/cips/cip2/
+func selectRandomImprove(utxos []UTXO, target, feeRate int) []UTXO {
+	coins := spendableCoins(utxos, feeRate)
+	rand.Shuffle(len(coins), func(i, j int) {
+		coins[i], coins[j] = coins[j], coins[i]
+	})
+
+	selected := selectInOrder(coins, target, feeRate)
+	if selected == nil {
+		return nil
+	}
+
+	value := 0
+	for _, coin := range selected {
+		value += effectiveValue(coin, feeRate)
+	}
+	ideal, limit := 2*target, 3*target
+
+	for _, coin := range coins[len(selected):] {
+		improved := value + effectiveValue(coin, feeRate)
+		if improved <= limit && abs(ideal-improved) < abs(ideal-value) {
+			selected = append(selected, coin)
+			value = improved
+		}
+	}
+
+	return selected
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+)
+
+// return UTXOs of `values`
+func newTestUTXOs(values ...int) []UTXO {
+	var utxos []UTXO
+	for i, value := range values {
+		utxos = append(utxos, UTXO{[]byte{byte(i)}, i, TXOutput{value, nil, nil, nil}})
+	}
+
+	return utxos
+}
+
+// return the values of `utxos`, in order
+func utxoValues(utxos []UTXO) []int {
+	var values []int
+	for _, utxo := range utxos {
+		values = append(values, utxo.Output.Value)
+	}
+
+	return values
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSelectLargestFirst(t *testing.T) {
+	utxos := newTestUTXOs(1, 5, 3, 10)
+
+	if got := utxoValues(selectLargestFirst(utxos, 12, 0)); !equalInts(got, []int{10, 5}) {
+		t.Errorf("selected %v, want [10 5]", got)
+	}
+	// 10 and 5 are worth 9 and 4 once their fee is paid
+	if got := utxoValues(selectLargestFirst(utxos, 14, 1)); !equalInts(got, []int{10, 5, 3}) {
+		t.Errorf("selected %v, want [10 5 3]", got)
+	}
+	if selected := selectLargestFirst(utxos, 20, 0); selected != nil {
+		t.Errorf("selected %v, more than the UTXOs are worth", utxoValues(selected))
+	}
+}
+
+func TestSelectSmallestFirst(t *testing.T) {
+	utxos := newTestUTXOs(1, 5, 3, 10)
+
+	if got := utxoValues(selectSmallestFirst(utxos, 8, 0)); !equalInts(got, []int{1, 3, 5}) {
+		t.Errorf("selected %v, want [1 3 5]", got)
+	}
+	// 1 is dust, worth nothing once its fee is paid
+	if got := utxoValues(selectSmallestFirst(utxos, 8, 1)); !equalInts(got, []int{3, 5, 10}) {
+		t.Errorf("selected %v, want [3 5 10]", got)
+	}
+}
+
+// branch and bound finds UTXOs needing no change, even when taking the
+// largest ones first doesn't
+func TestSelectBranchAndBound(t *testing.T) {
+	for _, feeRate := range []int{0, 1} {
+		utxos := newTestUTXOs(10+feeRate, 7+feeRate, 5+feeRate, 4+feeRate, 1+feeRate)
+		selected := selectBranchAndBound(utxos, 9, feeRate)
+		if selected == nil {
+			t.Fatalf("fee rate %d: no UTXOs selected", feeRate)
+		}
+
+		value := 0
+		for _, utxo := range selected {
+			value += effectiveValue(utxo, feeRate)
+		}
+		if value < 9 || value > 9+costOfChange(feeRate) {
+			t.Errorf("fee rate %d: selected %v worth %d, want 9 without change", feeRate, utxoValues(selected), value)
+		}
+	}
+
+	if selected := selectBranchAndBound(newTestUTXOs(10), 3, 0); selected != nil {
+		t.Errorf("selected %v, which needs change", utxoValues(selected))
+	}
+}
+
+// random improve adds UTXOs bringing the total closer to twice the target,
+// so the change is about the size of the payment
+func TestSelectRandomImprove(t *testing.T) {
+	utxos := newTestUTXOs(5, 5, 5, 5, 5, 5, 5, 5)
+
+	if got := utxoValues(selectRandomImprove(utxos, 10, 0)); !equalInts(got, []int{5, 5, 5, 5}) {
+		t.Errorf("selected %v, want four UTXOs of 5", got)
+	}
+	if selected := selectRandomImprove(utxos, 41, 0); selected != nil {
+		t.Errorf("selected %v, more than the UTXOs are worth", utxoValues(selected))
+	}
+}
+
+// the fees of the inputs and of the outputs are paid, and an excess not
+// worth a change output goes to the miner
+func TestSelectCoinsChange(t *testing.T) {
+	utxos := newTestUTXOs(10)
+
+	tests := []struct {
+		amount, change int
+	}{
+		{5, 2}, // 10 - 1 per input and per output, minus the fee of the change
+		{6, 0}, // an excess of 2 is the cost of a change output
+	}
+	for _, test := range tests {
+		selected, change, err := SelectCoins(utxos, test.amount, 1, CoinSelection{"largest", 1})
+		if err != nil || len(selected) != 1 || change != test.change {
+			t.Errorf("amount %d: selected %v, change %d, %v, want change %d", test.amount, utxoValues(selected), change, err, test.change)
+		}
+	}
+
+	// branch and bound finds no changeless set, random improve does
+	if selected, change, err := SelectCoins(utxos, 3, 1, CoinSelection{"bnb", 0}); err != nil || len(selected) != 1 || change != 7 {
+		t.Errorf("selected %v, change %d, %v, want change 7", utxoValues(selected), change, err)
+	}
+	if _, _, err := SelectCoins(utxos, 10, 1, CoinSelection{"largest", 1}); err == nil {
+		t.Error("coins are selected without enough funds")
+	}
+	if _, _, err := SelectCoins(utxos, 3, 1, CoinSelection{"unknown", 1}); err == nil {
+		t.Error("coins are selected with an unknown strategy")
+	}
+}
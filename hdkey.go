@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// HardenedKeyStart is the index of the first hardened child. A hardened child
+// can only be derived from the parent private key, so a leaked child private
+// key and the parent extended public key can't reveal the parent private key.
+const HardenedKeyStart = uint32(0x80000000)
+
+const (
+	extendedKeyLen = 78 // serialized length without the checksum
+	minSeedLen     = 16
+	maxSeedLen     = 64
+)
+
+var errInvalidChild = errors.New("derived key is invalid, use the next index")
+
+// ExtendedKey is a BIP32 key: a private or public key together with the chain
+// code needed to derive its children
+type ExtendedKey struct {
+	Key               []byte // 32-byte private key, or 33-byte compressed public key
+	ChainCode         []byte
+	Depth             byte
+	ParentFingerprint []byte // first 4 bytes of the parent public key hash
+	ChildNumber       uint32
+	Private           bool
+}
+
+// create the master key of `seed`
+//
+// I = HMAC-SHA512(key = "Bitcoin seed", data = seed), the left 32 bytes are
+// the private key and the right 32 bytes are the chain code
+func NewMasterKey(seed []byte) (*ExtendedKey, error) {
+	if len(seed) < minSeedLen || len(seed) > maxSeedLen {
+		return nil, fmt.Errorf("seed must be %d to %d bytes", minSeedLen, maxSeedLen)
+	}
+
+	I := hmacSHA512([]byte("Bitcoin seed"), seed)
+
+	var key btcec.ModNScalar
+	if overflow := key.SetByteSlice(I[:32]); overflow || key.IsZero() {
+		return nil, errors.New("seed gives an invalid master key")
+	}
+
+	return &ExtendedKey{I[:32], I[32:], 0, []byte{0, 0, 0, 0}, 0, true}, nil
+}
+
+// return the compressed public key of `k`
+func (k *ExtendedKey) PubKey() []byte {
+	if !k.Private {
+		return k.Key
+	}
+	privKey, _ := btcec.PrivKeyFromBytes(k.Key)
+
+	return privKey.PubKey().SerializeCompressed()
+}
+
+// derive child `i` of `k`. Indexes from HardenedKeyStart are hardened.
+//
+// I = HMAC-SHA512(key = chain code, data), where data is
+// 0x00 || private key || i for a hardened child, and public key || i otherwise.
+// The child key is parent key + I[:32] (as a scalar for a private key, as a
+// point for a public key), and the child chain code is I[32:].
+func (k *ExtendedKey) Child(i uint32) (*ExtendedKey, error) {
+	hardened := i >= HardenedKeyStart
+	if hardened && !k.Private {
+		return nil, errors.New("can't derive a hardened child from a public key")
+	}
+
+	var data []byte
+	if hardened {
+		data = append([]byte{0x00}, k.Key...)
+	} else {
+		data = append([]byte{}, k.PubKey()...)
+	}
+	index := make([]byte, 4)
+	binary.BigEndian.PutUint32(index, i)
+	data = append(data, index...)
+
+	I := hmacSHA512(k.ChainCode, data)
+
+	var tweak btcec.ModNScalar
+	if overflow := tweak.SetByteSlice(I[:32]); overflow {
+		return nil, errInvalidChild
+	}
+
+	var childKey []byte
+	if k.Private {
+		var parent btcec.ModNScalar
+		parent.SetByteSlice(k.Key)
+		tweak.Add(&parent)
+		if tweak.IsZero() {
+			return nil, errInvalidChild
+		}
+		key := tweak.Bytes()
+		childKey = key[:]
+	} else {
+		parent, err := btcec.ParsePubKey(k.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		var tweakPoint, parentPoint, child btcec.JacobianPoint
+		btcec.ScalarBaseMultNonConst(&tweak, &tweakPoint)
+		parent.AsJacobian(&parentPoint)
+		btcec.AddNonConst(&tweakPoint, &parentPoint, &child)
+		if (child.X.IsZero() && child.Y.IsZero()) || child.Z.IsZero() {
+			return nil, errInvalidChild
+		}
+		child.ToAffine()
+		childKey = btcec.NewPublicKey(&child.X, &child.Y).SerializeCompressed()
+	}
+
+	fingerprint := HashPubKey(k.PubKey())[:4]
+
+	return &ExtendedKey{childKey, I[32:], k.Depth + 1, fingerprint, i, k.Private}, nil
+}
+
+// derive the key at `path` below `k`, e.g. "m/44'/0'/0'/0/5". A "'" or "h"
+// suffix marks a hardened index.
+func (k *ExtendedKey) DerivePath(path string) (*ExtendedKey, error) {
+	indexes, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key := k
+	for _, i := range indexes {
+		key, err = key.Child(i)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// return the extended public key of `k`
+func (k *ExtendedKey) Neuter() *ExtendedKey {
+	if !k.Private {
+		return k
+	}
+	return &ExtendedKey{k.PubKey(), k.ChainCode, k.Depth, k.ParentFingerprint, k.ChildNumber, false}
+}
+
+// serialize `k` into its "xprv..." or "xpub..." form
+//
+// version (4) || depth (1) || parent fingerprint (4) || child number (4) ||
+// chain code (32) || 0x00 + private key or public key (33), Base58Check encoded
+func (k *ExtendedKey) String() string {
+	var payload []byte
+
+	if k.Private {
+		payload = append(payload, chainParams.XPrvVersion...)
+	} else {
+		payload = append(payload, chainParams.XPubVersion...)
+	}
+	payload = append(payload, k.Depth)
+	payload = append(payload, k.ParentFingerprint...)
+	index := make([]byte, 4)
+	binary.BigEndian.PutUint32(index, k.ChildNumber)
+	payload = append(payload, index...)
+	payload = append(payload, k.ChainCode...)
+	if k.Private {
+		payload = append(payload, 0x00)
+	}
+	payload = append(payload, k.Key...)
+
+	payload = append(payload, checksum(payload)...)
+	return string(Base58Encode(payload))
+}
+
+// parse a serialized "xprv..." or "xpub..." key
+func ParseExtendedKey(s string) (*ExtendedKey, error) {
+	payload := Base58Decode([]byte(s))
+	if len(payload) != extendedKeyLen+addressChecksumLen {
+		return nil, errors.New("extended key has a wrong length")
+	}
+
+	data := payload[:extendedKeyLen]
+	if bytes.Compare(checksum(data), payload[extendedKeyLen:]) != 0 {
+		return nil, errors.New("extended key has a wrong checksum")
+	}
+
+	version := data[:4]
+	depth := data[4]
+	fingerprint := data[5:9]
+	childNumber := binary.BigEndian.Uint32(data[9:13])
+	chainCode := data[13:45]
+	keyData := data[45:]
+
+	switch {
+	case bytes.Compare(version, chainParams.XPrvVersion) == 0:
+		var key btcec.ModNScalar
+		if keyData[0] != 0x00 {
+			return nil, errors.New("extended private key is not valid")
+		}
+		if overflow := key.SetByteSlice(keyData[1:]); overflow || key.IsZero() {
+			return nil, errors.New("extended private key is not valid")
+		}
+		return &ExtendedKey{keyData[1:], chainCode, depth, fingerprint, childNumber, true}, nil
+	case bytes.Compare(version, chainParams.XPubVersion) == 0:
+		if _, err := btcec.ParsePubKey(keyData); err != nil {
+			return nil, errors.New("extended public key is not valid")
+		}
+		return &ExtendedKey{keyData, chainCode, depth, fingerprint, childNumber, false}, nil
+	}
+	return nil, fmt.Errorf("extended key is not of %s", chainParams.Name)
+}
+
+// parse a derivation path like "m/44'/0'/0'/0/5" into child indexes
+func parsePath(path string) ([]uint32, error) {
+	parts := strings.Split(path, "/")
+	if parts[0] != "m" {
+		return nil, fmt.Errorf("derivation path %q doesn't start with m", path)
+	}
+
+	var indexes []uint32
+	for _, part := range parts[1:] {
+		offset := uint32(0)
+		if strings.HasSuffix(part, "'") || strings.HasSuffix(part, "h") {
+			offset = HardenedKeyStart
+			part = part[:len(part)-1]
+		}
+
+		i, err := strconv.ParseUint(part, 10, 32)
+		if err != nil || uint32(i) >= HardenedKeyStart {
+			return nil, fmt.Errorf("derivation path %q is not valid", path)
+		}
+		indexes = append(indexes, uint32(i)+offset)
+	}
+	return indexes, nil
+}
+
+func hmacSHA512(key, data []byte) []byte {
+	mac := hmac.New(sha512.New, key)
+	mac.Write(data)
+
+	return mac.Sum(nil)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+)
+
+const (
+	maxHeadersPerMessage = 2000
+	medianTimeSpan       = 11            // a block may not be older than the median time of this many blocks before it
+	maxFutureBlockTime   = 2 * time.Hour // a block may not be newer than the time of the node plus this
+)
+
+var errUnconnectedHeaders = errors.New("headers don't connect to the header chain")
+
+// headerChain is the chain of block headers with the most work the node
+// knows. During a download it runs ahead of the blockchain, which holds the
+// blocks of its headers up to height `connected`.
+//
+// When a fork with more work replaces headers of blocks of the blockchain,
+// they are kept in `replaced` until the blocks of the fork have more work,
+// so that the blockchain can go back to them if the fork turns out invalid
+// or its blocks never arrive.
+//
+// Only the goroutine handling the messages uses it.
+type headerChain struct {
+	headers   []BlockHeader  // by height
+	heights   map[string]int // hex block hash -> height
+	work      []*big.Int     // by height: work of the chain up to the header
+	connected int
+	replaced  []BlockHeader // nil unless a fork is being connected
+}
+
+// the header chain of the node, up to date with its blockchain on start
+var chainHeaders *headerChain
+
+// return the header chain of the blocks of `bc`
+func newHeaderChain(bc *Blockchain) *headerChain {
+	var headers []BlockHeader
+	bci := bc.Iterator()
+
+	for {
+		block := bci.Next()
+		headers = append(headers, block.Header())
+
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+	for i, j := 0, len(headers)-1; i < j; i, j = i+1, j-1 {
+		headers[i], headers[j] = headers[j], headers[i]
+	}
+
+	hc := &headerChain{nil, make(map[string]int), nil, len(headers) - 1, nil}
+	for _, h := range headers {
+		hc.append(h)
+	}
+
+	return hc
+}
+
+// return the work of the proof of work of `h`: the number of hashes it takes
+// on average, 2^256 / (target + 1). Every block of a network has the same
+// target.
+func headerWork(h *BlockHeader) *big.Int {
+	target := new(big.Int).Add(powTarget(), big.NewInt(1))
+
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), target)
+}
+
+// add `h` on top of the chain
+func (hc *headerChain) append(h BlockHeader) {
+	work := headerWork(&h)
+	if len(hc.work) > 0 {
+		work.Add(work, hc.work[len(hc.work)-1])
+	}
+
+	hc.heights[hex.EncodeToString(h.Hash)] = len(hc.headers)
+	hc.headers = append(hc.headers, h)
+	hc.work = append(hc.work, work)
+}
+
+// return the height of the best header
+func (hc *headerChain) Height() int {
+	return len(hc.headers) - 1
+}
+
+// return the height of the header of `hash`, if in the chain
+func (hc *headerChain) HeightOf(hash []byte) (int, bool) {
+	height, ok := hc.heights[hex.EncodeToString(hash)]
+	return height, ok
+}
+
+// add `headers` sent by a peer, which follow each other and a header of the
+// chain. Headers known already are skipped. When they fork from the chain,
+// they replace its headers after the fork only if they have more work.
+//
+// returns: (number of headers added, error)
+func (hc *headerChain) Add(headers []BlockHeader) (int, error) {
+	if len(headers) == 0 {
+		return 0, nil
+	}
+	forkHeight, ok := hc.HeightOf(headers[0].PrevBlockHash)
+	if !ok {
+		return 0, errUnconnectedHeaders
+	}
+
+	for len(headers) > 0 && forkHeight < hc.Height() && bytes.Equal(hc.headers[forkHeight+1].Hash, headers[0].Hash) {
+		forkHeight++
+		headers = headers[1:]
+	}
+	work := new(big.Int).Set(hc.work[forkHeight])
+	for i := range headers {
+		work.Add(work, headerWork(&headers[i]))
+	}
+	if work.Cmp(hc.work[hc.Height()]) <= 0 {
+		return 0, nil
+	}
+
+	chain := make([]BlockHeader, forkHeight+1, forkHeight+1+len(headers))
+	copy(chain, hc.headers)
+	for i := range headers {
+		if err := validateHeader(&headers[i], chain); err != nil {
+			return 0, fmt.Errorf("header %x: %s", headers[i].Hash, err)
+		}
+		chain = append(chain, headers[i])
+	}
+
+	if forkHeight < hc.connected {
+		hc.keepReplaced(forkHeight)
+	}
+	hc.truncate(forkHeight + 1)
+	for _, h := range headers {
+		hc.append(h)
+	}
+
+	return len(headers), nil
+}
+
+// keep the headers of the blocks of the blockchain after `forkHeight`, which
+// a fork is about to replace
+func (hc *headerChain) keepReplaced(forkHeight int) {
+	if hc.replaced == nil {
+		hc.replaced = append([]BlockHeader{}, hc.headers[forkHeight+1:hc.connected+1]...)
+		return
+	}
+
+	// another fork while one is being connected: the blockchain goes back
+	// to the headers replaced by the first one
+	if firstFork := hc.replaced[0].Height - 1; forkHeight < firstFork {
+		hc.replaced = append(append([]BlockHeader{}, hc.headers[forkHeight+1:firstFork+1]...), hc.replaced...)
+	}
+}
+
+// go back to the headers replaced by the fork being connected
+func (hc *headerChain) restoreReplaced() {
+	hc.truncate(hc.replaced[0].Height)
+	for _, h := range hc.replaced {
+		hc.append(h)
+	}
+	hc.connected = hc.Height()
+	hc.replaced = nil
+}
+
+// record that the blockchain holds the block of height `height`, the one
+// after `connected`. A fork being connected is done once its blocks have
+// more work than the ones it replaced.
+func (hc *headerChain) connect(height int) {
+	hc.connected = height
+	if hc.replaced == nil {
+		return
+	}
+
+	firstFork := hc.replaced[0].Height - 1
+	replacedWork := new(big.Int).Set(hc.work[firstFork])
+	for i := range hc.replaced {
+		replacedWork.Add(replacedWork, headerWork(&hc.replaced[i]))
+	}
+	if hc.work[height].Cmp(replacedWork) > 0 {
+		hc.replaced = nil
+	}
+}
+
+// add the header of `block`, just mined on top of the blockchain. During a
+// download, a longer header chain keeps the block out.
+func (hc *headerChain) AddMinedBlock(block *Block) {
+	if _, err := hc.Add([]BlockHeader{block.Header()}); err != nil {
+		fmt.Printf("Mined block %x is not in the header chain: %s\n", block.Hash, err)
+	}
+	if height, ok := hc.HeightOf(block.Hash); ok && height == hc.connected+1 {
+		hc.connect(height)
+	}
+}
+
+// drop the headers from `height` on
+func (hc *headerChain) truncate(height int) {
+	for _, h := range hc.headers[height:] {
+		delete(hc.heights, hex.EncodeToString(h.Hash))
+	}
+	hc.headers = hc.headers[:height]
+	hc.work = hc.work[:height]
+
+	if hc.connected >= height {
+		hc.connected = height - 1
+	}
+}
+
+// check that `h` can follow `chain`
+func validateHeader(h *BlockHeader, chain []BlockHeader) error {
+	parent := &chain[len(chain)-1]
+
+	if !bytes.Equal(h.PrevBlockHash, parent.Hash) {
+		return errors.New("it doesn't follow the previous header")
+	}
+	if h.Height != parent.Height+1 {
+		return fmt.Errorf("height %d doesn't follow %d", h.Height, parent.Height)
+	}
+	if !h.ValidatePoW() {
+		return errors.New("proof of work is invalid")
+	}
+	// blocks mined in the same second have the same time, so it may be equal
+	if h.Timestamp < medianTimePast(chain) {
+		return errors.New("it's older than the median time of the previous blocks")
+	}
+	if h.Timestamp > time.Now().Add(maxFutureBlockTime).Unix() {
+		return errors.New("it's too far in the future")
+	}
+
+	return nil
+}
+
+// return the median time of the last `medianTimeSpan` headers of `chain`
+func medianTimePast(chain []BlockHeader) int64 {
+	var times []int64
+	for i := len(chain) - 1; i >= 0 && len(times) < medianTimeSpan; i-- {
+		times = append(times, chain[i].Timestamp)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+	return times[len(times)/2]
+}
+
+// return a block locator of the chain: hashes from the best header back to
+// the genesis block, the first 10 one after the other, then twice sparser
+// at each step. The first hash a peer knows tells where the chains fork.
+func (hc *headerChain) Locator() [][]byte {
+	var locator [][]byte
+	step := 1
+
+	for height := hc.Height(); height > 0; height -= step {
+		locator = append(locator, hc.headers[height].Hash)
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+
+	return append(locator, hc.headers[0].Hash)
+}
+
+// return up to `max` headers following the first hash of `locator` in the
+// chain, or the genesis block, and stopping at `hashStop`. Only headers of
+// blocks in the blockchain are returned, which the peer can download next.
+func (hc *headerChain) HeadersAfter(locator [][]byte, hashStop []byte, max int) []BlockHeader {
+	start := 0
+	for _, hash := range locator {
+		if height, ok := hc.HeightOf(hash); ok && height <= hc.connected {
+			start = height
+			break
+		}
+	}
+
+	var headers []BlockHeader
+	for height := start + 1; height <= hc.connected && len(headers) < max; height++ {
+		headers = append(headers, hc.headers[height])
+		if bytes.Equal(hc.headers[height].Hash, hashStop) {
+			break
+		}
+	}
+
+	return headers
+}
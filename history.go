@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"log"
+
+	"github.com/boltdb/bolt"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"golang.org/x/crypto/ripemd160"
+)
+
+const historyBucket = "addrindex"
+
+// AddressIndex keeps the transactions of every address, so that the history
+// of an address is read without walking the chain. It's updated together
+// with the UTXO set.
+//
+// `addrindex` structure
+//
+//   - 'o' + 32-byte transaction hash + 4-byte output index -> key locking the output + 8-byte value
+//   - 'h' + 1-byte key length + key + 4-byte block height + 32-byte transaction hash -> HistoryEntry
+type AddressIndex struct {
+	Blockchain *Blockchain
+}
+
+// HistoryEntry is a transaction seen from one address
+type HistoryEntry struct {
+	Txid           []byte
+	Height         int
+	Timestamp      int64
+	Coinbase       bool
+	Received       int      // value of the outputs paying the address
+	Sent           int      // value of the outputs of the address spent by the inputs
+	Counterparties []string // the payers if the address gains coins, else the payees
+}
+
+// return "mined", "received", "sent", or "self" when the address only paid
+// itself
+func (e HistoryEntry) Direction() string {
+	switch {
+	case e.Coinbase:
+		return "mined"
+	case e.Received > e.Sent:
+		return "received"
+	case e.Received < e.Sent:
+		return "sent"
+	}
+	return "self"
+}
+
+// return how much the address gained or lost, fees included
+func (e HistoryEntry) Amount() int {
+	if e.Received > e.Sent {
+		return e.Received - e.Sent
+	}
+	return e.Sent - e.Received
+}
+
+// return the key which an output is indexed by: its public key hash or x-only
+// public key. It's nil for a HTLC output, which belongs to no address until
+// it's spent, and for an output paying no key, such as the witness commitment
+// of a coinbase.
+func indexKey(out TXOutput) []byte {
+	if out.HTLC != nil || out.IsWitnessCommitment() {
+		return nil
+	}
+	key := out.LockingKeys()[0]
+	if len(key) != ripemd160.Size && len(key) != schnorr.PubKeyBytesLen {
+		return nil
+	}
+	return key
+}
+
+func outputIndexKey(txID []byte, vout int) []byte {
+	key := append([]byte{'o'}, txID...)
+	return binary.BigEndian.AppendUint32(key, uint32(vout))
+}
+
+func historyPrefix(lockingKey []byte) []byte {
+	return append([]byte{'h', byte(len(lockingKey))}, lockingKey...)
+}
+
+// rebuild the index from the whole chain
+func (a AddressIndex) Reindex() {
+	db := a.Blockchain.db
+	bucketName := []byte(historyBucket)
+
+	var blocks []*Block
+	bci := a.Blockchain.Iterator()
+	for {
+		block := bci.Next()
+		blocks = append(blocks, block)
+
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(bucketName)
+		if err != nil && err != bolt.ErrBucketNotFound {
+			log.Panic(err)
+		}
+
+		b, err := tx.CreateBucket(bucketName)
+		logErr(err)
+
+		for i := len(blocks) - 1; i >= 0; i-- { // from the genesis block
+			indexBlock(b, blocks[i])
+		}
+		return nil
+	})
+	logErr(err)
+}
+
+// add the transactions of `block`, the latest block, to the index. An index
+// missing from an older database is built.
+func (a AddressIndex) Update(block *Block) {
+	indexed := false
+
+	err := a.Blockchain.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(historyBucket))
+		if b != nil {
+			indexBlock(b, block)
+			indexed = true
+		}
+		return nil
+	})
+	logErr(err)
+
+	if !indexed {
+		a.Reindex()
+	}
+}
+
+// add the outputs and history entries of `block` into bucket `b`
+func indexBlock(b *bolt.Bucket, block *Block) {
+	for _, tx := range block.Transactions {
+		for outIdx, out := range tx.Vout {
+			value := append([]byte{}, indexKey(out)...)
+			value = binary.BigEndian.AppendUint64(value, uint64(out.Value))
+			err := b.Put(outputIndexKey(tx.ID, outIdx), value)
+			logErr(err)
+		}
+	}
+
+	for _, tx := range block.Transactions {
+		entries := make(map[string]*HistoryEntry) // key -> entry
+		var payers, payees []string
+
+		entry := func(key []byte) *HistoryEntry {
+			if entries[string(key)] == nil {
+				entries[string(key)] = &HistoryEntry{tx.ID, block.Height, block.Timestamp, tx.IsCoinbase(), 0, 0, nil}
+			}
+			return entries[string(key)]
+		}
+
+		if !tx.IsCoinbase() {
+			for _, vin := range tx.Vin {
+				value := b.Get(outputIndexKey(vin.Txid, vin.Vout))
+				if len(value) <= 8 { // unknown or HTLC output
+					continue
+				}
+				key := value[:len(value)-8]
+				entry(key).Sent += int(binary.BigEndian.Uint64(value[len(value)-8:]))
+				payers = append(payers, encodeAddress(key))
+			}
+		}
+		for _, out := range tx.Vout {
+			if key := indexKey(out); key != nil {
+				entry(key).Received += out.Value
+				payees = append(payees, encodeAddress(key))
+			} else if out.HTLC != nil {
+				payees = append(payees, encodeAddress(out.HTLC.RecipientPubKeyHash))
+			}
+		}
+
+		for key, e := range entries {
+			self := encodeAddress([]byte(key))
+			counterparties := payees
+			if e.Received > e.Sent {
+				counterparties = payers
+			}
+			e.Counterparties = others(counterparties, self)
+
+			historyKey := binary.BigEndian.AppendUint32(historyPrefix([]byte(key)), uint32(e.Height))
+			historyKey = append(historyKey, tx.ID...)
+			err := b.Put(historyKey, e.Serialize())
+			logErr(err)
+		}
+	}
+}
+
+// return the distinct addresses of `addresses` other than `self`
+func others(addresses []string, self string) []string {
+	var result []string
+	seen := map[string]bool{self: true}
+
+	for _, addr := range addresses {
+		if !seen[addr] {
+			seen[addr] = true
+			result = append(result, addr)
+		}
+	}
+
+	return result
+}
+
+// return the transactions of `lockingKey` (a public key hash or an x-only
+// public key), oldest first
+func (a AddressIndex) FindHistory(lockingKey []byte) []HistoryEntry {
+	var history []HistoryEntry
+	indexed := false
+
+	err := a.Blockchain.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(historyBucket))
+		if b == nil {
+			return nil
+		}
+		indexed = true
+
+		prefix := historyPrefix(lockingKey)
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			history = append(history, DeserializeHistoryEntry(v))
+		}
+		return nil
+	})
+	logErr(err)
+
+	if !indexed {
+		a.Reindex()
+		return a.FindHistory(lockingKey)
+	}
+	return history
+}
+
+// serialize HistoryEntry
+func (e HistoryEntry) Serialize() []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(e)
+	logErr(err)
+
+	return buff.Bytes()
+}
+
+// deserialize HistoryEntry
+func DeserializeHistoryEntry(data []byte) HistoryEntry {
+	var entry HistoryEntry
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&entry)
+	logErr(err)
+
+	return entry
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// the witness commitment of a coinbase pays no address, so it has no history
+func TestHistorySkipsWitnessCommitment(t *testing.T) {
+	miner := NewWallet(false)
+	bc := newTestBlockchain(t, miner)
+	genesis, err := bc.GetBlock(bc.tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commitment := genesis.Transactions[0].Vout[len(genesis.Transactions[0].Vout)-1]
+	if !commitment.IsWitnessCommitment() {
+		t.Fatal("the genesis coinbase has no witness commitment")
+	}
+	if history := (AddressIndex{bc}).FindHistory(commitment.PubKeyHash); len(history) != 0 {
+		t.Errorf("the witness commitment has %d history entries", len(history))
+	}
+
+	history := AddressIndex{bc}.FindHistory(HashPubKey(miner.PublicKey))
+	if len(history) != 1 || !bytes.Equal(history[0].Txid, genesis.Transactions[0].ID) || history[0].Direction() != "mined" {
+		t.Errorf("the history of the miner is %v", history)
+	}
+}
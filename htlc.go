@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+const secretLen = 32
+
+// HTLC (hash time-locked contract) locks an output so that it can be spent
+// either by the recipient revealing the preimage of `Hash`, or by the sender
+// once the chain reaches block height `Timeout`.
+//
+// Two HTLCs sharing the same `Hash` on two chains make an atomic swap: the
+// party who claims first reveals the preimage, which lets the other party
+// claim too.
+type HTLC struct {
+	Hash                []byte // SHA-256 of the secret
+	RecipientPubKeyHash []byte // who can claim with the secret
+	RefundPubKeyHash    []byte // who can take the coins back after `Timeout`
+	Timeout             int    // block height from which refund is allowed
+}
+
+// create a new TXOutput locked by a HTLC
+func NewHTLCOutput(value int, to, refund string, hash []byte, timeout int) *TXOutput {
+	recipient := NewTXOutput(value, to).PubKeyHash
+	sender := NewTXOutput(value, refund).PubKeyHash
+
+	htlc := &HTLC{hash, recipient, sender, timeout}
+	return &TXOutput{value, nil, htlc, nil}
+}
+
+// check if `in` unlocks the contract via one of its two branches
+//
+// claim:  SHA-256(witness.Preimage) == Hash and `in` is signed by the recipient
+// refund: `lockTime` >= Timeout and `in` is signed by the sender
+func (h *HTLC) IsUnlockedBy(in *TXInput, lockTime int) bool {
+	witness := in.Witness
+	pubKeyHash := HashPubKey(witness.PubKey)
+
+	if len(witness.Preimage) > 0 {
+		hash := sha256.Sum256(witness.Preimage)
+		return bytes.Compare(hash[:], h.Hash) == 0 &&
+			bytes.Compare(pubKeyHash, h.RecipientPubKeyHash) == 0
+	}
+
+	return lockTime >= h.Timeout && bytes.Compare(pubKeyHash, h.RefundPubKeyHash) == 0
+}
+
+// return the SHA-256 hash of the contract, its two branches and their keys,
+// which a signature spending the HTLC output commits to
+func (h *HTLC) ContractHash() []byte {
+	var encoded bytes.Buffer
+
+	for _, data := range [][]byte{h.Hash, h.RecipientPubKeyHash, h.RefundPubKeyHash} {
+		encoded.Write(IntToHex(int64(len(data))))
+		encoded.Write(data)
+	}
+	encoded.Write(IntToHex(int64(h.Timeout)))
+	hash := sha256.Sum256(encoded.Bytes())
+
+	return hash[:]
+}
+
+// return a random secret and its SHA-256 hash
+func NewHTLCSecret() ([]byte, []byte) {
+	secret := make([]byte, secretLen)
+	_, err := rand.Read(secret)
+	logErr(err)
+	hash := sha256.Sum256(secret)
+
+	return secret, hash[:]
+}
+
+// create a transaction which locks `amount` from `from` in a HTLC that `to`
+// can claim with the secret of `hash`, or `from` can refund at height `timeout`
+func NewHTLCTransaction(from, to string, amount int, hash []byte, timeout int, UTXOSet *UTXOSet) (*Transaction, error) {
+	var inputs []TXInput
+	var outputs []TXOutput
+
+	wallets, err := NewWallets()
+	logErr(err)
+	if wallets.IsLocked() {
+		return nil, errWalletLocked
+	}
+	if wallets.Wallets[normalizeAddress(from)] == nil {
+		return nil, errors.New("Sender's key is not in the wallet file")
+	}
+	wallet := wallets.GetWallet(from)
+	acc, validOutputs := UTXOSet.FindSpendableOutputs(wallet.LockingKey(), amount)
+
+	if acc < amount {
+		return nil, errors.New("Not enough funds")
+	}
+
+	for txid, outs := range validOutputs {
+		txID, err := hex.DecodeString(txid)
+		logErr(err)
+
+		for _, out := range outs {
+			input := TXInput{txID, out, nil, TXWitness{nil, wallet.PublicKey, nil}}
+			inputs = append(inputs, input)
+		}
+	}
+
+	outputs = append(outputs, *NewHTLCOutput(amount, to, from, hash, timeout))
+	if acc > amount {
+		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+	}
+
+	tx := Transaction{nil, inputs, outputs, 0}
+	tx.ID = tx.Hash()
+	UTXOSet.Blockchain.SignTransaction(&tx, wallet)
+
+	return &tx, nil
+}
+
+// create a transaction which spends the HTLC output in transaction `htlcTxID`.
+// If `secret` is given, the coins are claimed by the recipient, otherwise they
+// are refunded to the sender.
+func NewHTLCSpendTransaction(htlcTxID, secret []byte, UTXOSet *UTXOSet) (*Transaction, error) {
+	bc := UTXOSet.Blockchain
+	vout, htlcOut, err := UTXOSet.FindHTLC(htlcTxID)
+	if err != nil {
+		return nil, err
+	}
+	htlc := htlcOut.HTLC
+
+	wallets, err := NewWallets()
+	logErr(err)
+	if wallets.IsLocked() {
+		return nil, errWalletLocked
+	}
+
+	pubKeyHash := htlc.RefundPubKeyHash
+	lockTime := htlc.Timeout
+	if secret != nil {
+		pubKeyHash = htlc.RecipientPubKeyHash
+		lockTime = 0
+	}
+	// the address of the key may be Base58Check or bech32
+	addr := wallets.FindAddress(pubKeyHash)
+	if addr == "" {
+		return nil, errors.New("HTLC key is not in the wallet file")
+	}
+	wallet := wallets.GetWallet(addr)
+
+	input := TXInput{htlcTxID, vout, nil, TXWitness{nil, wallet.PublicKey, secret}}
+	output := NewTXOutput(htlcOut.Value, addr)
+
+	tx := Transaction{nil, []TXInput{input}, []TXOutput{*output}, lockTime}
+	tx.ID = tx.Hash()
+	bc.SignTransaction(&tx, wallet)
+
+	return &tx, nil
+}
+
+// find the preimage revealed by the transaction which claimed the HTLC in
+// transaction `htlcTxID`
+func (bc *Blockchain) FindHTLCSecret(htlcTxID []byte) ([]byte, error) {
+	bci := bc.Iterator()
+
+	for {
+		block := bci.Next()
+
+		for _, tx := range block.Transactions {
+			for _, vin := range tx.Vin {
+				if bytes.Compare(vin.Txid, htlcTxID) == 0 && len(vin.Witness.Preimage) > 0 {
+					return vin.Witness.Preimage, nil
+				}
+			}
+		}
+
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+	return nil, errors.New("HTLC has not been claimed")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// save a wallet file holding a sender and a recipient, with bech32 addresses
+// if `bech32`, and a blockchain whose genesis block pays the sender
+func newTestHTLCWallets(t *testing.T, bech32 bool) (*Blockchain, *Wallet, *Wallet) {
+	wallets := emptyWallets()
+	sender := wallets.Wallets[wallets.CreateWallet(0, false, bech32)]
+	recipient := wallets.Wallets[wallets.CreateWallet(0, false, bech32)]
+	bc := newTestBlockchain(t, sender)
+	wallets.SaveToFile()
+
+	return bc, sender, recipient
+}
+
+// lock `amount` of `sender` in a mined HTLC which `recipient` can claim with
+// the secret of `hash`, or `sender` can refund from height `timeout`
+func newTestHTLC(t *testing.T, bc *Blockchain, sender, recipient *Wallet, amount int, hash []byte, timeout int) *Transaction {
+	UTXOSet := UTXOSet{bc}
+	tx, err := NewHTLCTransaction(string(sender.GetAddress()), string(recipient.GetAddress()), amount, hash, timeout, &UTXOSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connectTestBlock(t, bc, newTestBlock(bc, sender, 0, tx))
+
+	return tx
+}
+
+// the recipient claims an HTLC with the secret, which the sender can then
+// find in the chain
+func TestHTLCClaim(t *testing.T) {
+	bc, sender, recipient := newTestHTLCWallets(t, false)
+	UTXOSet := UTXOSet{bc}
+	secret, hash := NewHTLCSecret()
+	htlc := newTestHTLC(t, bc, sender, recipient, 3, hash, 100)
+
+	_, wrongSecret := NewHTLCSecret()
+	wrongClaim, err := NewHTLCSpendTransaction(htlc.ID, wrongSecret, &UTXOSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.ValidateBlock(newTestBlock(bc, sender, 0, wrongClaim)); err == nil {
+		t.Error("an HTLC is claimed with a wrong secret")
+	}
+
+	claim, err := NewHTLCSpendTransaction(htlc.ID, secret, &UTXOSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connectTestBlock(t, bc, newTestBlock(bc, sender, 0, claim))
+	if !claim.Vout[0].IsLockedWithKey(recipient.LockingKey()) || claim.Vout[0].Value != 3 {
+		t.Error("the claim doesn't pay the HTLC to the recipient")
+	}
+	revealed, err := bc.FindHTLCSecret(htlc.ID)
+	if err != nil || !bytes.Equal(revealed, secret) {
+		t.Errorf("found secret %x, %v, want %x", revealed, err, secret)
+	}
+}
+
+// the sender can take an HTLC back once the chain reaches its timeout, not
+// before
+func TestHTLCRefund(t *testing.T) {
+	bc, sender, recipient := newTestHTLCWallets(t, false)
+	UTXOSet := UTXOSet{bc}
+	_, hash := NewHTLCSecret()
+	timeout := bc.GetBestHeight() + 3
+	htlc := newTestHTLC(t, bc, sender, recipient, 3, hash, timeout)
+
+	refund, err := NewHTLCSpendTransaction(htlc.ID, nil, &UTXOSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refund.LockTime != timeout {
+		t.Errorf("refund has lock time %d, want %d", refund.LockTime, timeout)
+	}
+	if err := bc.ValidateBlock(newTestBlock(bc, sender, 0, refund)); err == nil {
+		t.Error("an HTLC is refunded before its timeout")
+	}
+
+	connectTestBlock(t, bc, newTestBlock(bc, sender, 0))
+	connectTestBlock(t, bc, newTestBlock(bc, sender, 0, refund))
+	if !refund.Vout[0].IsLockedWithKey(sender.LockingKey()) || refund.Vout[0].Value != 3 {
+		t.Error("the refund doesn't pay the HTLC back to the sender")
+	}
+}
+
+// a sender whose key is not in the wallet file is an error, not a panic
+func TestHTLCUnknownSender(t *testing.T) {
+	bc, _, recipient := newTestHTLCWallets(t, false)
+	UTXOSet := UTXOSet{bc}
+	_, hash := NewHTLCSecret()
+
+	stranger := string(NewWallet(false).GetAddress())
+	if _, err := NewHTLCTransaction(stranger, string(recipient.GetAddress()), 3, hash, 100, &UTXOSet); err == nil {
+		t.Error("an HTLC is created for a sender without a key")
+	}
+}
+
+// the keys of an HTLC are found whatever the encoding of their address
+func TestHTLCSpendWithBech32Wallets(t *testing.T) {
+	bc, sender, recipient := newTestHTLCWallets(t, true)
+	UTXOSet := UTXOSet{bc}
+	secret, hash := NewHTLCSecret()
+
+	claimed := newTestHTLC(t, bc, sender, recipient, 3, hash, 1)
+	refunded := newTestHTLC(t, bc, sender, recipient, 4, hash, 1)
+
+	claim, err := NewHTLCSpendTransaction(claimed.ID, secret, &UTXOSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claim.Vout[0].IsLockedWithKey(recipient.LockingKey()) {
+		t.Error("the claim doesn't pay the recipient")
+	}
+	refund, err := NewHTLCSpendTransaction(refunded.ID, nil, &UTXOSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !refund.Vout[0].IsLockedWithKey(sender.LockingKey()) {
+		t.Error("the refund doesn't pay the sender")
+	}
+	connectTestBlock(t, bc, newTestBlock(bc, sender, 0, claim, refund))
+}
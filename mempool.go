@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+const mempoolBucket = "mempool"
+
+// Mempool keeps the transactions waiting to be mined by `generate` on a
+// network with on-demand mining. Unlike the in-memory mempool of a node, it's
+// stored with the chain, so it outlives a command.
+//
+// `mempool` structure
+//
+//   - 32-byte transaction hash -> serialized transaction
+type Mempool struct {
+	Blockchain *Blockchain
+}
+
+// add `tx`, which must be valid in the next block and spend no output that
+// another transaction of the mempool spends
+func (m Mempool) Add(tx *Transaction) error {
+	if err := m.Blockchain.checkMempoolTransaction(tx, m.spentOutputs()); err != nil {
+		return err
+	}
+
+	err := m.Blockchain.db.Update(func(dbTx *bolt.Tx) error {
+		b, err := dbTx.CreateBucketIfNotExists([]byte(mempoolBucket))
+		logErr(err)
+
+		return b.Put(tx.ID, tx.Serialize())
+	})
+	logErr(err)
+
+	return nil
+}
+
+// return the transactions of the mempool, by ID
+func (m Mempool) Transactions() []*Transaction {
+	var txs []*Transaction
+
+	err := m.Blockchain.db.View(func(dbTx *bolt.Tx) error {
+		b := dbTx.Bucket([]byte(mempoolBucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			tx, err := DeserializeTransaction(v)
+			if err != nil {
+				return err
+			}
+			txs = append(txs, &tx)
+			return nil
+		})
+	})
+	logErr(err)
+
+	return txs
+}
+
+// check if `tx` may join a mempool whose transactions spend `spent`
+// ("txid:vout"): it's not a coinbase, it spends outputs of the UTXO set which
+// no transaction of the mempool spends, and it's valid in the next block. Its
+// inputs are then added to `spent`.
+func (bc *Blockchain) checkMempoolTransaction(tx *Transaction, spent map[string]bool) error {
+	if tx.IsCoinbase() {
+		return errors.New("a coinbase transaction can't be in the mempool")
+	}
+
+	UTXOSet := UTXOSet{bc}
+	spends := make(map[string]bool)
+	for _, vin := range tx.Vin {
+		outpoint := fmt.Sprintf("%x:%d", vin.Txid, vin.Vout)
+		if spent[outpoint] || spends[outpoint] || !UTXOSet.IsUnspent(vin.Txid, vin.Vout) {
+			return fmt.Errorf("input %s is not found or already spent", outpoint)
+		}
+		spends[outpoint] = true
+	}
+	if err := bc.VerifyTransaction(tx); err != nil {
+		return fmt.Errorf("transaction is invalid: %s", err)
+	}
+
+	for outpoint := range spends {
+		spent[outpoint] = true
+	}
+	return nil
+}
+
+// return the outputs spent by the mempool, as "txid:vout"
+func (m Mempool) spentOutputs() map[string]bool {
+	spent := make(map[string]bool)
+
+	for _, tx := range m.Transactions() {
+		for _, vin := range tx.Vin {
+			spent[fmt.Sprintf("%x:%d", vin.Txid, vin.Vout)] = true
+		}
+	}
+
+	return spent
+}
+
+// remove the transactions mined in `block`, the latest block, and the ones
+// spending an output which `block` spent
+func (m Mempool) Update(block *Block) {
+	spent := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		for _, vin := range tx.Vin {
+			spent[fmt.Sprintf("%x:%d", vin.Txid, vin.Vout)] = true
+		}
+	}
+
+	err := m.Blockchain.db.Update(func(dbTx *bolt.Tx) error {
+		b := dbTx.Bucket([]byte(mempoolBucket))
+		if b == nil {
+			return nil
+		}
+
+		var removed [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			tx, err := DeserializeTransaction(v)
+			if err != nil {
+				return err
+			}
+			for _, vin := range tx.Vin {
+				if spent[fmt.Sprintf("%x:%d", vin.Txid, vin.Vout)] {
+					removed = append(removed, k)
+					break
+				}
+			}
+			return nil
+		})
+		logErr(err)
+
+		for _, k := range removed {
+			err := b.Delete(k)
+			logErr(err)
+		}
+		return nil
+	})
+	logErr(err)
+}
+
+// mine `n` blocks paying `miner` at once, on a network with on-demand mining.
+// The first block includes the transactions of the mempool which are still
+// valid.
+//
+// returns the hashes of the blocks
+func (u UTXOSet) Generate(n int, miner string) ([][]byte, error) {
+	if !chainParams.OnDemandMining {
+		return nil, fmt.Errorf("blocks are only generated on regtest, not on %s", chainParams.Name)
+	}
+	if n < 1 {
+		return nil, errors.New("the number of blocks must be positive")
+	}
+	bc := u.Blockchain
+	var hashes [][]byte
+
+	for i := 0; i < n; i++ {
+		var txs []*Transaction
+		fees := 0
+		for _, tx := range (Mempool{bc}).Transactions() {
+			if bc.VerifyTransaction(tx) != nil {
+				continue
+			}
+			fee, err := bc.TransactionFee(tx)
+			logErr(err) // its inputs were found when verifying it
+			txs = append(txs, tx)
+			fees += fee
+		}
+
+		height := bc.GetBestHeight() + 1
+		cbTx := NewCoinbaseTX(miner, fmt.Sprintf("Reward to '%s' at height %d", miner, height), fees)
+
+		newBlock := bc.MineBlock(append([]*Transaction{cbTx}, txs...))
+		if newBlock == nil {
+			return hashes, errors.New("mining failed")
+		}
+		u.Update(newBlock)
+		hashes = append(hashes, newBlock.Hash)
+	}
+
+	return hashes, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	_ "embed"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/text/unicode/norm"
+)
+
+// BIP39 English wordlist, https://github.com/bitcoin/bips/blob/master/bip-0039/english.txt
+//
+//go:embed wordlists/english.txt
+var englishWordlist string
+
+var (
+	mnemonicWords   = strings.Fields(englishWordlist)
+	mnemonicIndexes = make(map[string]int)
+)
+
+const (
+	mnemonicEntropyLen = 32   // 24 words
+	seedIterations     = 2048 // PBKDF2 iterations from mnemonic to seed
+	bitsPerWord        = 11
+)
+
+func init() {
+	for i, word := range mnemonicWords {
+		mnemonicIndexes[word] = i
+	}
+}
+
+// encode `entropy` (16 to 32 bytes, a multiple of 4) into a BIP39 mnemonic
+//
+// A checksum of len(entropy)/4 bits (first bits of SHA-256(entropy)) is
+// appended, and every 11 bits select a word of the wordlist.
+func NewMnemonic(entropy []byte) (string, error) {
+	if len(entropy) < 16 || len(entropy) > 32 || len(entropy)%4 != 0 {
+		return "", errors.New("entropy must be 16 to 32 bytes, a multiple of 4")
+	}
+
+	checksumBits := uint(len(entropy) / 4)
+	hash := sha256.Sum256(entropy)
+
+	// entropy || checksum, as one number
+	data := new(big.Int).SetBytes(entropy)
+	data.Lsh(data, checksumBits)
+	data.Or(data, big.NewInt(int64(hash[0]>>(8-checksumBits))))
+
+	wordCount := (len(entropy)*8 + int(checksumBits)) / bitsPerWord
+	words := make([]string, wordCount)
+	mask := big.NewInt(1<<bitsPerWord - 1)
+	for i := wordCount - 1; i >= 0; i-- {
+		index := new(big.Int).And(data, mask)
+		words[i] = mnemonicWords[index.Int64()]
+		data.Rsh(data, bitsPerWord)
+	}
+
+	return strings.Join(words, " "), nil
+}
+
+// decode `mnemonic` back into its entropy, checking the words and checksum
+func MnemonicToEntropy(mnemonic string) ([]byte, error) {
+	words := strings.Fields(mnemonic)
+	if len(words) < 12 || len(words) > 24 || len(words)%3 != 0 {
+		return nil, errors.New("mnemonic must have 12, 15, 18, 21 or 24 words")
+	}
+
+	data := new(big.Int)
+	for _, word := range words {
+		index, ok := mnemonicIndexes[word]
+		if !ok {
+			return nil, fmt.Errorf("%q is not a mnemonic word", word)
+		}
+		data.Lsh(data, bitsPerWord)
+		data.Or(data, big.NewInt(int64(index)))
+	}
+
+	checksumBits := uint(len(words) / 3)
+	checksum := new(big.Int).And(data, big.NewInt(1<<checksumBits-1))
+	data.Rsh(data, checksumBits)
+
+	entropy := data.FillBytes(make([]byte, len(words)*4/3))
+	hash := sha256.Sum256(entropy)
+	if checksum.Int64() != int64(hash[0]>>(8-checksumBits)) {
+		return nil, errors.New("mnemonic has a wrong checksum")
+	}
+
+	return entropy, nil
+}
+
+// return the 64-byte seed of `mnemonic` protected by the optional
+// `passphrase`: PBKDF2-HMAC-SHA512 of the mnemonic, salted with
+// "mnemonic" + passphrase, both in NFKD form
+//
+// A different passphrase gives a different, equally valid wallet.
+func MnemonicToSeed(mnemonic, passphrase string) []byte {
+	password := norm.NFKD.String(strings.Join(strings.Fields(mnemonic), " "))
+	salt := norm.NFKD.String("mnemonic" + passphrase)
+
+	return pbkdf2.Key([]byte(password), []byte(salt), seedIterations, 64, sha512.New)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// every message between nodes is framed as in Bitcoin:
+//
+//	magic (4) || command (12) || payload length (4, little endian) || checksum (4) || payload
+//
+// where the checksum is the first 4 bytes of SHA-256(SHA-256(payload))
+const (
+	messageHeaderLen  = 4 + commandLength + 4 + 4
+	maxMessagePayload = 32 * 1024 * 1024 // a larger payload is a broken or hostile peer
+	sendQueueLen      = 256              // messages waiting to be written to a peer
+	inboxLen          = 256              // messages from all peers waiting to be handled
+	dialTimeout       = 5 * time.Second
+)
+
+// Peer is a long-lived connection to another node. A read loop passes its
+// messages to the node, and a write loop sends the queued ones, so requests
+// and replies flow both ways on the same connection.
+type Peer struct {
+	Addr    string // address the peer listens on, or an inbound peer connects from
+	Inbound bool   // the peer connected to us
+
+	ListenAddr string // address an inbound peer claims to listen on, guarded by the lock of `peerManager`
+
+	// from the `version` of the peer
+	Version     int
+	Services    uint64
+	UserAgent   string
+	StartHeight int
+
+	BestHeight  int           // height of the best block the peer is known to have
+	ConnTime    time.Time     // when the connection was made
+	PingTime    time.Duration // round-trip time of the last `ping`, 0 before its `pong`
+	MinPingTime time.Duration // shortest round-trip time
+
+	// handshake state, only used by the goroutine handling the messages
+	versionSent     bool
+	versionReceived bool
+	verackReceived  bool
+	pending         [][]byte // framed messages queued before the handshake completed
+	addrRequested   bool     // the peer sent `getaddr`, which is answered once
+	pingNonce       uint64   // nonce of the `ping` waiting for its `pong`, 0 if none
+	pingSent        time.Time
+
+	conn      net.Conn
+	sendQueue chan []byte // framed messages
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+// peerMessage is a message read from `peer`
+type peerMessage struct {
+	peer    *Peer
+	command string
+	payload []byte
+}
+
+var inbox = make(chan peerMessage, inboxLen) // handled one at a time by the node
+
+// frame a message
+func encodeMessage(command string, payload []byte) []byte {
+	var buff bytes.Buffer
+
+	buff.Write(chainParams.Magic[:])
+	buff.Write(commandToBytes(command))
+	err := binary.Write(&buff, binary.LittleEndian, uint32(len(payload)))
+	logErr(err)
+	buff.Write(messageChecksum(payload))
+	buff.Write(payload)
+
+	return buff.Bytes()
+}
+
+// read a framed message from `r`
+//
+// returns: (command, payload, error)
+func readMessage(r io.Reader) (string, []byte, error) {
+	header := make([]byte, messageHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", nil, err
+	}
+
+	if !bytes.Equal(header[:4], chainParams.Magic[:]) {
+		return "", nil, errors.New("message is of another network")
+	}
+	command := bytesToCommand(header[4 : 4+commandLength])
+	length := binary.LittleEndian.Uint32(header[4+commandLength:])
+	checksum := header[4+commandLength+4:]
+	if length > maxMessagePayload {
+		return "", nil, fmt.Errorf("%s message of %d bytes is too large", command, length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", nil, err
+	}
+	if !bytes.Equal(checksum, messageChecksum(payload)) {
+		return "", nil, fmt.Errorf("%s message has a wrong checksum", command)
+	}
+
+	return command, payload, nil
+}
+
+func messageChecksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+
+	return second[:4]
+}
+
+// create a Peer of `conn`. `addr` is the address it listens on, if known.
+func newPeer(conn net.Conn, addr string, inbound bool) *Peer {
+	p := &Peer{
+		Addr:      addr,
+		Inbound:   inbound,
+		ConnTime:  time.Now(),
+		conn:      conn,
+		sendQueue: make(chan []byte, sendQueueLen),
+		quit:      make(chan struct{}),
+	}
+
+	return p
+}
+
+// start exchanging messages with the peer
+func (p *Peer) start() {
+	go p.readLoop()
+	go p.writeLoop()
+}
+
+// pass the messages of the peer to the node until the connection breaks
+func (p *Peer) readLoop() {
+	defer p.Disconnect()
+
+	for {
+		command, payload, err := readMessage(p.conn)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Printf("Disconnecting %s: %s\n", p, err)
+			}
+			return
+		}
+
+		select {
+		case inbox <- peerMessage{p, command, payload}:
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// write the queued messages until the peer is disconnected
+func (p *Peer) writeLoop() {
+	for {
+		select {
+		case frame := <-p.sendQueue:
+			if _, err := p.conn.Write(frame); err != nil {
+				fmt.Printf("Disconnecting %s: %s\n", p, err)
+				p.Disconnect()
+				return
+			}
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// queue a message for the peer. Until the handshake completes, only
+// `version` and `verack` are sent, the other messages wait for it. A peer
+// which doesn't read its messages fast enough to keep the queue from filling
+// up is disconnected.
+func (p *Peer) QueueMessage(command string, payload []byte) {
+	frame := encodeMessage(command, payload)
+	if !p.HandshakeDone() && command != "version" && command != "verack" {
+		p.pending = append(p.pending, frame)
+		return
+	}
+
+	p.queueFrame(frame)
+}
+
+func (p *Peer) queueFrame(frame []byte) {
+	select {
+	case p.sendQueue <- frame:
+	case <-p.quit:
+	default:
+		fmt.Printf("Disconnecting %s: its send queue is full\n", p)
+		p.Disconnect()
+	}
+}
+
+// check if the peer is still connected
+func (p *Peer) Connected() bool {
+	select {
+	case <-p.quit:
+		return false
+	default:
+		return true
+	}
+}
+
+// check if the handshake completed: the `version` of the peer was received
+// and ours acknowledged
+func (p *Peer) HandshakeDone() bool {
+	return p.versionReceived && p.verackReceived
+}
+
+// send the messages queued during the handshake
+func (p *Peer) flushPending() {
+	for _, frame := range p.pending {
+		p.queueFrame(frame)
+	}
+	p.pending = nil
+}
+
+// close the connection and forget the peer
+func (p *Peer) Disconnect() {
+	p.closeOnce.Do(func() {
+		close(p.quit)
+		p.conn.Close()
+
+		peerManager.removePeer(p)
+	})
+}
+
+func (p *Peer) String() string {
+	return p.Addr
+}
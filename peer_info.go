@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+// a running node holds the lock of the chain file, so it saves its peers
+// into `peerInfoFile` for `getpeerinfo` every `peerInfoInterval`
+const peerInfoFile = "peerinfo.dat"
+
+// PeerInfo describes a connected peer
+type PeerInfo struct {
+	Addr        string
+	Inbound     bool
+	Handshake   bool // the handshake completed
+	Version     int
+	Services    uint64
+	UserAgent   string
+	StartHeight int
+	BestHeight  int // height of the best block the peer is known to have
+	ConnTime    time.Time
+	PingTime    time.Duration // 0 before the first `pong`
+	MinPingTime time.Duration
+	PingWait    time.Duration // time waited for the `pong` of the current `ping`
+}
+
+// peerInfoSnapshot is the content of `peerInfoFile`
+type peerInfoSnapshot struct {
+	Time  time.Time
+	Peers []PeerInfo
+}
+
+// describe `p`. Only the goroutine handling the messages may call it.
+func NewPeerInfo(p *Peer) PeerInfo {
+	info := PeerInfo{
+		Addr:        p.String(),
+		Inbound:     p.Inbound,
+		Handshake:   p.HandshakeDone(),
+		Version:     p.Version,
+		Services:    p.Services,
+		UserAgent:   p.UserAgent,
+		StartHeight: p.StartHeight,
+		BestHeight:  p.BestHeight,
+		ConnTime:    p.ConnTime,
+		PingTime:    p.PingTime,
+		MinPingTime: p.MinPingTime,
+	}
+	if p.pingNonce != 0 {
+		info.PingWait = time.Since(p.pingSent)
+	}
+
+	return info
+}
+
+// save the description of `peers` into the data directory
+func SavePeerInfo(peers []*Peer) {
+	snapshot := peerInfoSnapshot{time.Now(), nil}
+	for _, p := range peers {
+		snapshot.Peers = append(snapshot.Peers, NewPeerInfo(p))
+	}
+	sort.Slice(snapshot.Peers, func(i, j int) bool {
+		return snapshot.Peers[i].Addr < snapshot.Peers[j].Addr
+	})
+
+	var content bytes.Buffer
+	encoder := gob.NewEncoder(&content)
+	err := encoder.Encode(snapshot)
+	logErr(err)
+
+	// `getpeerinfo` may read the file meanwhile, so it's replaced at once
+	err = writePrivateFile(dataFile(peerInfoFile), content.Bytes())
+	logErr(err)
+}
+
+// load the peers saved by the node running in the data directory
+//
+// returns: (time they were saved, peers, error)
+func LoadPeerInfo() (time.Time, []PeerInfo, error) {
+	fileContent, err := ioutil.ReadFile(dataFile(peerInfoFile))
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+
+	var snapshot peerInfoSnapshot
+	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
+	if err := decoder.Decode(&snapshot); err != nil {
+		return time.Time{}, nil, err
+	}
+
+	return snapshot.Time, snapshot.Peers, nil
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	peersFile             = "peers.dat"
+	defaultTargetOutbound = 8  // outbound peers the node keeps connections to
+	defaultMaxInbound     = 32 // inbound peers accepted at most
+	connectInterval       = 2 * time.Second
+	minRetryDelay         = 2 * time.Second // after the first failure to connect to an address
+	maxRetryDelay         = 10 * time.Minute
+	minPeerLifetime       = time.Minute // an outbound peer dropping sooner counts as a failed attempt
+
+	// gossiped addresses fill `newBuckets` buckets of `bucketSize`
+	// addresses, the ones of one source only `bucketsPerSource` of them, so
+	// that a peer flooding the node with addresses only evicts a few others
+	newBuckets       = 64
+	bucketSize       = 64
+	bucketsPerSource = 8
+	noBucket         = -1 // seed nodes and nodes seen, which gossip never evicts
+)
+
+// knownAddress is an entry of the address book
+type knownAddress struct {
+	Addr        string
+	Services    uint64
+	Timestamp   time.Time // last time the node was heard of
+	LastSeen    time.Time // last completed handshake, zero if never
+	LastAttempt time.Time // last connection attempt
+	Failures    int       // failed connection attempts, or connections dropped soon, in a row
+	Bucket      int       // bucket of a gossiped address, or `noBucket`
+}
+
+// addressBook is the content of `peersFile`
+type addressBook struct {
+	Key       []byte // secret which places addresses in buckets
+	Addresses []knownAddress
+}
+
+// PeerManager keeps the node connected: it dials addresses of its address
+// book until `TargetOutbound` outbound peers are connected, retrying a
+// failed address with an exponential backoff, and accepts at most
+// `MaxInbound` inbound peers. The address book is saved in the data
+// directory with the last time each address was seen.
+//
+// A PeerManager is safe for concurrent use.
+type PeerManager struct {
+	TargetOutbound int
+	MaxInbound     int
+
+	lock      sync.Mutex
+	bc        *Blockchain
+	peers     map[string]*Peer // listen address -> peer
+	inbound   int              // connected inbound peers, registered or not
+	addresses map[string]*knownAddress
+	buckets   [newBuckets]map[string]*knownAddress
+	key       []byte
+	dirty     bool // the address book changed since it was saved
+}
+
+var peerManager = NewPeerManager(defaultTargetOutbound, defaultMaxInbound)
+
+func NewPeerManager(targetOutbound, maxInbound int) *PeerManager {
+	m := &PeerManager{
+		TargetOutbound: targetOutbound,
+		MaxInbound:     maxInbound,
+		peers:          make(map[string]*Peer),
+		addresses:      make(map[string]*knownAddress),
+		key:            make([]byte, 32),
+	}
+	for i := range m.buckets {
+		m.buckets[i] = make(map[string]*knownAddress)
+	}
+	_, err := rand.Read(m.key)
+	logErr(err)
+
+	return m
+}
+
+// load the address book, add the seed nodes of the network to it and start
+// connecting to peers
+func (m *PeerManager) Start(bc *Blockchain) {
+	m.lock.Lock()
+	m.bc = bc
+	m.lock.Unlock()
+
+	err := m.LoadFromFile()
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Ignoring %s: %s\n", dataFile(peersFile), err)
+	}
+	m.AddSeeds(chainParams.SeedNodes)
+
+	go m.connectLoop()
+}
+
+// keep dialing addresses while there are fewer outbound peers than the target
+func (m *PeerManager) connectLoop() {
+	for {
+		for _, addr := range m.addressesToDial(time.Now()) {
+			m.connect(addr)
+		}
+		m.SaveToFile()
+
+		time.Sleep(connectInterval)
+	}
+}
+
+// return the addresses worth dialing at `now` to reach the outbound target,
+// the ones seen most recently first
+func (m *PeerManager) addressesToDial(now time.Time) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	outbound := 0
+	for _, p := range m.peers {
+		if !p.Inbound {
+			outbound++
+		}
+	}
+
+	var candidates []*knownAddress
+	for _, ka := range m.addresses {
+		if ka.Addr == nodeAddr || m.connectedTo(ka.Addr) {
+			continue
+		}
+		if now.Before(ka.LastAttempt.Add(retryDelay(ka.Failures))) {
+			continue
+		}
+		candidates = append(candidates, ka)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].LastSeen.After(candidates[j].LastSeen)
+	})
+
+	var addrs []string
+	for _, ka := range candidates {
+		if outbound+len(addrs) >= m.TargetOutbound {
+			break
+		}
+		addrs = append(addrs, ka.Addr)
+	}
+
+	return addrs
+}
+
+// the time to wait before dialing an address again after `failures` failed
+// attempts in a row
+func retryDelay(failures int) time.Duration {
+	if failures == 0 {
+		return 0
+	}
+
+	delay := minRetryDelay
+	for i := 1; i < failures && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+
+	return delay
+}
+
+// dial `addr` and start the handshake with it
+func (m *PeerManager) connect(addr string) {
+	m.lock.Lock()
+	ka := m.addresses[addr]
+	if ka == nil {
+		// evicted meanwhile
+		m.lock.Unlock()
+		return
+	}
+	ka.LastAttempt = time.Now()
+	m.dirty = true
+	bc := m.bc
+	m.lock.Unlock()
+
+	conn, err := net.DialTimeout(protocol, addr, dialTimeout)
+	if err != nil {
+		m.lock.Lock()
+		ka.Failures++
+		fmt.Printf("%s is not available, retrying in %s\n", addr, retryDelay(ka.Failures))
+		m.lock.Unlock()
+		return
+	}
+
+	p := newPeer(conn, addr, false)
+	sendVersion(p, bc)
+
+	m.lock.Lock()
+	if m.connectedTo(addr) {
+		// it connected to us meanwhile
+		m.lock.Unlock()
+		conn.Close()
+		return
+	}
+	m.peers[addr] = p
+	m.lock.Unlock()
+
+	p.start()
+}
+
+// accept inbound peers on `ln`, up to `MaxInbound`
+func (m *PeerManager) AcceptPeers(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			fmt.Println(err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		m.lock.Lock()
+		full := m.inbound >= m.MaxInbound
+		if !full {
+			m.inbound++
+		}
+		m.lock.Unlock()
+
+		if full {
+			fmt.Printf("Rejecting %s: %d inbound peers already\n", conn.RemoteAddr(), m.MaxInbound)
+			conn.Close()
+			continue
+		}
+		newPeer(conn, conn.RemoteAddr().String(), true).start()
+	}
+}
+
+// remember inbound peer `p` by the address it connects from, and
+// `listenAddr`, the address it claims to listen on in its `version`, so that
+// the node doesn't dial it too. The claimed address isn't checked, so a peer
+// could claim the address of another one, which is then not dialed while `p`
+// is connected.
+func (m *PeerManager) registerPeer(p *Peer, listenAddr string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p.ListenAddr = listenAddr
+	m.peers[p.Addr] = p
+}
+
+// check if a peer listening on, or connecting from, `addr` is connected. The
+// lock must be held.
+func (m *PeerManager) connectedTo(addr string) bool {
+	if m.peers[addr] != nil {
+		return true
+	}
+	for _, p := range m.peers {
+		if p.ListenAddr == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forget disconnected peer `p`. An outbound peer dropping before
+// `minPeerLifetime` is retried with the backoff of a failed attempt.
+func (m *PeerManager) removePeer(p *Peer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if p.Inbound {
+		m.inbound--
+	}
+	if m.peers[p.Addr] != p {
+		return
+	}
+	delete(m.peers, p.Addr)
+
+	if ka := m.addresses[p.Addr]; ka != nil && !p.Inbound {
+		if time.Since(p.ConnTime) < minPeerLifetime {
+			ka.Failures++
+		} else {
+			ka.Failures = 0
+		}
+		m.dirty = true
+	}
+}
+
+// return the connected peers
+func (m *PeerManager) Peers() []*Peer {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var peers []*Peer
+	for _, p := range m.peers {
+		peers = append(peers, p)
+	}
+
+	return peers
+}
+
+// add seed nodes `addrs` to the address book
+func (m *PeerManager) AddSeeds(addrs []string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, addr := range addrs {
+		if m.addresses[addr] == nil {
+			m.addresses[addr] = &knownAddress{Addr: addr, Bucket: noBucket}
+			m.dirty = true
+		}
+	}
+}
+
+// add address `na` gossiped by peer `source`, or update its timestamp. When
+// its bucket is full, the worst address of the bucket is evicted.
+//
+// returns if the address is new or newer than known
+func (m *PeerManager) AddAddress(na netAddress, source string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	timestamp := time.Unix(na.Timestamp, 0)
+	if ka := m.addresses[na.Addr]; ka != nil {
+		if !timestamp.After(ka.Timestamp) {
+			return false
+		}
+		ka.Timestamp = timestamp
+		ka.Services = na.Services
+		m.dirty = true
+		return true
+	}
+
+	bucket := m.bucketOf(na.Addr, source)
+	if len(m.buckets[bucket]) >= bucketSize {
+		m.evict(bucket)
+	}
+	ka := &knownAddress{Addr: na.Addr, Services: na.Services, Timestamp: timestamp, Bucket: bucket}
+	m.addresses[na.Addr] = ka
+	m.buckets[bucket][na.Addr] = ka
+	m.dirty = true
+
+	return true
+}
+
+// return the bucket of `addr` gossiped by `source`. All the addresses from
+// one host go to the same `bucketsPerSource` buckets.
+func (m *PeerManager) bucketOf(addr, source string) int {
+	host, _, err := net.SplitHostPort(source)
+	if err != nil {
+		host = source
+	}
+
+	addrHash := sha256.Sum256(append(append([]byte{}, m.key...), addr...))
+	slot := addrHash[0] % bucketsPerSource
+	hash := sha256.Sum256(bytes.Join([][]byte{m.key, []byte(host), {slot}}, nil))
+
+	return int(binary.LittleEndian.Uint64(hash[:8]) % newBuckets)
+}
+
+// remove the address of `bucket` failing the most, or heard of the longest
+// ago
+func (m *PeerManager) evict(bucket int) {
+	var worst *knownAddress
+	for _, ka := range m.buckets[bucket] {
+		if worst == nil || ka.Failures > worst.Failures ||
+			ka.Failures == worst.Failures && ka.Timestamp.Before(worst.Timestamp) {
+			worst = ka
+		}
+	}
+
+	delete(m.buckets[bucket], worst.Addr)
+	delete(m.addresses, worst.Addr)
+}
+
+// record a completed handshake with the peer listening on `addr`, which
+// then can't be evicted. Its failures are forgotten when it disconnects, if
+// it stayed long enough.
+func (m *PeerManager) MarkSeen(addr string, services uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ka := m.addresses[addr]
+	if ka == nil {
+		ka = &knownAddress{Addr: addr, Bucket: noBucket}
+		m.addresses[addr] = ka
+	}
+	if ka.Bucket != noBucket {
+		delete(m.buckets[ka.Bucket], addr)
+		ka.Bucket = noBucket
+	}
+	ka.Services = services
+	ka.Timestamp = time.Now()
+	ka.LastSeen = ka.Timestamp
+	m.dirty = true
+}
+
+// return up to `n` random addresses of the address book which were heard of
+func (m *PeerManager) Sample(n int) []netAddress {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var addrs []netAddress
+	for _, ka := range m.addresses {
+		if !ka.Timestamp.IsZero() {
+			addrs = append(addrs, netAddress{ka.Addr, ka.Services, ka.Timestamp.Unix()})
+		}
+	}
+	mathrand.Shuffle(len(addrs), func(i, j int) {
+		addrs[i], addrs[j] = addrs[j], addrs[i]
+	})
+	if len(addrs) > n {
+		addrs = addrs[:n]
+	}
+
+	return addrs
+}
+
+// return the addresses of the address book
+func (m *PeerManager) Addresses() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var addrs []string
+	for addr := range m.addresses {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	return addrs
+}
+
+// LoadFromFile loads the address book from the data directory
+func (m *PeerManager) LoadFromFile() error {
+	fileContent, err := ioutil.ReadFile(dataFile(peersFile))
+	if err != nil {
+		return err
+	}
+
+	var book addressBook
+	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
+	if err := decoder.Decode(&book); err != nil {
+		return err
+	}
+	// without its key, the buckets of the addresses would be predictable
+	if len(book.Key) == 0 {
+		return errors.New("the address book has no key")
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.key = book.Key
+	for i := range book.Addresses {
+		ka := &book.Addresses[i]
+		if ka.Addr == "" {
+			continue
+		}
+		if ka.Bucket != noBucket {
+			if ka.Bucket < 0 || ka.Bucket >= newBuckets || len(m.buckets[ka.Bucket]) >= bucketSize {
+				continue
+			}
+			m.buckets[ka.Bucket][ka.Addr] = ka
+		}
+		m.addresses[ka.Addr] = ka
+	}
+
+	return nil
+}
+
+// SaveToFile saves the address book into the data directory if it changed
+func (m *PeerManager) SaveToFile() {
+	m.lock.Lock()
+	if !m.dirty {
+		m.lock.Unlock()
+		return
+	}
+	book := addressBook{m.key, nil}
+	for _, ka := range m.addresses {
+		book.Addresses = append(book.Addresses, *ka)
+	}
+	m.dirty = false
+	m.lock.Unlock()
+
+	var content bytes.Buffer
+	encoder := gob.NewEncoder(&content)
+	err := encoder.Encode(book)
+	logErr(err)
+
+	ensureDataDir()
+	err = writePrivateFile(dataFile(peersFile), content.Bytes())
+	logErr(err)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// an address which an inbound peer claims to listen on isn't dialed while
+// it's connected
+func TestInboundPeerIsNotDialed(t *testing.T) {
+	m := NewPeerManager(defaultTargetOutbound, defaultMaxInbound)
+	m.AddSeeds([]string{"10.0.0.1:3000"})
+
+	conn, _ := net.Pipe()
+	inbound := newPeer(conn, "10.0.0.1:50000", true)
+	m.inbound++
+	m.registerPeer(inbound, "10.0.0.1:3000")
+	if addrs := m.addressesToDial(time.Now()); len(addrs) != 0 {
+		t.Errorf("dialing %v, to which a peer is connected", addrs)
+	}
+
+	m.removePeer(inbound)
+	if addrs := m.addressesToDial(time.Now()); len(addrs) != 1 {
+		t.Errorf("dialing %v once the peer is gone", addrs)
+	}
+}
+
+// an outbound peer which drops right after the handshake is retried with a
+// backoff, one which stayed connected long enough right away
+func TestDroppedPeerBackoff(t *testing.T) {
+	m := NewPeerManager(defaultTargetOutbound, defaultMaxInbound)
+	m.AddSeeds([]string{"test"})
+	now := time.Now()
+
+	for i := 1; i <= 3; i++ {
+		p := newTestPeer()
+		m.addresses[p.Addr].LastAttempt = now
+		m.peers[p.Addr] = p
+		m.MarkSeen(p.Addr, nodeNetwork)
+		m.removePeer(p)
+
+		if failures := m.addresses[p.Addr].Failures; failures != i {
+			t.Fatalf("%d failures after %d dropped connections", failures, i)
+		}
+	}
+	if addrs := m.addressesToDial(now.Add(connectInterval)); len(addrs) != 0 {
+		t.Errorf("redialing %v without a backoff", addrs)
+	}
+
+	p := newTestPeer()
+	p.ConnTime = now.Add(-minPeerLifetime)
+	m.peers[p.Addr] = p
+	m.removePeer(p)
+	if failures := m.addresses[p.Addr].Failures; failures != 0 {
+		t.Errorf("%d failures after a lasting connection", failures)
+	}
+}
+
+// an address book without its key is rejected
+func TestLoadAddressBookWithoutKey(t *testing.T) {
+	dir := dataDir
+	dataDir = t.TempDir()
+	t.Cleanup(func() { dataDir = dir })
+
+	var content bytes.Buffer
+	book := addressBook{nil, []knownAddress{{Addr: "10.0.0.1:3000", Bucket: 0}}}
+	if err := gob.NewEncoder(&content).Encode(book); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dataFile(peersFile), content.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewPeerManager(defaultTargetOutbound, defaultMaxInbound)
+	key := m.key
+	if err := m.LoadFromFile(); err == nil {
+		t.Error("an address book without a key is loaded")
+	}
+	if !bytes.Equal(m.key, key) || len(m.addresses) != 0 {
+		t.Error("an address book without a key replaced the address book")
+	}
+}
+
+// a peer flooding the node with addresses fills `bucketsPerSource` buckets at
+// most, and never evicts the addresses of seed nodes or nodes seen
+func TestAddressFloodIsBounded(t *testing.T) {
+	m := NewPeerManager(defaultTargetOutbound, defaultMaxInbound)
+	m.AddSeeds([]string{"10.0.0.1:3000"})
+	m.MarkSeen("10.0.0.2:3000", nodeNetwork)
+
+	now := time.Now().Unix()
+	for i := 0; i < 2*bucketsPerSource*bucketSize; i++ {
+		m.AddAddress(netAddress{fmt.Sprintf("10.%d.%d.%d:3000", 1+i/65536, i/256%256, i%256), nodeNetwork, now}, "10.9.9.9:50000")
+	}
+
+	buckets := 0
+	for _, bucket := range m.buckets {
+		if len(bucket) > bucketSize {
+			t.Errorf("a bucket has %d addresses, more than %d", len(bucket), bucketSize)
+		}
+		if len(bucket) > 0 {
+			buckets++
+		}
+	}
+	if buckets > bucketsPerSource {
+		t.Errorf("one source filled %d buckets, more than %d", buckets, bucketsPerSource)
+	}
+	if len(m.addresses) > bucketsPerSource*bucketSize+2 {
+		t.Errorf("one source added %d addresses", len(m.addresses)-2)
+	}
+	for _, addr := range []string{"10.0.0.1:3000", "10.0.0.2:3000"} {
+		if m.addresses[addr] == nil {
+			t.Errorf("%s is evicted", addr)
+		}
+	}
+}
+
+// a full bucket evicts the address failing the most, then the one heard of
+// the longest ago
+func TestEvictWorstAddress(t *testing.T) {
+	m := NewPeerManager(defaultTargetOutbound, defaultMaxInbound)
+	now := time.Now()
+	add := func(addr string, failures int, age time.Duration) {
+		ka := &knownAddress{Addr: addr, Timestamp: now.Add(-age), Failures: failures, Bucket: 0}
+		m.addresses[addr] = ka
+		m.buckets[0][addr] = ka
+	}
+	add("fresh", 0, 0)
+	add("old", 0, time.Hour)
+	add("failing", 2, 0)
+
+	for _, want := range []string{"failing", "old"} {
+		m.evict(0)
+		if m.addresses[want] != nil || m.buckets[0][want] != nil {
+			t.Errorf("%s isn't evicted first", want)
+		}
+	}
+	if m.addresses["fresh"] == nil {
+		t.Error("the best address is evicted")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// a framed message is read back as it was sent
+func TestMessageFrameRoundTrip(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(encodeMessage("ping", []byte{1, 2, 3}))
+	stream.Write(encodeMessage("verack", nil))
+
+	for _, want := range []struct {
+		command string
+		payload []byte
+	}{{"ping", []byte{1, 2, 3}}, {"verack", []byte{}}} {
+		command, payload, err := readMessage(&stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if command != want.command || !bytes.Equal(payload, want.payload) {
+			t.Errorf("read %s %x, want %s %x", command, payload, want.command, want.payload)
+		}
+	}
+}
+
+// a frame of another network, with a payload not matching its checksum, or
+// announcing a payload too large to be read is an error
+func TestMessageFrameRejected(t *testing.T) {
+	badMagic := encodeMessage("ping", []byte{1, 2, 3})
+	badMagic[0] ^= 0xff
+
+	badChecksum := encodeMessage("ping", []byte{1, 2, 3})
+	badChecksum[len(badChecksum)-1] ^= 0xff
+
+	// only the header: the payload mustn't be waited for
+	oversized := encodeMessage("block", nil)
+	binary.LittleEndian.PutUint32(oversized[4+commandLength:], maxMessagePayload+1)
+
+	tests := []struct {
+		name  string
+		frame []byte
+		err   string
+	}{
+		{"bad magic", badMagic, "another network"},
+		{"bad checksum", badChecksum, "checksum"},
+		{"oversized", oversized, "too large"},
+	}
+	for _, test := range tests {
+		_, _, err := readMessage(bytes.NewReader(test.frame))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
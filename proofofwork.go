@@ -11,8 +11,6 @@ import (
 
 var maxNonce = math.MaxInt64
 
-const targetBits = 15 // smaller targetBits, easier difficulty
-
 type ProofOfWork struct {
 	block  *Block
 	target *big.Int
@@ -20,21 +18,32 @@ type ProofOfWork struct {
 
 // return a new ProofOfWork instance
 func NewProofOfWork(b *Block) *ProofOfWork {
-	target := big.NewInt(1)
-	target.Lsh(target, uint(256-targetBits)) // target == 0x10000000......
-
-	pow := &ProofOfWork{b, target}
+	pow := &ProofOfWork{b, powTarget()}
 
 	return pow
 }
 
+// return the target a block hash must be below
+func powTarget() *big.Int {
+	target := big.NewInt(1)
+	target.Lsh(target, uint(256-chainParams.TargetBits)) // target == 0x10000000......
+
+	return target
+}
+
 func (pow *ProofOfWork) prepareData(nonce int) []byte {
+	return powData(pow.block.PrevBlockHash, pow.block.HashTransactions(), pow.block.Timestamp, nonce)
+}
+
+// return the data hashed by the proof of work of a block: its header, where
+// the merkle root covers the transactions
+func powData(prevBlockHash, merkleRoot []byte, timestamp int64, nonce int) []byte {
 	data := bytes.Join(
 		[][]byte{
-			pow.block.PrevBlockHash,
-			pow.block.HashTransactions(),
-			IntToHex(pow.block.Timestamp),
-			IntToHex(int64(targetBits)),
+			prevBlockHash,
+			merkleRoot,
+			IntToHex(timestamp),
+			IntToHex(int64(chainParams.TargetBits)),
 			IntToHex(int64(nonce)),
 		},
 		[]byte{},
@@ -70,7 +79,7 @@ func (pow *ProofOfWork) Validate() bool {
 	hash := sha256.Sum256(data)
 	hashInt.SetBytes(hash[:])
 
-	isValid := hashInt.Cmp(pow.target) == -1
+	isValid := hashInt.Cmp(pow.target) == -1 && bytes.Compare(hash[:], pow.block.Hash) == 0
 
 	return isValid
 }
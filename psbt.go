@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"fmt"
+)
+
+// the serialized PSBT starts with these bytes, as in BIP174
+var psbtMagic = []byte{'p', 's', 'b', 't', 0xff}
+
+// PSBT is a partially signed transaction: an unsigned transaction with the
+// outputs its inputs spend, which is all a signer needs, so a wallet can sign
+// it without the blockchain. Signatures are collected in the witnesses of
+// `Tx`, which don't change its ID.
+//
+// see https://github.com/bitcoin/bips/blob/master/bip-0174.mediawiki
+type PSBT struct {
+	Tx       Transaction
+	PrevOuts []TXOutput // output spent by each input of `Tx`
+}
+
+// create a PSBT of unsigned transaction `tx`, looking up the outputs it
+// spends in `bc`
+func NewPSBT(tx *Transaction, bc *Blockchain) (*PSBT, error) {
+	psbt := PSBT{*tx, nil}
+
+	for _, vin := range tx.Vin {
+		prevTx, err := bc.FindTransaction(vin.Txid)
+		if err != nil || vin.Vout < 0 || vin.Vout >= len(prevTx.Vout) {
+			return nil, fmt.Errorf("input %x:%d is not found", vin.Txid, vin.Vout)
+		}
+		psbt.PrevOuts = append(psbt.PrevOuts, prevTx.Vout[vin.Vout])
+	}
+
+	return &psbt, nil
+}
+
+// encode `p` in base64
+func (p PSBT) Encode() string {
+	var content bytes.Buffer
+	content.Write(psbtMagic)
+
+	encoder := gob.NewEncoder(&content)
+	err := encoder.Encode(p)
+	logErr(err)
+
+	return base64.StdEncoding.EncodeToString(content.Bytes())
+}
+
+// decode a base64-encoded PSBT
+func DecodePSBT(s string) (*PSBT, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || !bytes.HasPrefix(data, psbtMagic) {
+		return nil, errors.New("PSBT is not valid base64 starting with the PSBT magic")
+	}
+
+	var p PSBT
+	decoder := gob.NewDecoder(bytes.NewReader(data[len(psbtMagic):]))
+	if err := decoder.Decode(&p); err != nil {
+		return nil, errors.New("PSBT can't be decoded")
+	}
+	if len(p.PrevOuts) != len(p.Tx.Vin) || len(p.Tx.Vin) == 0 || p.Tx.IsCoinbase() {
+		return nil, errors.New("PSBT doesn't hold an output for each input")
+	}
+	for i, vin := range p.Tx.Vin {
+		if vin.Vout < 0 {
+			return nil, fmt.Errorf("input %d spends output %d", i, vin.Vout)
+		}
+	}
+	if bytes.Compare(p.Tx.ID, p.Tx.Hash()) != 0 {
+		return nil, errors.New("transaction ID doesn't match its content")
+	}
+
+	return &p, nil
+}
+
+// return the fee of the transaction, as far as the previous outputs in the
+// PSBT tell: the signatures don't cover their values
+func (p *PSBT) Fee() int {
+	return p.Tx.fee(p.PrevOuts)
+}
+
+// check if input `inID` has a signature
+func (p *PSBT) IsSigned(inID int) bool {
+	return len(p.Tx.Vin[inID].Witness.Signature) > 0
+}
+
+// sign the inputs of `p` whose keys are in `ws` with SIGHASH_ALL. Signed
+// inputs and HTLC inputs are left as they are.
+//
+// returns the number of inputs signed
+func (ws *Wallets) SignPSBT(p *PSBT) int {
+	signed := 0
+
+	for inID, prevOut := range p.PrevOuts {
+		if p.IsSigned(inID) || prevOut.HTLC != nil {
+			continue
+		}
+
+		for _, wallet := range ws.Wallets {
+			if wallet.PrivateKey != nil && prevOut.IsLockedWithKey(wallet.LockingKey()) {
+				p.Tx.Vin[inID].Witness.PubKey = wallet.PublicKey
+				p.Tx.signInput(inID, *wallet, prevOut, SigHashAll)
+				signed++
+				break
+			}
+		}
+	}
+
+	return signed
+}
+
+// merge the signatures of `other`, a copy of `p` signed by somebody else
+func (p *PSBT) Combine(other *PSBT) error {
+	if bytes.Compare(p.Tx.ID, other.Tx.ID) != 0 {
+		return errors.New("PSBTs are of different transactions")
+	}
+
+	for inID := range p.Tx.Vin {
+		if !p.IsSigned(inID) && other.IsSigned(inID) {
+			p.Tx.Vin[inID].Witness = other.Tx.Vin[inID].Witness
+		}
+	}
+	return nil
+}
+
+// check that every input of `p` is signed and verifies against the previous
+// outputs, and return the transaction ready to be broadcast
+func (p *PSBT) Finalize() (*Transaction, error) {
+	for inID := range p.Tx.Vin {
+		if !p.IsSigned(inID) {
+			return nil, fmt.Errorf("input %d is not signed", inID)
+		}
+	}
+	batch := &schnorrBatch{}
+	if !p.Tx.verifyInputs(p.PrevOuts, batch) || !batch.Verify() {
+		return nil, errors.New("signatures don't verify")
+	}
+
+	tx := p.Tx
+	return &tx, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+// return a PSBT whose only input spends output `vout` of value 10
+func newTestPSBT(vout int) PSBT {
+	to := NewWallet(false)
+	tx := Transaction{nil, []TXInput{{make([]byte, 32), vout, nil, TXWitness{}}}, []TXOutput{*NewTXOutput(7, string(to.GetAddress()))}, 0}
+	tx.ID = tx.Hash()
+
+	return PSBT{tx, []TXOutput{*NewTXOutput(10, string(to.GetAddress()))}}
+}
+
+func TestDecodePSBTRejectsNegativeOutput(t *testing.T) {
+	if _, err := DecodePSBT(newTestPSBT(-1).Encode()); err == nil {
+		t.Error("a PSBT spending output -1 is decoded")
+	}
+}
+
+// the outputs an input spends aren't padded up to its index
+func TestPSBTFeeOfLargeOutputIndex(t *testing.T) {
+	psbt, err := DecodePSBT(newTestPSBT(1 << 40).Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fee := psbt.Fee(); fee != 3 {
+		t.Errorf("fee is %d, not 3", fee)
+	}
+}
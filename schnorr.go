@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+)
+
+// return the 32-byte x-only public key of the wallet (BIP340). It's the X
+// coordinate of the public key, and Y is taken as even.
+func (w Wallet) XOnlyPubKey() []byte {
+	return w.PublicKey[1:]
+}
+
+// sign `hash` with a 64-byte BIP340 Schnorr signature
+func (w Wallet) SignSchnorr(hash []byte) []byte {
+	privKey, _ := btcec.PrivKeyFromBytes(w.PrivateKey)
+	signature, err := schnorr.Sign(privKey, hash)
+	logErr(err)
+
+	return signature.Serialize()
+}
+
+// check if Schnorr `signature` of `hash` is made by the owner of `xOnlyPubKey`
+func verifySchnorr(xOnlyPubKey, hash, signature []byte) bool {
+	key, err := schnorr.ParsePubKey(xOnlyPubKey)
+	if err != nil {
+		return false
+	}
+	sig, err := schnorr.ParseSignature(signature)
+	if err != nil {
+		return false
+	}
+
+	return sig.Verify(hash, key)
+}
+
+// schnorrBatch collects Schnorr signatures so that all signatures of a block
+// can be verified at once
+type schnorrBatch struct {
+	pubKeys    [][]byte
+	hashes     [][]byte
+	signatures [][]byte
+}
+
+// add a signature to be verified later by `Verify`
+func (b *schnorrBatch) Add(xOnlyPubKey, hash, signature []byte) {
+	b.pubKeys = append(b.pubKeys, xOnlyPubKey)
+	b.hashes = append(b.hashes, hash)
+	b.signatures = append(b.signatures, signature)
+}
+
+// verify all signatures in the batch (BIP340 batch verification)
+//
+// Signature i is (r_i, s_i) for public key P_i, R_i is the point whose X is
+// r_i, and e_i = hash(r_i || P_i || m_i). With random a_1 ... a_u all
+// signatures are valid (except with negligible probability) if
+//
+//	(a_1*s_1 + ... + a_u*s_u)*G = a_1*R_1 + ... + a_u*R_u + (a_1*e_1)*P_1 + ... + (a_u*e_u)*P_u
+//
+// The right side is computed in one multi-scalar multiplication, which is
+// faster than checking each signature alone. It doesn't tell which signature
+// is invalid.
+func (b *schnorrBatch) Verify() bool {
+	switch len(b.signatures) {
+	case 0:
+		return true
+	case 1:
+		return verifySchnorr(b.pubKeys[0], b.hashes[0], b.signatures[0])
+	}
+
+	var sum btcec.ModNScalar // a_1*s_1 + ... + a_u*s_u
+	var scalars []btcec.ModNScalar
+	var points []btcec.JacobianPoint
+
+	for i, signature := range b.signatures {
+		if len(signature) != schnorr.SignatureSize || len(b.hashes[i]) != 32 {
+			return false
+		}
+
+		key, err := schnorr.ParsePubKey(b.pubKeys[i])
+		if err != nil {
+			return false
+		}
+		var P btcec.JacobianPoint
+		key.AsJacobian(&P)
+
+		// R = lift_x(r), the point with X = r and even Y
+		var R btcec.JacobianPoint
+		if overflow := R.X.SetByteSlice(signature[:32]); overflow {
+			return false
+		}
+		if !btcec.DecompressY(&R.X, false, &R.Y) {
+			return false
+		}
+		R.Z.SetInt(1)
+
+		var s btcec.ModNScalar
+		if overflow := s.SetByteSlice(signature[32:]); overflow {
+			return false
+		}
+
+		var e btcec.ModNScalar
+		challenge := taggedHash("BIP0340/challenge", signature[:32], b.pubKeys[i], b.hashes[i])
+		e.SetBytes(&challenge)
+
+		a := randomScalar(i)
+		sum.Add(s.Mul(&a))
+
+		// move R and P terms to the left side, so the sum should be infinity
+		var aR, aeP btcec.ModNScalar
+		aR.NegateVal(&a)
+		aeP.Mul2(&a, &e).Negate()
+		scalars = append(scalars, aR, aeP)
+		points = append(points, R, P)
+	}
+
+	var sG, rest, result btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(&sum, &sG)
+	multiScalarMult(scalars, points, &rest)
+	btcec.AddNonConst(&sG, &rest, &result)
+
+	return (result.X.IsZero() && result.Y.IsZero()) || result.Z.IsZero()
+}
+
+// return a random batch coefficient. The first one is 1 as BIP340 suggests.
+//
+// 128 random bits are enough: a forged batch passes with probability 2^-128,
+// and the short coefficients halve the cost of the R terms.
+func randomScalar(i int) btcec.ModNScalar {
+	var a btcec.ModNScalar
+
+	if i == 0 {
+		a.SetInt(1)
+		return a
+	}
+
+	var buf [32]byte
+	_, err := rand.Read(buf[16:])
+	logErr(err)
+	buf[16] |= 0x80 // never zero
+	a.SetBytes(&buf)
+
+	return a
+}
+
+// width of the wNAF windows used by multiScalarMult
+const wnafWidth = 5
+
+// compute scalars[0]*points[0] + ... + scalars[n-1]*points[n-1] into `result`
+//
+// Strauss' method: all terms share the same 256 doublings, so each extra term
+// only costs its additions. Scalars are written in width-5 NAF, which leaves
+// about one non-zero digit in 6, and the odd multiples each digit selects are
+// converted to affine coordinates so additions are the cheaper mixed kind.
+func multiScalarMult(scalars []btcec.ModNScalar, points []btcec.JacobianPoint, result *btcec.JacobianPoint) {
+	const tableSize = 1 << (wnafWidth - 2)
+	var tmp btcec.JacobianPoint
+
+	// tables[i][j] = (2j+1)*points[i]
+	tables := make([][tableSize]btcec.JacobianPoint, len(points))
+	var all []*btcec.JacobianPoint
+	for i := range points {
+		var double btcec.JacobianPoint
+		btcec.DoubleNonConst(&points[i], &double)
+		tables[i][0].Set(&points[i])
+		for j := 1; j < tableSize; j++ {
+			btcec.AddNonConst(&tables[i][j-1], &double, &tables[i][j])
+		}
+		for j := range tables[i] {
+			all = append(all, &tables[i][j])
+		}
+	}
+	toAffine(all)
+
+	nafs := make([][]int8, len(scalars))
+	maxLen := 0
+	for i := range scalars {
+		nafs[i] = wnaf(&scalars[i])
+		if len(nafs[i]) > maxLen {
+			maxLen = len(nafs[i])
+		}
+	}
+
+	var neg btcec.JacobianPoint
+	*result = btcec.JacobianPoint{} // point at infinity
+	for bit := maxLen - 1; bit >= 0; bit-- {
+		btcec.DoubleNonConst(result, &tmp)
+		result.Set(&tmp)
+
+		for i, naf := range nafs {
+			if bit >= len(naf) || naf[bit] == 0 {
+				continue
+			}
+			digit := naf[bit]
+			point := &tables[i][(abs8(digit)-1)/2]
+			if digit < 0 {
+				neg.Set(point)
+				neg.Y.Negate(1).Normalize()
+				point = &neg
+			}
+			btcec.AddNonConst(result, point, &tmp)
+			result.Set(&tmp)
+		}
+	}
+}
+
+// return the width-5 non-adjacent form of `k`, least significant digit first.
+// Every digit is zero or odd in -15...15, and any 5 consecutive digits have at
+// most one non-zero.
+func wnaf(k *btcec.ModNScalar) []int8 {
+	const window = 1 << wnafWidth
+
+	bytes := k.Bytes()
+	n := new(big.Int).SetBytes(bytes[:])
+	var naf []int8
+
+	for n.Sign() > 0 {
+		var digit int8
+		if n.Bit(0) == 1 {
+			mod := int(n.Int64() & (window - 1))
+			if mod >= window/2 {
+				mod -= window
+			}
+			digit = int8(mod)
+			n.Sub(n, big.NewInt(int64(mod)))
+		}
+		naf = append(naf, digit)
+		n.Rsh(n, 1)
+	}
+
+	return naf
+}
+
+// convert `points` to affine coordinates (Z = 1) with a single field
+// inversion (Montgomery's trick). None of the points may be infinity.
+func toAffine(points []*btcec.JacobianPoint) {
+	// prefix[i] = Z_0 * ... * Z_(i-1)
+	prefix := make([]btcec.FieldVal, len(points))
+	var acc btcec.FieldVal
+	acc.SetInt(1)
+	for i, p := range points {
+		prefix[i].Set(&acc)
+		acc.Mul(&p.Z)
+	}
+
+	acc.Inverse() // 1 / (Z_0 * ... * Z_(n-1))
+	for i := len(points) - 1; i >= 0; i-- {
+		p := points[i]
+
+		var zInv, zInv2, zInv3 btcec.FieldVal
+		zInv.Mul2(&acc, &prefix[i])
+		acc.Mul(&p.Z)
+		zInv2.SquareVal(&zInv)
+		zInv3.Mul2(&zInv2, &zInv)
+
+		p.X.Mul(&zInv2).Normalize()
+		p.Y.Mul(&zInv3).Normalize()
+		p.Z.SetInt(1)
+	}
+}
+
+func abs8(x int8) int8 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// tagged hash of BIP340: SHA256(SHA256(tag) || SHA256(tag) || msgs...)
+func taggedHash(tag string, msgs ...[]byte) [32]byte {
+	tagHash := sha256.Sum256([]byte(tag))
+
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, msg := range msgs {
+		h.Write(msg)
+	}
+
+	var hash [32]byte
+	copy(hash[:], h.Sum(nil))
+	return hash
+}
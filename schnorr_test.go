@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// verification test vectors of BIP340
+//
+// see https://github.com/bitcoin/bips/blob/master/bip-0340/test-vectors.csv
+var bip340Vectors = []struct {
+	secretKey string // empty if the vector doesn't sign
+	publicKey string
+	message   string
+	signature string
+	valid     bool
+}{
+	{"0000000000000000000000000000000000000000000000000000000000000003", "F9308A019258C31049344F85F89D5229B531C845836F99B08601F113BCE036F9", "0000000000000000000000000000000000000000000000000000000000000000", "E907831F80848D1069A5371B402410364BDF1C5F8307B0084C55F1CE2DCA821525F66A4A85EA8B71E482A74F382D2CE5EBEEE8FDB2172F477DF4900D310536C0", true},
+	{"B7E151628AED2A6ABF7158809CF4F3C762E7160F38B4DA56A784D9045190CFEF", "DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659", "243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89", "6896BD60EEAE296DB48A229FF71DFE071BDE413E6D43F917DC8DCF8C78DE33418906D11AC976ABCCB20B091292BFF4EA897EFCB639EA871CFA95F6DE339E4B0A", true},
+	{"C90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B14E5C9", "DD308AFEC5777E13121FA72B9CC1B7CC0139715309B086C960E18FD969774EB8", "7E2D58D8B3BCDF1ABADEC7829054F90DDA9805AAB56C77333024B9D0A508B75C", "5831AAEED7B44BB74E5EAB94BA9D4294C49BCF2A60728D8B4C200F50DD313C1BAB745879A5AD954A72C45A91C3A51D3C7ADEA98D82F8481E0E1E03674A6F3FB7", true},
+	{"0B432B2677937381AEF05BB02A66ECD012773062CF3FA2549E44F58ED2401710", "25D1DFF95105F5253C4022F628A996AD3A0D95FBF21D468A1B33F8C160D8F517", "FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF", "7EB0509757E246F19449885651611CB965ECC1A187DD51B64FDA1EDC9637D5EC97582B9CB13DB3933705B32BA982AF5AF25FD78881EBB32771FC5922EFC66EA3", true},
+	{"", "D69C3509BB99E412E68B0FE8544E72837DFA30746D8BE2AA65975F29D22DC7B9", "4DF3C3F68FCC83B27E9D42C90431A72499F17875C81A599B566C9889B9696703", "00000000000000000000003B78CE563F89A0ED9414F5AA28AD0D96D6795F9C6376AFB1548AF603B3EB45C9F8207DEE1060CB71C04E80F593060B07D28308D7F4", true},
+	// public key not on the curve
+	{"", "EEFDEA4CDB677750A420FEE807EACF21EB9898AE79B9768766E4FAA04A2D4A34", "243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89", "6CFF5C3BA86C69EA4B7376F31A9BCB4F74C1976089B2D9963DA2E5543E17776969E89B4C5564D00349106B8497785DD7D1D713A8AE82B32FA79D5F7FC407D39B", false},
+	// has_even_y(R) is false
+	{"", "DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659", "243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89", "FFF97BD5755EEEA420453A14355235D382F6472F8568A18B2F057A14602975563CC27944640AC607CD107AE10923D9EF7A73C643E166BE5EBEAFA34B1AC553E2", false},
+	// negated message
+	{"", "DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659", "243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89", "1FA62E331EDBC21C394792D2AB1100A7B432B013DF3F6FF4F99FCB33E0E1515F28890B3EDB6E7189B630448B515CE4F8622A954CFE545735AAEA5134FCCDB2BD", false},
+	// negated s value
+	{"", "DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659", "243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89", "6CFF5C3BA86C69EA4B7376F31A9BCB4F74C1976089B2D9963DA2E5543E177769961764B3AA9B2FFCB6EF947B6887A226E8D7C93E00C5ED0C1834FF0D0C2E6DA6", false},
+	// sG - eP is infinite
+	{"", "DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659", "243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89", "0000000000000000000000000000000000000000000000000000000000000000123DDA8328AF9C23A94C1FEECFD123BA4FB73476F0D594DCB65C6425BD186051", false},
+	{"", "DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659", "243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89", "00000000000000000000000000000000000000000000000000000000000000017615FBAF5AE28864013C099742DEADB4DBA87F11AC6754F93780D5A1837CF197", false},
+	// sig[0:32] is not an X coordinate on the curve
+	{"", "DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659", "243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89", "4A298DACAE57395A15D0795DDBFD1DCB564DA82B0F269BC70A74F8220429BA1D69E89B4C5564D00349106B8497785DD7D1D713A8AE82B32FA79D5F7FC407D39B", false},
+	// sig[0:32] is equal to the field size
+	{"", "DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659", "243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89", "FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEFFFFFC2F69E89B4C5564D00349106B8497785DD7D1D713A8AE82B32FA79D5F7FC407D39B", false},
+	// sig[32:64] is equal to the curve order
+	{"", "DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659", "243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89", "6CFF5C3BA86C69EA4B7376F31A9BCB4F74C1976089B2D9963DA2E5543E177769FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEBAAEDCE6AF48A03BBFD25E8CD0364141", false},
+	// public key is not a valid X coordinate because it exceeds the field size
+	{"", "FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEFFFFFC30", "243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89", "6CFF5C3BA86C69EA4B7376F31A9BCB4F74C1976089B2D9963DA2E5543E17776969E89B4C5564D00349106B8497785DD7D1D713A8AE82B32FA79D5F7FC407D39B", false},
+}
+
+func decodeHexString(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestVerifySchnorrBIP340(t *testing.T) {
+	for i, v := range bip340Vectors {
+		pubKey := decodeHexString(t, v.publicKey)
+		message := decodeHexString(t, v.message)
+		signature := decodeHexString(t, v.signature)
+
+		if verifySchnorr(pubKey, message, signature) != v.valid {
+			t.Errorf("vector %d: verifySchnorr isn't %t", i, v.valid)
+		}
+	}
+}
+
+// the signatures of BIP340 use random auxiliary data, while btcec derives
+// the nonce from the key and the message (RFC6979), so only the public keys
+// and the validity of the signatures are compared
+func TestSignSchnorrBIP340(t *testing.T) {
+	for i, v := range bip340Vectors {
+		if v.secretKey == "" {
+			continue
+		}
+		privKey, pubKey := btcec.PrivKeyFromBytes(decodeHexString(t, v.secretKey))
+		wallet := Wallet{privKey.Serialize(), pubKey.SerializeCompressed(), true, false, ""}
+		if !strings.EqualFold(hex.EncodeToString(wallet.XOnlyPubKey()), v.publicKey) {
+			t.Errorf("vector %d: x-only public key is %x", i, wallet.XOnlyPubKey())
+		}
+
+		message := decodeHexString(t, v.message)
+		signature := wallet.SignSchnorr(message)
+		if !verifySchnorr(wallet.XOnlyPubKey(), message, signature) {
+			t.Errorf("vector %d: signature %x doesn't verify", i, signature)
+		}
+	}
+}
+
+// return a batch of the valid BIP340 vectors and of `n` signatures of new keys
+func newTestBatch(t *testing.T, n int) *schnorrBatch {
+	batch := &schnorrBatch{}
+	for _, v := range bip340Vectors {
+		if v.valid {
+			batch.Add(decodeHexString(t, v.publicKey), decodeHexString(t, v.message), decodeHexString(t, v.signature))
+		}
+	}
+	for i := 0; i < n; i++ {
+		wallet := NewWallet(true)
+		hash := sha256.Sum256([]byte(fmt.Sprint(i)))
+		batch.Add(wallet.XOnlyPubKey(), hash[:], wallet.SignSchnorr(hash[:]))
+	}
+	return batch
+}
+
+func TestSchnorrBatchBIP340(t *testing.T) {
+	for _, n := range []int{0, 1, 20} {
+		if !newTestBatch(t, n).Verify() {
+			t.Errorf("a batch of the valid vectors and %d signatures doesn't verify", n)
+		}
+	}
+
+	for i, v := range bip340Vectors {
+		if v.valid {
+			continue
+		}
+		single := &schnorrBatch{}
+		single.Add(decodeHexString(t, v.publicKey), decodeHexString(t, v.message), decodeHexString(t, v.signature))
+		if single.Verify() {
+			t.Errorf("vector %d alone verifies in a batch", i)
+		}
+
+		batch := newTestBatch(t, 3)
+		batch.Add(decodeHexString(t, v.publicKey), decodeHexString(t, v.message), decodeHexString(t, v.signature))
+		if batch.Verify() {
+			t.Errorf("a batch with vector %d verifies", i)
+		}
+	}
+}
+
+func TestSchnorrBatchRejectsWrongMessage(t *testing.T) {
+	batch := newTestBatch(t, 10)
+	last := len(batch.hashes) - 1
+	hash := append([]byte{}, batch.hashes[last]...)
+	hash[0] ^= 1
+	batch.hashes[last] = hash
+
+	if batch.Verify() {
+		t.Error("a batch with a signature of another message verifies")
+	}
+}
+
+// multiScalarMult gives the same point as adding up the products one by one
+func TestMultiScalarMult(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	for _, n := range []int{1, 2, 7} {
+		var scalars []btcec.ModNScalar
+		var points []btcec.JacobianPoint
+		var expected btcec.JacobianPoint
+
+		for i := 0; i < n; i++ {
+			var buf [32]byte
+			random.Read(buf[:])
+			var k, s btcec.ModNScalar
+			k.SetByteSlice(buf[:])
+			random.Read(buf[:])
+			s.SetByteSlice(buf[:])
+			if i == 0 {
+				s.SetInt(1) // the first batch coefficient
+			}
+
+			var point, product, sum btcec.JacobianPoint
+			btcec.ScalarBaseMultNonConst(&k, &point)
+			btcec.ScalarMultNonConst(&s, &point, &product)
+			btcec.AddNonConst(&expected, &product, &sum)
+			expected.Set(&sum)
+
+			scalars = append(scalars, s)
+			points = append(points, point)
+		}
+
+		var result btcec.JacobianPoint
+		multiScalarMult(scalars, points, &result)
+		result.ToAffine()
+		expected.ToAffine()
+		if !result.X.Equals(&expected.X) || !result.Y.Equals(&expected.Y) {
+			t.Errorf("%d terms: the sum differs", n)
+		}
+	}
+}
+
+// every wNAF digit is zero or odd and below 16 in magnitude, any 5 digits in
+// a row have at most one non-zero, and the digits add up to the scalar
+func TestWNAF(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 100; i++ {
+		var buf [32]byte
+		random.Read(buf[:])
+		var k btcec.ModNScalar
+		k.SetByteSlice(buf[:])
+
+		naf := wnaf(&k)
+		var sum, digit btcec.ModNScalar
+		for bit := len(naf) - 1; bit >= 0; bit-- {
+			d := naf[bit]
+			if d != 0 && (d%2 == 0 || abs8(d) > 15) {
+				t.Fatalf("%x: digit %d", buf, d)
+			}
+			if d != 0 {
+				for j := bit + 1; j < bit+wnafWidth && j < len(naf); j++ {
+					if naf[j] != 0 {
+						t.Fatalf("%x: digits %d and %d are non-zero", buf, bit, j)
+					}
+				}
+			}
+
+			sum.Add(&sum) // double
+			digit.SetInt(uint32(abs8(d)))
+			if d < 0 {
+				digit.Negate()
+			}
+			sum.Add(&digit)
+		}
+		if !sum.Equals(&k) {
+			t.Fatalf("%x: the digits don't add up to the scalar", buf)
+		}
+	}
+}
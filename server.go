@@ -2,48 +2,131 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/binary"
 	"encoding/gob"
 	"fmt"
 	"log"
 	"net"
+	"time"
 )
 
 const protocol = "tcp"
-const nodeVersion = 1
+const nodeVersion = 2        // protocol version, 2 since the handshake
+const minPeerVersion = 2     // peers below it are disconnected
+const nodeNetwork uint64 = 1 // service flag of a node serving the full blockchain
+const userAgent = "/blockchain-go:0.2.0/"
 const commandLength = 12
 
+// address gossip
+const (
+	maxAddrPerMessage = 1000                // a peer sending more is disconnected
+	maxAddrToRelay    = 10                  // larger `addr` messages reply to `getaddr`, and aren't relayed
+	addrRelayPeers    = 2                   // peers a fresh address is relayed to
+	addrFreshness     = 10 * time.Minute    // addresses heard of for longer aren't relayed
+	addrMaxAge        = 30 * 24 * time.Hour // older addresses are ignored
+	advertiseInterval = 10 * time.Minute    // the node announces its address to its peers
+)
+
+// keepalive
+const (
+	pingInterval     = 30 * time.Second
+	pingTimeout      = 2 * time.Minute // a peer not answering a `ping` for longer is disconnected
+	peerInfoInterval = 5 * time.Second // `getpeerinfo` reads the peers saved this often
+)
+
+const stallCheckInterval = time.Second
+
 var nodeAddr string
+var localNonce uint64 // sent in `version`, to detect a connection to this node itself
 
-var miningAddress string                    // the mining reward payee
-var knownNodes = []string{"localhost:3000"} // central node
-var blocksInTransit = [][]byte{}            // a block hash set waiting to be downloaded
+var miningAddress string // the mining reward payee
 var mempool = make(map[string]Transaction)
 
-// StartServer starts a node to connect network
-// `nodeID`: constructing IP address "localhost:`nodeID`"
-// `minerAddress` : the address to received mining rewards to
-func StartServer(nodeID, minerAddress string) {
-	nodeAddr = fmt.Sprintf("localhost:%s", nodeID)
+// StartServer starts a node to connect network, with the chain in the data
+// directory
+// `port`: the node listens on "localhost:`port`"
+// `minerAddress` : the address to received mining rewards to, empty for a
+// node which doesn't mine
+func StartServer(port int, minerAddress string) {
+	nodeAddr = fmt.Sprintf("localhost:%d", port)
 	miningAddress = minerAddress
+	localNonce = randomNonce()
 	ln, err := net.Listen(protocol, nodeAddr)
 	logErr(err)
 	defer ln.Close()
 
-	bc := NewBlockchain(nodeID)
+	bc := LoadBlockchain()
+	chainHeaders = newHeaderChain(bc)
+	go peerManager.AcceptPeers(ln)
 
-	// If current node is not central node, then send `version` message to
-	// central node to know if its blockchain is outdated
-	if nodeAddr != knownNodes[0] {
-		sendVersion(knownNodes[0], bc)
-	}
+	// connect to the central node and the other known nodes, whose `version`
+	// tells if the blockchain of this node is outdated
+	peerManager.Start(bc)
 
+	// messages of all peers are handled one at a time, so the handlers
+	// share the node state without locks
+	advertise := time.NewTicker(advertiseInterval)
+	keepalive := time.NewTicker(pingInterval)
+	peerInfo := time.NewTicker(peerInfoInterval)
+	stalls := time.NewTicker(stallCheckInterval)
 	for {
-		conn, err := ln.Accept()
-		//logErr(err)
-		go handleConnection(conn, bc)
+		select {
+		case msg := <-inbox:
+			handleMessage(msg, bc)
+		case <-advertise.C:
+			for _, p := range peerManager.Peers() {
+				if p.HandshakeDone() {
+					sendAddr(p, []netAddress{selfAddress()})
+				}
+			}
+		case <-keepalive.C:
+			pingPeers()
+		case <-peerInfo.C:
+			SavePeerInfo(peerManager.Peers())
+		case <-stalls.C:
+			downloader.CheckStalls(chainHeaders, bc)
+		}
+	}
+}
+
+// ping the peers, and disconnect the ones which didn't answer the previous
+// `ping` in time
+func pingPeers() {
+	for _, p := range peerManager.Peers() {
+		if !p.HandshakeDone() {
+			continue
+		}
+		if p.pingNonce != 0 {
+			if time.Since(p.pingSent) > pingTimeout {
+				fmt.Printf("Disconnecting %s: no pong for %s\n", p, pingTimeout)
+				p.Disconnect()
+			}
+			continue
+		}
+		sendPing(p)
 	}
 }
 
+// the address of this node, to announce
+func selfAddress() netAddress {
+	return netAddress{nodeAddr, nodeNetwork, time.Now().Unix()}
+}
+
+// check if this node is the central node, the first seed node of the
+// network, which relays transactions
+func isCentralNode() bool {
+	return len(chainParams.SeedNodes) > 0 && nodeAddr == chainParams.SeedNodes[0]
+}
+
+func randomNonce() uint64 {
+	var buf [8]byte
+	_, err := rand.Read(buf[:])
+	logErr(err)
+
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
 // commandToBytes converts `command` into a 12-byte buffer
 func commandToBytes(command string) []byte {
 	var bytes [commandLength]byte
@@ -5,147 +5,313 @@ import (
 	"encoding/gob"
 	"encoding/hex"
 	"fmt"
-	"io/ioutil"
+	"math/rand"
 	"net"
+	"time"
 )
 
-// handleConnection handles different commands contained in `conn`
-func handleConnection(conn net.Conn, bc *Blockchain) {
-	request, err := ioutil.ReadAll(conn)
-	logErr(err)
+// handleMessage decodes the payload of a message from a peer and handles
+// it. A peer sending a malformed payload is disconnected.
+func handleMessage(msg peerMessage, bc *Blockchain) {
+	p := msg.peer
+	fmt.Printf("Received %s command from %s\n", msg.command, p)
+
+	decode := func(payload interface{}) bool {
+		dec := gob.NewDecoder(bytes.NewReader(msg.payload))
+		if err := dec.Decode(payload); err != nil {
+			fmt.Printf("Disconnecting %s: malformed %s message: %s\n", p, msg.command, err)
+			p.Disconnect()
+			return false
+		}
+		return true
+	}
 
-	// extract command
-	command := bytesToCommand(request[:commandLength])
-	fmt.Printf("Received %s command\n", command)
+	// nothing but the handshake is processed before it completes
+	if !p.HandshakeDone() && msg.command != "version" && msg.command != "verack" {
+		fmt.Printf("Ignoring %s command from %s before the handshake\n", msg.command, p)
+		return
+	}
 
-	switch command {
+	switch msg.command {
 	case "addr":
-		handleAddr(request)
+		var payload address
+		if decode(&payload) {
+			handleAddr(p, payload)
+		}
+	case "getaddr":
+		handleGetAddr(p)
+	case "ping":
+		var payload ping
+		if decode(&payload) {
+			sendPong(p, payload.Nonce)
+		}
+	case "pong":
+		var payload pong
+		if decode(&payload) {
+			handlePong(p, payload)
+		}
 	case "block":
-		handleBlock(request, bc)
+		var payload block
+		if decode(&payload) {
+			handleBlock(p, payload, bc)
+		}
 	case "inv":
-		handleInv(request, bc)
-	case "getblocks":
-		handleGetBlocks(request, bc)
+		var payload inv
+		if decode(&payload) {
+			handleInv(p, payload, bc)
+		}
+	case "getheaders":
+		var payload getheaders
+		if decode(&payload) {
+			handleGetHeaders(p, payload)
+		}
+	case "headers":
+		var payload headers
+		if decode(&payload) {
+			handleHeaders(p, payload)
+		}
 	case "getdata":
-		handleGetData(request, bc)
+		var payload getdata
+		if decode(&payload) {
+			handleGetData(p, payload, bc)
+		}
 	case "tx":
-		handleTx(request, bc)
+		var payload tx
+		if decode(&payload) {
+			handleTx(p, payload, bc)
+		}
 	case "version":
-		handleVersion(request, bc)
+		var payload version
+		if decode(&payload) {
+			handleVersion(p, payload, bc)
+		}
+	case "verack":
+		handleVerack(p, bc)
 	default:
 		fmt.Println("Unknown command!")
 	}
-
-	conn.Close()
 }
 
 /* ---------- Functions below are handling different message ---------- */
 
-func handleVersion(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
-	var payload version
+// the handshake: each node sends its `version` first, and acknowledges the
+// `version` of the other one with `verack`
+func handleVersion(p *Peer, payload version, bc *Blockchain) {
+	if p.versionReceived {
+		fmt.Printf("Ignoring another version from %s\n", p)
+		return
+	}
+	if payload.Nonce == localNonce {
+		fmt.Printf("Disconnecting %s: it is this node\n", p)
+		p.Disconnect()
+		return
+	}
+	if payload.Version < minPeerVersion {
+		fmt.Printf("Disconnecting %s: protocol version %d is below %d\n", p, payload.Version, minPeerVersion)
+		p.Disconnect()
+		return
+	}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	//logErr(err)
+	p.versionReceived = true
+	p.Version = payload.Version
+	p.Services = payload.Services
+	p.UserAgent = payload.UserAgent
+	p.StartHeight = payload.StartHeight
+	p.BestHeight = payload.StartHeight
+	if p.Inbound {
+		peerManager.registerPeer(p, payload.AddrFrom)
+	}
 
-	myBestHeight := bc.GetBestHeight()
-	foreignerBestHeight := payload.BestHeight
+	if !p.versionSent {
+		sendVersion(p, bc)
+	}
+	sendVerack(p)
 
-	if myBestHeight < foreignerBestHeight {
-		// If connected node's blockchain is longer, it replies `getblocks` message
-		// to sender of `version` message for getting newer blocks
-		sendGetBlocks(payload.AddrFrom)
-	} else if myBestHeight > foreignerBestHeight {
-		// If current node's blockchain is longer, it replies with `version` message
-		sendVersion(payload.AddrFrom, bc)
+	if p.HandshakeDone() {
+		completeHandshake(p, bc)
 	}
+}
 
+func handleVerack(p *Peer, bc *Blockchain) {
+	if !p.versionSent || p.verackReceived {
+		fmt.Printf("Ignoring unexpected verack from %s\n", p)
+		return
+	}
+
+	p.verackReceived = true
+
+	if p.HandshakeDone() {
+		completeHandshake(p, bc)
+	}
 }
 
-func handleAddr(request []byte) {
-	var buff bytes.Buffer
-	var payload address
+func completeHandshake(p *Peer, bc *Blockchain) {
+	fmt.Printf("Connected to %s: %s, protocol version %d, height %d\n", p, p.UserAgent, p.Version, p.StartHeight)
+	p.flushPending()
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	logErr(err)
+	// announce this node, and learn about others from an outbound peer,
+	// which an attacker can't choose
+	sendAddr(p, []netAddress{selfAddress()})
+	if !p.Inbound {
+		peerManager.MarkSeen(p.Addr, p.Services)
+		sendGetAddr(p)
+	}
 
-	// update `knownNodes`
-	knownNodes = append(knownNodes, payload.AddrList...)
-	fmt.Println("The are %d known nodes now!\n", len(knownNodes))
-	requestBlocks()
+	// measure the latency right away
+	sendPing(p)
 
+	// If connected node's blockchain is longer, it sends `getheaders` message
+	// for getting the headers of newer blocks, and then the blocks. Otherwise
+	// the peer does so, given our `version`.
+	if chainHeaders.Height() < p.StartHeight {
+		sendGetHeaders(p)
+	}
+	downloader.Schedule(chainHeaders)
 }
 
-func requestBlocks() {
-	for _, node := range knownNodes {
-		sendGetBlocks(node)
+// record the round-trip time of the `ping` of `p`
+func handlePong(p *Peer, payload pong) {
+	if p.pingNonce == 0 || payload.Nonce != p.pingNonce {
+		fmt.Printf("Ignoring unexpected pong from %s\n", p)
+		return
 	}
+
+	p.PingTime = time.Since(p.pingSent)
+	if p.MinPingTime == 0 || p.PingTime < p.MinPingTime {
+		p.MinPingTime = p.PingTime
+	}
+	p.pingNonce = 0
 }
 
-// When received a `block` message, add it if
-func handleBlock(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
-	var payload block
+// add the addresses to the address book, where the peer manager finds nodes
+// to connect to, and relay the fresh ones of an announcement
+func handleAddr(p *Peer, payload address) {
+	if len(payload.AddrList) > maxAddrPerMessage {
+		fmt.Printf("Disconnecting %s: %d addresses in a message\n", p, len(payload.AddrList))
+		p.Disconnect()
+		return
+	}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	logErr(err)
+	now := time.Now()
+	var fresh []netAddress
+	for _, na := range payload.AddrList {
+		if _, _, err := net.SplitHostPort(na.Addr); err != nil || na.Addr == nodeAddr {
+			continue
+		}
 
-	blockData := payload.Block
-	block := DeserializeBlock(blockData)
+		timestamp := time.Unix(na.Timestamp, 0)
+		if timestamp.After(now.Add(addrFreshness)) {
+			// a time in the future is a lie, so the address is treated as old
+			na.Timestamp = now.Add(-5 * 24 * time.Hour).Unix()
+		} else if now.Sub(timestamp) > addrMaxAge {
+			continue
+		}
 
-	fmt.Println("Received a new block!")
-	bc.AddBlock(block)
+		if peerManager.AddAddress(na, p.conn.RemoteAddr().String()) && now.Sub(timestamp) < addrFreshness {
+			fresh = append(fresh, na)
+		}
+	}
+	fmt.Printf("There are %d known nodes now!\n", len(peerManager.Addresses()))
 
-	fmt.Println("Added block %x\n", block.Hash)
+	if len(payload.AddrList) <= maxAddrToRelay && len(fresh) > 0 {
+		relayAddresses(p, fresh)
+	}
+}
 
-	if len(blocksInTransit) > 0 {
-		// each `handleBlock` only download one block
-		blockHash := blocksInTransit[0]
-		// send `getdata` message for getting block whose hash is `blockHash`
-		sendGetData(payload.AddrFrom, "block", blockHash)
+// send `addrs` to `addrRelayPeers` random peers other than `from`. Since an
+// address is only relayed when it's new or newer than known, an
+// announcement stops spreading once every node has it.
+func relayAddresses(from *Peer, addrs []netAddress) {
+	var peers []*Peer
+	for _, p := range peerManager.Peers() {
+		if p != from && p.HandshakeDone() {
+			peers = append(peers, p)
+		}
+	}
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
 
-		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := UTXOSet{bc}
-		UTXOSet.Reindex()
+	for i := 0; i < len(peers) && i < addrRelayPeers; i++ {
+		sendAddr(peers[i], addrs)
+	}
+}
+
+// reply with addresses of the address book, once per connection so that the
+// peer can't map the address book
+func handleGetAddr(p *Peer) {
+	if p.addrRequested {
+		fmt.Printf("Ignoring another getaddr from %s\n", p)
+		return
 	}
+	p.addrRequested = true
 
+	sendAddr(p, peerManager.Sample(maxAddrPerMessage))
 }
 
-func handleInv(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
-	var payload inv
+// reply with the headers of the blocks following the chain of the peer
+func handleGetHeaders(p *Peer, payload getheaders) {
+	sendHeaders(p, chainHeaders.HeadersAfter(payload.Locator, payload.HashStop, maxHeadersPerMessage))
+}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	logErr(err)
+// add the headers to the header chain, and download the blocks of the new
+// ones
+func handleHeaders(p *Peer, payload headers) {
+	if len(payload.Headers) > maxHeadersPerMessage {
+		fmt.Printf("Disconnecting %s: %d headers in a message\n", p, len(payload.Headers))
+		p.Disconnect()
+		return
+	}
 
-	fmt.Println("Received inventory with %d %s\n", len(payload.Items), payload.Type)
+	added, err := chainHeaders.Add(payload.Headers)
+	if err == errUnconnectedHeaders {
+		// the peer doesn't know where our chains fork, so tell it
+		sendGetHeaders(p)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Disconnecting %s: invalid headers: %s\n", p, err)
+		p.Disconnect()
+		return
+	}
+	if len(payload.Headers) > 0 {
+		if last := payload.Headers[len(payload.Headers)-1]; last.Height > p.BestHeight {
+			p.BestHeight = last.Height
+		}
+	}
+	fmt.Printf("Received %d headers, %d new, the header chain is at height %d\n", len(payload.Headers), added, chainHeaders.Height())
 
-	if payload.Type == "block" {
-		blocksInTransit = payload.Items
+	// a full message means there are more
+	if len(payload.Headers) == maxHeadersPerMessage {
+		sendGetHeaders(p)
+	}
+	downloader.Schedule(chainHeaders)
+}
 
-		// Here we only deal with `.Items[0]` because we won't send `inv` with multiple items
-		blockHash := payload.Items[0]
+// When received a `block` message, add it with the blocks downloaded
+// before it
+func handleBlock(p *Peer, payload block, bc *Blockchain) {
+	blockData := payload.Block
+	block := DeserializeBlock(blockData)
 
-		// send `getdata` message for getting block whose hash is `blockHash`
-		sendGetData(payload.AddrFrom, "block", blockHash)
+	downloader.BlockReceived(p, block, chainHeaders, bc)
+}
+
+func handleInv(p *Peer, payload inv, bc *Blockchain) {
+	fmt.Printf("Received inventory with %d %s\n", len(payload.Items), payload.Type)
+	if len(payload.Items) == 0 {
+		return
+	}
 
-		newInTransit := [][]byte{}
-		for _, b := range blocksInTransit {
-			if bytes.Compare(b, blockHash) != 0 {
-				newInTransit = append(newInTransit, b)
+	if payload.Type == "block" {
+		// a new block is downloaded headers first too: the headers tell
+		// where it is in the chain, and which blocks are missing before it
+		for _, hash := range payload.Items {
+			if _, ok := chainHeaders.HeightOf(hash); !ok {
+				sendGetHeaders(p)
+				break
 			}
 		}
-		blocksInTransit = newInTransit
 	}
 
 	if payload.Type == "tx" {
@@ -154,71 +320,62 @@ func handleInv(request []byte, bc *Blockchain) {
 		// check if tx hash is alread in our mempool.
 		// If not, send `getdata` message for getting transaction whose hash is `txID`
 		if mempool[hex.EncodeToString(txID)].ID == nil {
-			sendGetData(payload.AddrFrom, "tx", txID)
+			sendGetData(p, "tx", txID)
 		}
 	}
 }
 
-func handleGetBlocks(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
-	var payload getblocks
-
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	logErr(err)
-
-	blocks := bc.GetBlockHashes()
-
-	// reply `inv` message for showing others nodes `payload.AddrFrom`
-	// what blocks or transactions he has
-	sendInv(payload.AddrFrom, "block", blocks)
-}
-
-func handleGetData(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
-	var payload getdata
-
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	logErr(err)
-
+func handleGetData(p *Peer, payload getdata, bc *Blockchain) {
 	if payload.Type == "block" {
 		block, err := bc.GetBlock([]byte(payload.ID))
-		logErr(err)
+		if err != nil {
+			fmt.Printf("%s asked for unknown block %x\n", p, payload.ID)
+			return
+		}
 
 		// reply with block data
-		sendBlock(payload.AddrFrom, &block)
+		sendBlock(p, &block)
 	}
 
 	if payload.Type == "tx" {
 		txID := hex.EncodeToString(payload.ID)
-		tx := mempool[txID]
+		tx, ok := mempool[txID]
+		if !ok {
+			fmt.Printf("%s asked for unknown transaction %s\n", p, txID)
+			return
+		}
 
 		// reply with transaction data
-		sendTx(payload.AddrFrom, &tx)
+		sendTx(p, &tx)
 	}
 }
 
-func handleTx(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
-	var payload tx
-
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	logErr(err)
-
+// add a transaction to the mempool if it's valid and spends no output which
+// the mempool spends. A peer sending a malformed transaction is disconnected.
+func handleTx(p *Peer, payload tx, bc *Blockchain) {
 	txData := payload.Transaction
-	tx := DeserializeTransaction(txData)
+	tx, err := DeserializeTransaction(txData)
+	if err != nil {
+		fmt.Printf("Disconnecting %s: malformed transaction: %s\n", p, err)
+		p.Disconnect()
+		return
+	}
+	if _, ok := mempool[hex.EncodeToString(tx.ID)]; ok {
+		return
+	}
+	// a transaction may be invalid only here: its inputs may not be mined
+	// yet, or already be spent by a block or another transaction
+	if err := bc.checkMempoolTransaction(&tx, mempoolSpentOutputs()); err != nil {
+		fmt.Printf("Ignoring transaction %x from %s: %s\n", tx.ID, p, err)
+		return
+	}
 	mempool[hex.EncodeToString(tx.ID)] = tx
 
-	if nodeAddr == knownNodes[0] {
-		for _, node := range knownNodes {
-			if node != nodeAddr && node != payload.AddrFrom {
-				// show to `node` transaction `tx`
-				sendInv(node, "tx", [][]byte{tx.ID})
+	if isCentralNode() {
+		for _, peer := range peerManager.Peers() {
+			if peer != p {
+				// show to `peer` transaction `tx`
+				sendInv(peer, "tx", [][]byte{tx.ID})
 			}
 		}
 	} else {
@@ -226,23 +383,37 @@ func handleTx(request []byte, bc *Blockchain) {
 		MineTransactions:
 			// Begin to mine block
 			var txs []*Transaction
+			fees := 0
+			spent := make(map[string]bool) // by the transactions of the block
 
 			for id := range mempool {
 				tx := mempool[id]
-				if bc.VerifyTransaction(&tx) {
-					txs = append(txs, &tx)
+				// a transaction valid when received may spend an output
+				// which a block has spent since
+				if err := bc.checkMempoolTransaction(&tx, spent); err != nil {
+					fmt.Printf("Dropping transaction %s: %s\n", id, err)
+					delete(mempool, id)
+					continue
 				}
+				fee, err := bc.TransactionFee(&tx)
+				logErr(err) // its inputs were found when verifying it
+				txs = append(txs, &tx)
+				fees += fee
 			}
 
 			if len(txs) == 0 {
 				fmt.Println("All transactions are invalid! Waiting for new ones...")
 				return
 			}
-
-			cbTx := NewCoinbaseTX(miningAddress, "")
-			txs = append(txs, cbTx)
+			cbTx := NewCoinbaseTX(miningAddress, "", fees)
+			txs = append([]*Transaction{cbTx}, txs...) // coinbase is the first transaction
 
 			newBlock := bc.MineBlock(txs)
+			if newBlock == nil { // the reason is logged by MineBlock
+				fmt.Println("Mining failed! Waiting for new transactions...")
+				return
+			}
+			chainHeaders.AddMinedBlock(newBlock)
 			UTXOSet := UTXOSet{bc}
 			UTXOSet.Reindex()
 
@@ -255,10 +426,8 @@ func handleTx(request []byte, bc *Blockchain) {
 			}
 
 			// broadcast block
-			for _, node := range knownNodes {
-				if node != nodeAddr {
-					sendInv(node, "block", [][]byte{newBlock.Hash})
-				}
+			for _, peer := range peerManager.Peers() {
+				sendInv(peer, "block", [][]byte{newBlock.Hash})
 			}
 
 			if len(mempool) > 0 {
@@ -267,3 +436,16 @@ func handleTx(request []byte, bc *Blockchain) {
 		}
 	}
 }
+
+// return the outputs spent by the transactions of `mempool`, as "txid:vout"
+func mempoolSpentOutputs() map[string]bool {
+	spent := make(map[string]bool)
+
+	for _, tx := range mempool {
+		for _, vin := range tx.Vin {
+			spent[fmt.Sprintf("%x:%d", vin.Txid, vin.Vout)] = true
+		}
+	}
+
+	return spent
+}
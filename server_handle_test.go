@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// a peer sending a malformed transaction is disconnected, instead of making
+// the node panic, while one sending a transaction which is invalid only on
+// this node is not
+func TestHandleTxDisconnectsPeer(t *testing.T) {
+	miner := NewWallet(false)
+	bc := newTestBlockchain(t, miner)
+	genesis, err := bc.GetBlock(bc.tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mempool = make(map[string]Transaction) })
+
+	p := newTestPeer()
+	handleTx(p, tx{"test", []byte("not a transaction")}, bc)
+	if p.Connected() {
+		t.Error("a peer sending a malformed transaction is still connected")
+	}
+
+	unknown := &Transaction{nil, []TXInput{{make([]byte, 32), 0, nil, TXWitness{}}}, []TXOutput{*NewTXOutput(5, string(miner.GetAddress()))}, 0}
+	unknown.ID = unknown.Hash()
+	p = newTestPeer()
+	handleTx(p, tx{"test", unknown.Serialize()}, bc)
+	if !p.Connected() {
+		t.Error("a peer sending a transaction spending an unknown output is disconnected")
+	}
+	if len(mempool) != 0 {
+		t.Error("an invalid transaction is in the mempool")
+	}
+
+	valid := newSpendingTX(genesis.Transactions[0], miner, NewWallet(false))
+	p = newTestPeer()
+	handleTx(p, tx{"test", valid.Serialize()}, bc)
+	if !p.Connected() {
+		t.Error("a peer sending a valid transaction is disconnected")
+	}
+	if _, ok := mempool[hex.EncodeToString(valid.ID)]; !ok {
+		t.Error("a valid transaction isn't in the mempool")
+	}
+}
+
+// a transaction spending an output which the mempool already spends isn't
+// added, nor mined along with the first one
+func TestHandleTxRejectsDoubleSpend(t *testing.T) {
+	miner := NewWallet(false)
+	bc := newTestBlockchain(t, miner)
+	genesis, err := bc.GetBlock(bc.tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mempool = make(map[string]Transaction) })
+
+	toAlice := newSpendingTX(genesis.Transactions[0], miner, NewWallet(false))
+	toBob := newSpendingTX(genesis.Transactions[0], miner, NewWallet(false))
+	p := newTestPeer()
+	handleTx(p, tx{"test", toAlice.Serialize()}, bc)
+	handleTx(p, tx{"test", toBob.Serialize()}, bc)
+	if !p.Connected() {
+		t.Error("a peer relaying a double spend is disconnected")
+	}
+	if _, ok := mempool[hex.EncodeToString(toBob.ID)]; ok || len(mempool) != 1 {
+		t.Error("both spends of an output are in the mempool")
+	}
+
+	cbTx := NewCoinbaseTX(string(miner.GetAddress()), "", 0)
+	if bc.MineBlock([]*Transaction{cbTx, toAlice, toBob}) != nil {
+		t.Error("a block spending an output twice is mined")
+	}
+}
+
+// nothing but the handshake is handled before it completes, and the messages
+// to the peer wait for it
+func TestMessagesBeforeHandshake(t *testing.T) {
+	miner := NewWallet(false)
+	bc := newTestBlockchain(t, miner)
+	genesis, err := bc.GetBlock(bc.tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers, manager := chainHeaders, peerManager
+	chainHeaders, peerManager = newHeaderChain(bc), NewPeerManager(defaultTargetOutbound, defaultMaxInbound)
+	t.Cleanup(func() {
+		chainHeaders, peerManager = headers, manager
+		mempool = make(map[string]Transaction)
+	})
+
+	p := newTestPeer()
+	send := func(command string, payload []byte) {
+		handleMessage(peerMessage{p, command, payload}, bc)
+	}
+	payment := tx{"test", newSpendingTX(genesis.Transactions[0], miner, NewWallet(false)).Serialize()}
+
+	sendVersion(p, bc)
+	send("tx", gobEncode(payment))
+	send("version", gobEncode(version{nodeVersion, nodeNetwork, time.Now().Unix(), localNonce + 1, userAgent, 0, p.Addr}))
+	send("tx", gobEncode(payment))
+	sendGetAddr(p)
+	if len(mempool) != 0 {
+		t.Error("a transaction is handled before the handshake completed")
+	}
+	if len(p.pending) != 1 {
+		t.Errorf("%d messages wait for the handshake, want 1", len(p.pending))
+	}
+
+	send("verack", nil)
+	if !p.HandshakeDone() || !p.Connected() {
+		t.Fatal("the handshake didn't complete")
+	}
+	var commands []string
+	for len(p.sendQueue) > 0 {
+		command, _, err := readMessage(bytes.NewReader(<-p.sendQueue))
+		if err != nil {
+			t.Fatal(err)
+		}
+		commands = append(commands, command)
+	}
+	if len(commands) < 3 || commands[0] != "version" || commands[1] != "verack" || commands[2] != "getaddr" {
+		t.Errorf("sent %v, want version, verack and then the waiting getaddr", commands)
+	}
+
+	send("tx", gobEncode(payment))
+	if len(mempool) != 1 {
+		t.Error("a transaction isn't handled after the handshake")
+	}
+}
+
+// a peer of an older protocol version, or this node itself, is disconnected
+// during the handshake
+func TestHandshakeRejectsPeer(t *testing.T) {
+	bc := newTestBlockchain(t, NewWallet(false))
+
+	old := newTestPeer()
+	handleVersion(old, version{minPeerVersion - 1, nodeNetwork, time.Now().Unix(), localNonce + 1, userAgent, 0, old.Addr}, bc)
+	if old.Connected() {
+		t.Error("a peer below the minimum protocol version is connected")
+	}
+
+	self := newTestPeer()
+	handleVersion(self, version{nodeVersion, nodeNetwork, time.Now().Unix(), localNonce, userAgent, 0, self.Addr}, bc)
+	if self.Connected() {
+		t.Error("a connection to this node itself is kept")
+	}
+}
+
+// return `n` peers done with the handshake, known to `peerManager`
+func newTestHandshakenPeers(n int) []*Peer {
+	var peers []*Peer
+	for i := 0; i < n; i++ {
+		conn, _ := net.Pipe()
+		p := newPeer(conn, fmt.Sprintf("10.0.0.%d:3000", i+1), false)
+		p.versionReceived, p.verackReceived = true, true
+		peerManager.peers[p.Addr] = p
+		peers = append(peers, p)
+	}
+
+	return peers
+}
+
+// a fresh address is relayed to `addrRelayPeers` peers other than its
+// sender, once, and a large `addr` message isn't relayed
+func TestAddrRelayLimits(t *testing.T) {
+	manager := peerManager
+	peerManager = NewPeerManager(defaultTargetOutbound, defaultMaxInbound)
+	t.Cleanup(func() { peerManager = manager })
+
+	peers := newTestHandshakenPeers(5)
+	from := peers[0]
+	relayed := func() int {
+		n := 0
+		for _, p := range peers {
+			for len(p.sendQueue) > 0 {
+				if p == from {
+					t.Error("an address is relayed to its sender")
+				}
+				<-p.sendQueue
+				n++
+			}
+		}
+		return n
+	}
+
+	fresh := netAddress{"10.1.0.1:3000", nodeNetwork, time.Now().Unix()}
+	handleAddr(from, address{[]netAddress{fresh}})
+	if n := relayed(); n != addrRelayPeers {
+		t.Errorf("a fresh address is relayed to %d peers, want %d", n, addrRelayPeers)
+	}
+	handleAddr(from, address{[]netAddress{fresh}})
+	if n := relayed(); n != 0 {
+		t.Errorf("a known address is relayed again to %d peers", n)
+	}
+
+	var many []netAddress
+	for i := 0; i <= maxAddrToRelay; i++ {
+		many = append(many, netAddress{fmt.Sprintf("10.2.0.%d:3000", i), nodeNetwork, time.Now().Unix()})
+	}
+	handleAddr(from, address{many})
+	if n := relayed(); n != 0 {
+		t.Errorf("%d addresses are relayed to %d peers", len(many), n)
+	}
+
+	old := netAddress{"10.3.0.1:3000", nodeNetwork, time.Now().Add(-2 * addrFreshness).Unix()}
+	handleAddr(from, address{[]netAddress{old}})
+	if n := relayed(); n != 0 {
+		t.Errorf("an address heard of long ago is relayed to %d peers", n)
+	}
+
+	tooMany := make([]netAddress, maxAddrPerMessage+1)
+	handleAddr(from, address{tooMany})
+	if from.Connected() {
+		t.Errorf("a peer sending %d addresses is connected", len(tooMany))
+	}
+}
+
+// a peer is pinged once its last `ping` is answered, and disconnected when
+// it doesn't answer it within `pingTimeout`
+func TestPingTimeout(t *testing.T) {
+	manager := peerManager
+	peerManager = NewPeerManager(defaultTargetOutbound, defaultMaxInbound)
+	t.Cleanup(func() { peerManager = manager })
+
+	peers := newTestHandshakenPeers(3)
+	idle, waiting, silent := peers[0], peers[1], peers[2]
+	sendPing(waiting)
+	sendPing(silent)
+	silent.pingSent = time.Now().Add(-pingTimeout - time.Second)
+	for _, p := range peers {
+		for len(p.sendQueue) > 0 {
+			<-p.sendQueue
+		}
+	}
+
+	pingPeers()
+	if idle.pingNonce == 0 || len(idle.sendQueue) != 1 {
+		t.Error("an idle peer isn't pinged")
+	}
+	if !waiting.Connected() || len(waiting.sendQueue) != 0 {
+		t.Error("a peer whose ping isn't late is disconnected or pinged again")
+	}
+	if silent.Connected() {
+		t.Errorf("a peer not answering a ping for %s is connected", pingTimeout)
+	}
+
+	handlePong(waiting, pong{waiting.pingNonce + 1})
+	if waiting.pingNonce == 0 {
+		t.Error("a pong with another nonce answers the ping")
+	}
+	handlePong(waiting, pong{waiting.pingNonce})
+	if waiting.pingNonce != 0 || waiting.PingTime == 0 || waiting.MinPingTime != waiting.PingTime {
+		t.Errorf("the pong isn't recorded: ping time %s, min %s", waiting.PingTime, waiting.MinPingTime)
+	}
+}
+
+// an inbound peer is known by the address it connects from, so claiming the
+// address of another peer in its `version` doesn't replace that one
+func TestInboundPeerCantClaimAnotherAddress(t *testing.T) {
+	bc := newTestBlockchain(t, NewWallet(false))
+	manager := peerManager
+	peerManager = NewPeerManager(defaultTargetOutbound, defaultMaxInbound)
+	t.Cleanup(func() { peerManager = manager })
+
+	outbound := newTestPeer()
+	peerManager.peers[outbound.Addr] = outbound
+
+	conn, _ := net.Pipe()
+	inbound := newPeer(conn, "10.0.0.1:50000", true)
+	handleVersion(inbound, version{nodeVersion, nodeNetwork, 0, 1, userAgent, 0, outbound.Addr}, bc)
+
+	if peerManager.peers[outbound.Addr] != outbound {
+		t.Error("the inbound peer replaced the peer whose address it claimed")
+	}
+	if peerManager.peers[inbound.Addr] != inbound {
+		t.Error("the inbound peer isn't known by the address it connects from")
+	}
+}
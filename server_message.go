@@ -1,14 +1,29 @@
 package main
 
-// `version` message for checking if current nodes' blockchain is outdated
+// `version` message opening the handshake, which the peer acknowledges with a
+// `verack` message without payload, and for checking if current
+// nodes' blockchain is outdated
 type version struct {
-	Version    int
-	BestHeight int    // length of blockchain
-	AddrFrom   string // sender's address
+	Version     int    // protocol version
+	Services    uint64 // bitfield of the services of the sender, such as `nodeNetwork`
+	Timestamp   int64  // sender's time, in Unix seconds
+	Nonce       uint64 // random for each run of a node, to detect a connection to itself
+	UserAgent   string // sender's software, such as "/blockchain-go:0.2.0/"
+	StartHeight int    // height of the sender's blockchain
+	AddrFrom    string // sender's address
 }
 
+// `addr` message gossiping addresses of nodes, replying to a `getaddr`
+// message without payload or announcing a few fresh addresses
 type address struct {
-	AddrList []string
+	AddrList []netAddress
+}
+
+// an address of a node in an `addr` message
+type netAddress struct {
+	Addr      string // "host:port" the node listens on
+	Services  uint64 // bitfield of the services of the node
+	Timestamp int64  // last time the node was heard of, in Unix seconds
 }
 
 type block struct {
@@ -21,9 +36,27 @@ type tx struct {
 	Transaction []byte
 }
 
-// `getblocks` message for getting his list of blocks hashes
-type getblocks struct {
-	AddrFrom string // sender's address
+// `ping` message checking that a peer is alive, which replies `pong` with
+// the same nonce
+type ping struct {
+	Nonce uint64
+}
+
+type pong struct {
+	Nonce uint64
+}
+
+// `getheaders` message for getting the headers following the first hash of
+// `Locator` the peer knows, up to `HashStop` or `maxHeadersPerMessage`
+// headers
+type getheaders struct {
+	Locator  [][]byte // hashes of the header chain of the sender, see `headerChain.Locator`
+	HashStop []byte   // hash of the last header wanted, empty for as many as possible
+}
+
+// `headers` message replying to `getheaders`
+type headers struct {
+	Headers []BlockHeader
 }
 
 // `getdata` message for getting data
@@ -1,102 +1,84 @@
 package main
 
 import (
-	"bytes"
-	"fmt"
-	"io"
-	"net"
+	"time"
 )
 
-// sendVersion sends `addr` `version` message
-func sendVersion(addr string, bc *Blockchain) {
+// sendVersion sends `p` `version` message
+func sendVersion(p *Peer, bc *Blockchain) {
 	bestHeight := bc.GetBestHeight()
 	payload := gobEncode(version{
 		nodeVersion,
+		nodeNetwork,
+		time.Now().Unix(),
+		localNonce,
+		userAgent,
 		bestHeight,
 		nodeAddr,
 	})
 
-	// Message are sequence of bytes on low level.
-	// First 12 bytes speficy command ("version" here) and latter bytes are
-	// gob-encoded message structure
-	request := append(commandToBytes("version"), payload...)
-
-	sendData(addr, request)
+	// Message are sequence of bytes on low level, framed by QueueMessage
+	// with the command ("version" here); the payload is the gob-encoded
+	// message structure
+	p.QueueMessage("version", payload)
+	p.versionSent = true
 }
 
-// send `data` to `addr`
-func sendData(addr string, data []byte) {
-	// connect to `addr`
-	conn, err := net.Dial(protocol, addr)
-
-	// if connect error
-	if err != nil {
-		fmt.Println("%s is not available\n", addr)
-		var updatedNodes []string
-
-		// update `knownNodes`
-		for _, node := range knownNodes {
-			if node != addr {
-				updatedNodes = append(updatedNodes, node)
-			}
-		}
+// acknowledge the `version` of `p`
+func sendVerack(p *Peer) {
+	p.QueueMessage("verack", nil)
+}
 
-		knownNodes = updatedNodes // new `knownNodes` that don't contain `addr`
+func sendAddr(p *Peer, addrs []netAddress) {
+	p.QueueMessage("addr", gobEncode(address{addrs}))
+}
 
-		return
-	}
-	defer conn.Close()
+// send `ping` message to `p`, and wait for its `pong`
+func sendPing(p *Peer) {
+	p.pingNonce = randomNonce()
+	p.pingSent = time.Now()
 
-	_, err = io.Copy(conn, bytes.NewReader(data))
-	logErr(err)
+	p.QueueMessage("ping", gobEncode(ping{p.pingNonce}))
 }
 
-func sendAddr(addr string) {
-	nodes := address{knownNodes}
-	nodes.AddrList = append(nodes.AddrList, nodeAddr)
-	payload := gobEncode(nodes)
-	request := append(commandToBytes("addr"), payload...)
+func sendPong(p *Peer, nonce uint64) {
+	p.QueueMessage("pong", gobEncode(pong{nonce}))
+}
 
-	sendData(addr, request)
+// ask `p` for addresses of other nodes
+func sendGetAddr(p *Peer) {
+	p.QueueMessage("getaddr", nil)
 }
 
-func sendBlock(addr string, b *Block) {
+func sendBlock(p *Peer, b *Block) {
 	data := block{nodeAddr, b.Serialize()}
-	payload := gobEncode(data)
-	request := append(commandToBytes("block"), payload...)
 
-	sendData(addr, request)
+	p.QueueMessage("block", gobEncode(data))
 }
 
-func sendTx(addr string, tnx *Transaction) {
+func sendTx(p *Peer, tnx *Transaction) {
 	data := tx{nodeAddr, tnx.Serialize()}
-	payload := gobEncode(data)
-	request := append(commandToBytes("tx"), payload...)
 
-	sendData(addr, request)
+	p.QueueMessage("tx", gobEncode(data))
 }
 
-// send `inv` message to `addr`
-func sendInv(addr, kind string, items [][]byte) {
+// send `inv` message to `p`
+func sendInv(p *Peer, kind string, items [][]byte) {
 	inventory := inv{nodeAddr, kind, items}
-	payload := gobEncode(inventory)
-	request := append(commandToBytes("inv"), payload...)
 
-	sendData(addr, request)
+	p.QueueMessage("inv", gobEncode(inventory))
 }
 
-// send `getblocks` message to `addr`
-func sendGetBlocks(addr string) {
-	payload := gobEncode(getblocks{nodeAddr})
-	request := append(commandToBytes("getblocks"), payload...)
-
-	sendData(addr, request)
+// ask `p` for the headers following the header chain of the node
+func sendGetHeaders(p *Peer) {
+	p.QueueMessage("getheaders", gobEncode(getheaders{chainHeaders.Locator(), nil}))
 }
 
-// send a message to `addr` for getting
-func sendGetData(addr, kind string, id []byte) {
-	payload := gobEncode(getdata{nodeAddr, kind, id})
-	request := append(commandToBytes("getdata"), payload...)
+func sendHeaders(p *Peer, h []BlockHeader) {
+	p.QueueMessage("headers", gobEncode(headers{h}))
+}
 
-	sendData(addr, request)
+// send a message to `p` for getting
+func sendGetData(p *Peer, kind string, id []byte) {
+	p.QueueMessage("getdata", gobEncode(getdata{nodeAddr, kind, id}))
 }
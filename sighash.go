@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/sha256"
+)
+
+// Signature hash types. The type byte is appended to each signature and tells
+// which parts of the transaction the signature covers.
+const (
+	SigHashAll          = byte(0x01) // all inputs and all outputs
+	SigHashNone         = byte(0x02) // all inputs, no outputs
+	SigHashSingle       = byte(0x03) // all inputs, only the output with the same index as the signed input
+	SigHashAnyOneCanPay = byte(0x80) // modifier: only the signed input, so others can add their own inputs
+)
+
+// check if `hashType` is a known signature hash type
+func isValidSigHashType(hashType byte) bool {
+	base := hashType &^ SigHashAnyOneCanPay
+	return base >= SigHashAll && base <= SigHashSingle
+}
+
+// return the hash signed by input `inID` which spends `prevOut`
+//
+// 1. Empty Witness field in all TXInputs
+// 2. Fill witness PubKey field of input `inID` with the locking data of `prevOut`
+// 3. Drop the inputs and outputs which `hashType` doesn't cover
+// 4. Hash the transaction together with `hashType`
+//
+// The locking data is the public key hash, the x-only public key, or the hash
+// of the HTLC contract. Returns nil if `hashType` can't be applied to input
+// `inID`.
+func (tx *Transaction) SignatureHash(inID int, prevOut TXOutput, hashType byte) []byte {
+	if !isValidSigHashType(hashType) || inID >= len(tx.Vin) {
+		return nil
+	}
+
+	txCopy := tx.TrimmedCopy()
+	txCopy.Vin[inID].Witness.PubKey = prevOut.PubKeyHash
+	if prevOut.XOnlyPubKey != nil {
+		txCopy.Vin[inID].Witness.PubKey = prevOut.XOnlyPubKey
+	}
+	if prevOut.HTLC != nil {
+		txCopy.Vin[inID].Witness.PubKey = prevOut.HTLC.ContractHash()
+	}
+
+	switch hashType &^ SigHashAnyOneCanPay {
+	case SigHashNone:
+		txCopy.Vout = nil
+	case SigHashSingle:
+		// Bitcoin signs the hash `1` here, which lets anybody spend the
+		// input. We refuse instead.
+		if inID >= len(txCopy.Vout) {
+			return nil
+		}
+		txCopy.Vout = txCopy.Vout[:inID+1]
+		for i := 0; i < inID; i++ {
+			txCopy.Vout[i] = TXOutput{-1, nil, nil, nil}
+		}
+	}
+
+	if hashType&SigHashAnyOneCanPay != 0 {
+		txCopy.Vin = []TXInput{txCopy.Vin[inID]}
+	}
+
+	hash := sha256.Sum256(append(txCopy.SerializeForHash(), hashType))
+	return hash[:]
+}
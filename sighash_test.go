@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// return a transaction with two inputs and two outputs, and the output the
+// inputs spend
+func newSigHashTestTX() (*Transaction, TXOutput) {
+	owner := string(NewWallet(false).GetAddress())
+	ins := []TXInput{
+		{bytes.Repeat([]byte{1}, 32), 0, nil, TXWitness{}},
+		{bytes.Repeat([]byte{2}, 32), 1, nil, TXWitness{}},
+	}
+	outs := []TXOutput{*NewTXOutput(5, owner), *NewTXOutput(6, owner)}
+
+	return &Transaction{nil, ins, outs, 0}, *NewTXOutput(11, owner)
+}
+
+// check which changes of the transaction change the hash signed by input
+// `inID` with each hash type
+func TestSignatureHashCoverage(t *testing.T) {
+	changes := []struct {
+		name   string
+		change func(tx *Transaction)
+	}{
+		{"the signed input", func(tx *Transaction) { tx.Vin[0].Vout = 2 }},
+		{"another input", func(tx *Transaction) { tx.Vin[1].Vout = 2 }},
+		{"an added input", func(tx *Transaction) { tx.Vin = append(tx.Vin, tx.Vin[1]) }},
+		{"the output of the input", func(tx *Transaction) { tx.Vout[0].Value = 4 }},
+		{"another output", func(tx *Transaction) { tx.Vout[1].Value = 7 }},
+		{"the lock time", func(tx *Transaction) { tx.LockTime = 10 }},
+	}
+	tests := []struct {
+		hashType byte
+		covered  []bool // whether each change is covered
+	}{
+		{SigHashAll, []bool{true, true, true, true, true, true}},
+		{SigHashNone, []bool{true, true, true, false, false, true}},
+		{SigHashSingle, []bool{true, true, true, true, false, true}},
+		{SigHashAll | SigHashAnyOneCanPay, []bool{true, false, false, true, true, true}},
+		{SigHashNone | SigHashAnyOneCanPay, []bool{true, false, false, false, false, true}},
+		{SigHashSingle | SigHashAnyOneCanPay, []bool{true, false, false, true, false, true}},
+	}
+
+	for _, test := range tests {
+		for i, c := range changes {
+			tx, prevOut := newSigHashTestTX()
+			hash := tx.SignatureHash(0, prevOut, test.hashType)
+			c.change(tx)
+			changed := !bytes.Equal(hash, tx.SignatureHash(0, prevOut, test.hashType))
+			if changed != test.covered[i] {
+				t.Errorf("hash type %#x: covers %s: %v, want %v", test.hashType, c.name, changed, test.covered[i])
+			}
+		}
+	}
+}
+
+// each hash type gives a different hash, and one which can't be applied to
+// the input gives none
+func TestSignatureHashTypes(t *testing.T) {
+	tx, prevOut := newSigHashTestTX()
+	hashes := make(map[string]bool)
+	for _, hashType := range []byte{SigHashAll, SigHashNone, SigHashSingle, SigHashAll | SigHashAnyOneCanPay} {
+		hash := tx.SignatureHash(1, prevOut, hashType)
+		if hash == nil || hashes[string(hash)] {
+			t.Errorf("hash type %#x gives hash %x", hashType, hash)
+		}
+		hashes[string(hash)] = true
+	}
+
+	if tx.SignatureHash(0, prevOut, 0x04) != nil {
+		t.Error("an unknown hash type gives a hash")
+	}
+	if tx.SignatureHash(2, prevOut, SigHashAll) != nil {
+		t.Error("an input out of range gives a hash")
+	}
+	tx.Vout = tx.Vout[:1]
+	for _, hashType := range []byte{SigHashSingle, SigHashSingle | SigHashAnyOneCanPay} {
+		if tx.SignatureHash(1, prevOut, hashType) != nil {
+			t.Errorf("hash type %#x gives a hash for an input without an output", hashType)
+		}
+	}
+}
+
+// a signature spending an HTLC output commits to the contract
+func TestSignatureHashCoversHTLC(t *testing.T) {
+	tx, _ := newSigHashTestTX()
+	recipient, refund := string(NewWallet(false).GetAddress()), string(NewWallet(false).GetAddress())
+	_, hash := NewHTLCSecret()
+
+	htlc := *NewHTLCOutput(11, recipient, refund, hash, 10)
+	later := *NewHTLCOutput(11, recipient, refund, hash, 20)
+	if bytes.Equal(tx.SignatureHash(0, htlc, SigHashAll), tx.SignatureHash(0, later, SigHashAll)) {
+		t.Error("the hash doesn't cover the timeout of the HTLC")
+	}
+	swapped := *NewHTLCOutput(11, refund, recipient, hash, 10)
+	if bytes.Equal(tx.SignatureHash(0, htlc, SigHashAll), tx.SignatureHash(0, swapped, SigHashAll)) {
+		t.Error("the hash doesn't cover the keys of the HTLC")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+)
+
+// sign `hash` with the wallet's private key
+//
+// returns a DER-encoded signature whose S is in the lower half of the curve
+// order (low-S). Both S and -S are valid, so allowing only one of them keeps
+// others from changing the signature.
+func (w Wallet) Sign(hash []byte) []byte {
+	if isLegacyPubKey(w.PublicKey) {
+		return signLegacy(w.PrivateKey, hash)
+	}
+
+	privKey, _ := btcec.PrivKeyFromBytes(w.PrivateKey)
+	signature := ecdsa.Sign(privKey, hash) // RFC 6979 deterministic nonce, low-S
+
+	return signature.Serialize()
+}
+
+// check if `signature` of `hash` is made by the owner of `pubKey`
+func verifySignature(pubKey, hash, signature []byte) bool {
+	if isLegacyPubKey(pubKey) {
+		return verifyLegacy(pubKey, hash, signature)
+	}
+
+	key, err := btcec.ParsePubKey(pubKey)
+	if err != nil {
+		return false
+	}
+	sig, err := ecdsa.ParseDERSignature(signature)
+	if err != nil {
+		return false
+	}
+
+	// Serialize always outputs strict DER with low-S, so anything else is
+	// a malleated signature
+	if bytes.Compare(sig.Serialize(), signature) != 0 {
+		return false
+	}
+
+	return sig.Verify(hash, key)
+}
+
+// check if `pubKey` is a P256 key from a wallet file created before
+// secp256k1 was used
+func isLegacyPubKey(pubKey []byte) bool {
+	return len(pubKey) != btcec.PubKeyBytesLenCompressed
+}
@@ -2,24 +2,19 @@ package main
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
 	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
 	"fmt"
 	"log"
-	"math/big"
 	"strings"
 )
 
-const subsidy = 10
-
 type Transaction struct {
-	ID   []byte
-	Vin  []TXInput
-	Vout []TXOutput
+	ID       []byte
+	Vin      []TXInput
+	Vout     []TXOutput
+	LockTime int // the transaction can't be mined into a block lower than this height
 }
 
 // check if the transaction is coinbase
@@ -38,156 +33,333 @@ func (tx Transaction) Serialize() []byte {
 	return encoded.Bytes()
 }
 
-// serialize `tx` and hash it with SHA-256 algorithm.
+// serialize `tx` for hashing, leaving out its ID. Integers take 8 bytes,
+// big-endian, and byte slices are prefixed by their length, so the result
+// only depends on the content of `tx`: the output of gob also depends on
+// the types the process encoded before, like the wallet file.
+func (tx *Transaction) SerializeForHash() []byte {
+	var encoded bytes.Buffer
+	writeInt := func(n int) { encoded.Write(IntToHex(int64(n))) }
+	writeBytes := func(data []byte) {
+		writeInt(len(data))
+		encoded.Write(data)
+	}
+
+	writeInt(len(tx.Vin))
+	for _, vin := range tx.Vin {
+		writeBytes(vin.Txid)
+		writeInt(vin.Vout)
+		writeBytes(vin.Data)
+		writeBytes(vin.Witness.Signature)
+		writeBytes(vin.Witness.PubKey)
+		writeBytes(vin.Witness.Preimage)
+	}
+
+	writeInt(len(tx.Vout))
+	for _, vout := range tx.Vout {
+		writeInt(vout.Value)
+		writeBytes(vout.PubKeyHash)
+		if vout.HTLC == nil {
+			encoded.WriteByte(0)
+		} else {
+			encoded.WriteByte(1)
+			writeBytes(vout.HTLC.Hash)
+			writeBytes(vout.HTLC.RecipientPubKeyHash)
+			writeBytes(vout.HTLC.RefundPubKeyHash)
+			writeInt(vout.HTLC.Timeout)
+		}
+		writeBytes(vout.XOnlyPubKey)
+	}
+
+	writeInt(tx.LockTime)
+
+	return encoded.Bytes()
+}
+
+// serialize `tx` without witnesses and hash it with SHA-256 algorithm.
+// The result is the transaction ID.
 func (tx *Transaction) Hash() []byte {
 	var hash [32]byte
 
-	txCopy := *tx
-	txCopy.ID = []byte{}
-
-	hash = sha256.Sum256(txCopy.Serialize())
+	txCopy := tx.TrimmedCopy()
+	hash = sha256.Sum256(txCopy.SerializeForHash())
 
 	return hash[:]
-
 }
 
-// return a transaction which empties Sinature and PubKey filed in all TXInpus
+// return a transaction which empties Witness filed in all TXInpus
 func (tx *Transaction) TrimmedCopy() Transaction {
 	var inputs []TXInput
 	var outputs []TXOutput
 	for _, vin := range tx.Vin {
-		inputs = append(inputs, TXInput{vin.Txid, vin.Vout, nil, nil})
+		inputs = append(inputs, TXInput{vin.Txid, vin.Vout, vin.Data, TXWitness{}})
 	}
 	for _, vout := range tx.Vout {
-		outputs = append(outputs, TXOutput{vout.Value, vout.PubKeyHash})
+		outputs = append(outputs, TXOutput{vout.Value, vout.PubKeyHash, vout.HTLC, vout.XOnlyPubKey})
 	}
-	txCopy := Transaction{tx.ID, inputs, outputs}
+	txCopy := Transaction{tx.ID, inputs, outputs, tx.LockTime}
 
 	return txCopy
 }
 
-// signs each input of `tx`
-func (tx *Transaction) Sign(privKey ecdsa.PrivateKey,
+// signs each input of `tx` by `wallet` with SIGHASH_ALL
+func (tx *Transaction) Sign(wallet Wallet,
 	prevTXs map[string]Transaction) {
 	if tx.IsCoinbase() {
 		return
 	}
-	txCopy := tx.TrimmedCopy()
-	for inID, vin := range txCopy.Vin {
-		prevTx := prevTXs[hex.EncodeToString(vin.Txid)] // previous transactions
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
-		txCopy.ID = txCopy.Hash()     //? SegWit: txid doesn't include signature
-		txCopy.Vin[inID].PubKey = nil // what does this mean?
-		// tutorial says "After getting the hash we should reset the PubKey
-		// field, so it doesn’t affect further iterations."
-
-		// Signing process
-		// 1. Empty Signature and PubKey filed in all TXInputs
-		// 2. Fill PubKey field in corresponding TXInput
-		// 3. Hash whole transaction
-		// 4. Sign the hash value
-		r, s, err := ecdsa.Sign(rand.Reader, &privKey, txCopy.ID)
-		logErr(err)
-		signature := append(r.Bytes(), s.Bytes()...)
-		tx.Vin[inID].Signature = signature
+	for inID := range tx.Vin {
+		tx.SignInput(inID, wallet, prevTXs, SigHashAll)
 	}
 }
 
+// signs input `inID` of `tx`, covering the parts of `tx` selected by
+// `hashType`. The hash type byte is appended to the signature.
+//
+// An output locked to an x-only public key is signed with Schnorr, others
+// with ECDSA.
+//
+// e.g. in a crowdfunding transaction each contributor adds an input and signs
+// it with SIGHASH_ALL|SIGHASH_ANYONECANPAY, so the signature stays valid when
+// others add their inputs but not if the outputs change.
+func (tx *Transaction) SignInput(inID int, wallet Wallet,
+	prevTXs map[string]Transaction, hashType byte) {
+	vin := tx.Vin[inID]
+	prevTx := prevTXs[hex.EncodeToString(vin.Txid)] // previous transactions
+
+	tx.signInput(inID, wallet, prevTx.Vout[vin.Vout], hashType)
+}
+
+// signs input `inID` of `tx`, which spends `prevOut`
+func (tx *Transaction) signInput(inID int, wallet Wallet, prevOut TXOutput, hashType byte) {
+	hash := tx.SignatureHash(inID, prevOut, hashType)
+	if hash == nil {
+		log.Panicf("ERROR: Can't sign input %d with hash type 0x%02x", inID, hashType)
+	}
+
+	var signature []byte
+	if prevOut.XOnlyPubKey != nil {
+		signature = wallet.SignSchnorr(hash)
+	} else {
+		signature = wallet.Sign(hash)
+	}
+	tx.Vin[inID].Witness.Signature = append(signature, hashType)
+}
+
 // check if Pubkey in `tx` TXInputs could verify
 // Signature in transaction TXOutputs from `prevTXs`
 // prevTXs structure: Transaction.ID->Transaction
 func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
+	batch := &schnorrBatch{}
+
+	return tx.verify(prevTXs, batch) && batch.Verify()
+}
+
+// same as Verify, but Schnorr signatures are added to `batch` rather than
+// verified, so that a whole block can verify them at once
+func (tx *Transaction) verify(prevTXs map[string]Transaction, batch *schnorrBatch) bool {
 	if tx.IsCoinbase() { // coinbase transaction don't need verification
 		return true
 	}
 
-	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
+	return tx.verifyInputs(tx.prevOutputs(prevTXs), batch)
+}
+
+// same as verify, but `prevOuts[i]` is the output which input i spends
+func (tx *Transaction) verifyInputs(prevOuts []TXOutput, batch *schnorrBatch) bool {
+	for _, out := range tx.Vout {
+		if out.Value < 0 { // it would let the other outputs exceed the inputs
+			return false
+		}
+	}
+	if tx.fee(prevOuts) < 0 { // outputs can't spend more than the inputs hold
+		return false
+	}
 
 	for inID, vin := range tx.Vin {
-		prevTx := prevTXs[hex.EncodeToString(vin.Txid)] // previous transactions
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Vin[inID].PubKey = nil
-
-		// signature (r, s) is a pair of numbers
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(vin.Signature)
-		r.SetBytes(vin.Signature[:(sigLen / 2)])
-		s.SetBytes(vin.Signature[(sigLen / 2):])
-
-		// public key (x, y) is a pair of coordinates
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(vin.PubKey)
-		x.SetBytes(vin.PubKey[:(keyLen / 2)])
-		y.SetBytes(vin.PubKey[(keyLen / 2):])
-
-		rawPubKey := ecdsa.PublicKey{curve, &x, &y}
-		if ecdsa.Verify(&rawPubKey, txCopy.ID, &r, &s) == false {
+		prevOut := prevOuts[inID]
+		witness := vin.Witness
+
+		if prevOut.HTLC != nil {
+			// HTLC output also requires the secret or an expired timeout
+			if prevOut.HTLC.IsUnlockedBy(&vin, tx.LockTime) == false {
+				return false
+			}
+		} else if prevOut.XOnlyPubKey == nil {
+			// the public key must be the one whose hash locks the output
+			if bytes.Compare(HashPubKey(witness.PubKey), prevOut.PubKeyHash) != 0 {
+				return false
+			}
+		}
+
+		// the last byte of the signature is the hash type
+		if len(witness.Signature) < 2 {
+			return false
+		}
+		sigLen := len(witness.Signature) - 1
+		hashType := witness.Signature[sigLen]
+		hash := tx.SignatureHash(inID, prevOut, hashType)
+		if hash == nil {
+			return false
+		}
+
+		if prevOut.XOnlyPubKey != nil {
+			// key-path spend: the output itself holds the public key
+			batch.Add(prevOut.XOnlyPubKey, hash, witness.Signature[:sigLen])
+		} else if verifySignature(witness.PubKey, hash, witness.Signature[:sigLen]) == false {
 			return false
 		}
 	}
 	return true
 }
 
-// create a new coinbase transaction
-func NewCoinbaseTX(to, data string) *Transaction {
+// return the fee of `tx`: the value of its inputs which its outputs don't
+// spend. prevTXs structure: Transaction.ID->Transaction
+func (tx *Transaction) Fee(prevTXs map[string]Transaction) int {
+	return tx.fee(tx.prevOutputs(prevTXs))
+}
+
+// same as Fee, but `prevOuts[i]` is the output which input i spends
+func (tx *Transaction) fee(prevOuts []TXOutput) int {
+	fee := 0
+
+	for _, prevOut := range prevOuts {
+		fee += prevOut.Value
+	}
+	for _, vout := range tx.Vout {
+		fee -= vout.Value
+	}
+
+	return fee
+}
+
+// return the outputs which the inputs of `tx` spend, in the order of the
+// inputs. prevTXs structure: Transaction.ID->Transaction
+func (tx *Transaction) prevOutputs(prevTXs map[string]Transaction) []TXOutput {
+	var prevOuts []TXOutput
+
+	for _, vin := range tx.Vin {
+		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
+		prevOuts = append(prevOuts, prevTx.Vout[vin.Vout])
+	}
+
+	return prevOuts
+}
+
+// create a new coinbase transaction, paying the block subsidy and `fees` of
+// the other transactions in the block
+func NewCoinbaseTX(to, data string, fees int) *Transaction {
 	if data == "" {
 		data = fmt.Sprintf("Reward to '%s'", to)
 	}
 
-	txin := TXInput{[]byte{}, -1, nil, []byte(data)} // coinbase have an empty TXInput
-	txout := NewTXOutput(subsidy, to)
-	tx := Transaction{nil, []TXInput{txin}, []TXOutput{*txout}}
+	txin := TXInput{[]byte{}, -1, []byte(data), TXWitness{}} // coinbase have an empty TXInput
+	txout := NewTXOutput(chainParams.Subsidy+fees, to)
+	tx := Transaction{nil, []TXInput{txin}, []TXOutput{*txout}, 0}
 	tx.ID = tx.Hash()
 
 	return &tx
 }
 
-// create a general transaction
-func NewUTXOTransaction(from, to string, amount int, UTXOSet *UTXOSet) *Transaction {
-	var inputs []TXInput
-	var outputs []TXOutput
+// Payment is an output paying `Amount` to `Address`
+type Payment struct {
+	Address string
+	Amount  int
+}
 
+// create a general transaction, paying the fee and picking the UTXOs of
+// `from` as `selection` says
+func NewUTXOTransaction(from, to string, amount int, selection CoinSelection, UTXOSet *UTXOSet) *Transaction {
+	return NewSendManyTransaction([]string{from}, []Payment{{to, amount}}, selection, UTXOSet)
+}
+
+// create a transaction making all `payments` at once, spending UTXOs of the
+// addresses `from` which are all in the wallet. The change goes to a new
+// change address of the account of the first address of `from`, or back to
+// that address if it's imported.
+func NewSendManyTransaction(from []string, payments []Payment, selection CoinSelection, UTXOSet *UTXOSet) *Transaction {
 	wallets, err := NewWallets() // load wallets
 	logErr(err)
-	wallet := wallets.GetWallet(from) // 1. load wallet by address `from`
-	pubKeyHash := HashPubKey(wallet.PublicKey)
-	// 2. find UTXO that address `from` can spend
-	acc, validOutputs := UTXOSet.FindSpendableOutputs(pubKeyHash, amount)
+	if wallets.IsLocked() {
+		log.Printf("ERROR: %s", errWalletLocked)
+		return nil
+	}
+	for _, addr := range from {
+		if wallet := wallets.Wallets[normalizeAddress(addr)]; wallet == nil {
+			log.Printf("ERROR: The wallet doesn't hold the key of '%s'", addr)
+			return nil
+		}
+	}
 
-	if acc < amount {
-		log.Print("ERROR: Not enough funds")
+	change := wallets.ChangeAddress(from[0])
+	tx := NewUnsignedTransaction(from, payments, change, wallets, selection, UTXOSet)
+	if tx == nil {
 		return nil
 	}
+	wallets.SignTransaction(tx, UTXOSet.Blockchain)
+	if change != from[0] && len(tx.Vout) > len(payments) {
+		wallets.SaveToFile() // keep the key of the change address
+	}
 
-	// 3. construct TXInputs
-	for txid, outs := range validOutputs {
-		txID, err := hex.DecodeString(txid) // decode UTXO's txid into []byte
-		logErr(err)
+	return tx
+}
+
+// create a transaction making `payments` from the addresses `from` without
+// signing it, so that a wallet holding only the addresses can prepare it for
+// another which holds the keys. The change goes to `change`. The inputs get
+// the public keys `ws` knows; the signer fills in the others.
+func NewUnsignedTransaction(from []string, payments []Payment, change string, ws *Wallets, selection CoinSelection, UTXOSet *UTXOSet) *Transaction {
+	var inputs []TXInput
+	var outputs []TXOutput
 
-		for _, out := range outs {
-			input := TXInput{txID, out, nil, wallet.PublicKey}
-			inputs = append(inputs, input)
+	amount := 0
+	for _, payment := range payments {
+		if payment.Amount <= 0 {
+			log.Print("ERROR: Amount must be positive")
+			return nil
 		}
+		amount += payment.Amount
+	}
+
+	// 1. find UTXOs of every address of `from`
+	var UTXOs []UTXO
+	owners := make(map[string]string) // txid:vout -> address
+	for _, addr := range from {
+		for _, utxo := range UTXOSet.FindUnspent(decodeAddress(addr)) {
+			outpoint := fmt.Sprintf("%x:%d", utxo.Txid, utxo.Vout)
+			if _, ok := owners[outpoint]; !ok {
+				owners[outpoint] = addr
+				UTXOs = append(UTXOs, utxo)
+			}
+		}
+	}
+
+	// 2. pick UTXOs covering `amount` and the fee
+	selected, changeAmount, err := SelectCoins(UTXOs, amount, len(payments), selection)
+	if err != nil {
+		log.Printf("ERROR: %s", err)
+		return nil
+	}
+
+	// 3. construct TXInputs
+	for _, utxo := range selected {
+		pubKey := ws.GetPubKey(owners[fmt.Sprintf("%x:%d", utxo.Txid, utxo.Vout)])
+		input := TXInput{utxo.Txid, utxo.Vout, nil, TXWitness{nil, pubKey, nil}}
+		inputs = append(inputs, input)
 	}
 
 	// 4. construct TXOutputs
-	outputs = append(outputs, *NewTXOutput(amount, to))
-	if acc > amount { // change（找零）
-		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+	for _, payment := range payments {
+		outputs = append(outputs, *NewTXOutput(payment.Amount, payment.Address))
+	}
+	if changeAmount > 0 { // change（找零）
+		outputs = append(outputs, *NewTXOutput(changeAmount, change))
 	}
 
-	tx := Transaction{nil, inputs, outputs}
+	tx := Transaction{nil, inputs, outputs, 0}
 	tx.ID = tx.Hash()
-	UTXOSet.Blockchain.SignTransaction(&tx, wallet.PrivateKey)
 
 	return &tx
-
 }
 
 // return a human-readable representation of a transaction
@@ -196,39 +368,52 @@ func (tx Transaction) String() string {
 
 	if tx.IsCoinbase() {
 		lines = append(lines, fmt.Sprintf("---   Coinbase  %x:", tx.ID))
-		lines = append(lines, fmt.Sprintf("       Data:    %s:", tx.Vin[0].PubKey))
+		lines = append(lines, fmt.Sprintf("       Data:    %s:", tx.Vin[0].Data))
 
 	} else {
 		lines = append(lines, fmt.Sprintf("--- Transaction %x:", tx.ID))
+		lines = append(lines, fmt.Sprintf("     WTXID: %x", tx.WitnessHash()))
 
 		for i, input := range tx.Vin {
 
 			lines = append(lines, fmt.Sprintf("     Input %d:", i))
 			lines = append(lines, fmt.Sprintf("       TXID:      %x", input.Txid))
 			lines = append(lines, fmt.Sprintf("       Out:       %d", input.Vout))
-			lines = append(lines, fmt.Sprintf("       Signature: %x", input.Signature))
-			lines = append(lines, fmt.Sprintf("       PubKey:    %x", input.PubKey))
+			lines = append(lines, fmt.Sprintf("       Signature: %x", input.Witness.Signature))
+			lines = append(lines, fmt.Sprintf("       PubKey:    %x", input.Witness.PubKey))
+			if len(input.Witness.Preimage) > 0 {
+				lines = append(lines, fmt.Sprintf("       Preimage:  %x", input.Witness.Preimage))
+			}
+		}
+		if tx.LockTime > 0 {
+			lines = append(lines, fmt.Sprintf("     LockTime: %d", tx.LockTime))
 		}
 	}
 
 	for i, output := range tx.Vout {
 		lines = append(lines, fmt.Sprintf("     Output %d:", i))
 		lines = append(lines, fmt.Sprintf("       Value:  %d", output.Value))
-		lines = append(lines, fmt.Sprintf("       Script: %x", output.PubKeyHash))
+		if output.XOnlyPubKey != nil {
+			lines = append(lines, fmt.Sprintf("       Key:    %x", output.XOnlyPubKey))
+		} else if output.HTLC != nil {
+			lines = append(lines, fmt.Sprintf("       HTLC:   hash %x", output.HTLC.Hash))
+			lines = append(lines, fmt.Sprintf("               recipient %x", output.HTLC.RecipientPubKeyHash))
+			lines = append(lines, fmt.Sprintf("               refund %x after height %d", output.HTLC.RefundPubKeyHash, output.HTLC.Timeout))
+		} else {
+			lines = append(lines, fmt.Sprintf("       Script: %x", output.PubKeyHash))
+		}
 	}
 
 	return strings.Join(lines, "\n")
 }
 
-// DeserializeTransaction deserializes a transaction
-func DeserializeTransaction(data []byte) Transaction {
+// DeserializeTransaction deserializes a transaction, or returns an error if
+// `data` is malformed
+func DeserializeTransaction(data []byte) (Transaction, error) {
 	var transaction Transaction
 
 	decoder := gob.NewDecoder(bytes.NewReader(data))
 	err := decoder.Decode(&transaction)
-	if err != nil {
-		log.Panic(err)
-	}
 
-	return transaction
+	return transaction, err
 }
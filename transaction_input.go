@@ -5,15 +5,15 @@ import (
 )
 
 type TXInput struct {
-	Txid      []byte // previous transaction id
-	Vout      int    // a vout sequence number in previous Txid transaction
-	Signature []byte // signature of transaction body
-	PubKey    []byte // ScriptSig
+	Txid    []byte    // previous transaction id
+	Vout    int       // a vout sequence number in previous Txid transaction
+	Data    []byte    // arbitrary data of a coinbase input, empty in other inputs
+	Witness TXWitness // unlocking data, not covered by the transaction ID
 }
 
 // checks if `pubKeyHash`(address) initial `in`
 func (in *TXInput) UseKey(pubKeyHash []byte) bool {
-	lockingHash := HashPubKey(in.PubKey)
+	lockingHash := HashPubKey(in.Witness.PubKey)
 
 	return bytes.Compare(lockingHash, pubKeyHash) == 0
 }
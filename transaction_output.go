@@ -3,35 +3,66 @@ package main
 import (
 	"bytes"
 	"encoding/gob"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
 )
 
 type TXOutput struct {
-	Value      int
-	PubKeyHash []byte
+	Value       int
+	PubKeyHash  []byte
+	HTLC        *HTLC  // non-nil if the output is locked by a HTLC instead of `PubKeyHash`
+	XOnlyPubKey []byte // non-nil if the output is locked to a Schnorr key instead of `PubKeyHash`
 }
 
 // Let `address` lock `output`
 func (out *TXOutput) Lock(address []byte) {
-	pubKeyHash := Base58Decode(address)
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	out.PubKeyHash = pubKeyHash
+	payload := decodeAddress(string(address))
+
+	if len(payload) == schnorr.PubKeyBytesLen {
+		out.XOnlyPubKey = payload
+	} else {
+		out.PubKeyHash = payload
+	}
+}
+
+// check if `key` (a public key hash or an x-only public key) could unlock `out`
+func (out *TXOutput) IsLockedWithKey(key []byte) bool {
+	if out.XOnlyPubKey != nil {
+		return bytes.Compare(out.XOnlyPubKey, key) == 0
+	}
+	return bytes.Compare(out.PubKeyHash, key) == 0
 }
 
-// check if `pubKeyHash` could unlock `out`
-func (out *TXOutput) IsLockedWithKey(pubKeyHash []byte) bool {
-	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
+// return the keys (public key hashes or an x-only public key) which can
+// unlock `out`. A HTLC output has two.
+func (out *TXOutput) LockingKeys() [][]byte {
+	switch {
+	case out.HTLC != nil:
+		return [][]byte{out.HTLC.RecipientPubKeyHash, out.HTLC.RefundPubKeyHash}
+	case out.XOnlyPubKey != nil:
+		return [][]byte{out.XOnlyPubKey}
+	}
+	return [][]byte{out.PubKeyHash}
 }
 
 // create a new TXOutput
 func NewTXOutput(value int, addr string) *TXOutput {
-	txo := &TXOutput{value, nil}
+	txo := &TXOutput{value, nil, nil, nil}
 	txo.Lock([]byte(addr))
 
 	return txo
 }
 
+// TXOutputs holds the unspent outputs of a transaction in the UTXO set
 type TXOutputs struct {
 	Outputs []TXOutput
+	Indexes []int // index of each output in its transaction
+}
+
+// add output `out` at index `outIdx` of its transaction
+func (outs *TXOutputs) Add(outIdx int, out TXOutput) {
+	outs.Outputs = append(outs.Outputs, out)
+	outs.Indexes = append(outs.Indexes, outIdx)
 }
 
 // serialize TXOutputs
@@ -53,5 +84,13 @@ func DeserializeOutputs(data []byte) TXOutputs {
 	err := dec.Decode(&outputs)
 	logErr(err)
 
+	// a UTXO set written before `Indexes` existed: this is right unless
+	// an earlier output of the transaction was spent, run Reindex then
+	if outputs.Indexes == nil {
+		for i := range outputs.Outputs {
+			outputs.Indexes = append(outputs.Indexes, i)
+		}
+	}
+
 	return outputs
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestVerifyPayToKeyHash(t *testing.T) {
+	owner := NewWallet(false)
+	prevTX := NewCoinbaseTX(string(owner.GetAddress()), "test", 0)
+	tx := newSpendingTX(prevTX, owner, owner)
+	prevTXs := map[string]Transaction{hex.EncodeToString(prevTX.ID): *prevTX}
+
+	if !tx.Verify(prevTXs) {
+		t.Error("the owner of an output can't spend it")
+	}
+}
+
+// an input signed with any key used to spend any pay-to-key-hash output
+func TestVerifyRejectsOtherKey(t *testing.T) {
+	owner, thief := NewWallet(false), NewWallet(false)
+	prevTX := NewCoinbaseTX(string(owner.GetAddress()), "test", 0)
+	tx := newSpendingTX(prevTX, thief, thief)
+	prevTXs := map[string]Transaction{hex.EncodeToString(prevTX.ID): *prevTX}
+
+	if tx.Verify(prevTXs) {
+		t.Error("an output was spent with a key which doesn't hash to its key hash")
+	}
+}
+
+func newTestTransaction() *Transaction {
+	in := TXInput{bytes.Repeat([]byte{1}, 32), 2, nil, TXWitness{[]byte{3}, []byte{4}, nil}}
+	out := TXOutput{50, bytes.Repeat([]byte{5}, 20), nil, nil}
+
+	return &Transaction{nil, []TXInput{in}, []TXOutput{out}, 7}
+}
+
+// the serialization hashed into the ID must not depend on what the process
+// encoded before, or nodes would disagree on transaction IDs
+func TestTransactionHashIsCanonical(t *testing.T) {
+	tx := newTestTransaction()
+	want := "d27db2bbfbb3804280f3211ea3c67dfd1251a40ea449e9adad6f89224f679931"
+
+	if got := hex.EncodeToString(tx.Hash()); got != want {
+		t.Errorf("Hash() = %s, want %s", got, want)
+	}
+}
+
+func TestHashExcludesWitness(t *testing.T) {
+	tx := newTestTransaction()
+	id, wtxid := tx.Hash(), tx.WitnessHash()
+	tx.Vin[0].Witness.Signature = []byte{6}
+
+	if !bytes.Equal(tx.Hash(), id) {
+		t.Error("the transaction ID changed with the witness")
+	}
+	if bytes.Equal(tx.WitnessHash(), wtxid) {
+		t.Error("the wtxid didn't change with the witness")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+// TXWitness holds the data which unlocks an output spent by a TXInput.
+//
+// Witness is left out of the transaction ID, so nobody can change the ID of a
+// transaction by tweaking its signatures (transaction malleability), and a
+// child transaction built before its parent is confirmed stays valid.
+type TXWitness struct {
+	Signature []byte // signature of transaction body
+	PubKey    []byte // public key of the signer
+	Preimage  []byte // secret revealed when claiming a HTLC output
+}
+
+// header of the coinbase output which commits to the witnesses of a block
+var witnessCommitmentHeader = []byte{0xaa, 0x21, 0xa9, 0xed}
+
+// serialize `tx` with its witnesses and hash it with SHA-256 algorithm.
+// The result is the wtxid of `tx`.
+func (tx *Transaction) WitnessHash() []byte {
+	var hash [32]byte
+
+	hash = sha256.Sum256(tx.SerializeForHash())
+
+	return hash[:]
+}
+
+// check if `out` is a witness commitment output
+func (out *TXOutput) IsWitnessCommitment() bool {
+	return out.Value == 0 && out.HTLC == nil && out.XOnlyPubKey == nil &&
+		len(out.PubKeyHash) == len(witnessCommitmentHeader)+sha256.Size &&
+		bytes.HasPrefix(out.PubKeyHash, witnessCommitmentHeader)
+}
+
+// return the witness merkle root committed in coinbase `tx`, or nil if there
+// isn't one
+func (tx *Transaction) WitnessCommitment() []byte {
+	for _, out := range tx.Vout {
+		if out.IsWitnessCommitment() {
+			return out.PubKeyHash[len(witnessCommitmentHeader):]
+		}
+	}
+	return nil
+}
+
+// put `witnessRoot` into coinbase `tx` as an unspendable zero-value output,
+// replacing any previous commitment, and update the transaction ID
+func (tx *Transaction) SetWitnessCommitment(witnessRoot []byte) {
+	var outputs []TXOutput
+
+	for _, out := range tx.Vout {
+		if !out.IsWitnessCommitment() {
+			outputs = append(outputs, out)
+		}
+	}
+	commitment := append(append([]byte{}, witnessCommitmentHeader...), witnessRoot...)
+	tx.Vout = append(outputs, TXOutput{0, commitment, nil, nil})
+	tx.ID = tx.Hash()
+}
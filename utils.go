@@ -3,7 +3,10 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
 )
 
 func logErr(err error) {
@@ -26,3 +29,25 @@ func ReverseBytes(data []byte) {
 		data[i], data[j] = data[j], data[i]
 	}
 }
+
+// write `data` to file `path`, readable only by its owner. It's written to a
+// new temporary file renamed over `path`, so the file is never half written,
+// and an existing file readable by others is replaced rather than rewritten
+// with its old permissions.
+func writePrivateFile(path string, data []byte) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp*") // mode 0600
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// an existing file readable by others becomes readable only by its owner
+func TestWritePrivateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wallet.dat")
+	if err := ioutil.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writePrivateFile(path, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("mode is %o", mode)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "new" {
+		t.Errorf("content is %q", data)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Dir(path)); len(files) != 1 {
+		t.Errorf("%d files are left", len(files))
+	}
+}
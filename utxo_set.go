@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/hex"
+	"errors"
 	"log"
 
 	"github.com/boltdb/bolt"
@@ -32,10 +33,10 @@ func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[s
 			txID := hex.EncodeToString(k)
 			outs := DeserializeOutputs(v)
 
-			for outIdx, out := range outs.Outputs {
+			for i, out := range outs.Outputs {
 				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
 					accumulated += out.Value
-					unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
+					unspentOutputs[txID] = append(unspentOutputs[txID], outs.Indexes[i])
 				}
 			}
 		}
@@ -72,6 +73,134 @@ func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 	return UTXOs
 }
 
+// UTXO is an unspent output together with the output point which spends it
+type UTXO struct {
+	Txid   []byte
+	Vout   int
+	Output TXOutput
+}
+
+// return the sum of the UTXOs of `addr`
+func (u UTXOSet) Balance(addr string) int {
+	balance := 0
+
+	for _, out := range u.FindUTXO(decodeAddress(addr)) {
+		balance += out.Value
+	}
+	return balance
+}
+
+// find all UTXOs that `key` (a public key hash or an x-only public key) could
+// spend, with their output points
+func (u UTXOSet) FindUnspent(key []byte) []UTXO {
+	var UTXOs []UTXO
+	db := u.Blockchain.db
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			outs := DeserializeOutputs(v)
+
+			for i, out := range outs.Outputs {
+				if out.IsLockedWithKey(key) {
+					txID := append([]byte{}, k...) // `k` is only valid in the transaction
+					UTXOs = append(UTXOs, UTXO{txID, outs.Indexes[i], out})
+				}
+			}
+		}
+
+		return nil
+	})
+	logErr(err)
+
+	return UTXOs
+}
+
+// return the hex-encoded keys (public key hashes and x-only public keys) which
+// lock at least one UTXO
+func (u UTXOSet) FindLockingKeys() map[string]bool {
+	keys := make(map[string]bool)
+	db := u.Blockchain.db
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			outs := DeserializeOutputs(v)
+
+			for _, out := range outs.Outputs {
+				for _, key := range out.LockingKeys() {
+					keys[hex.EncodeToString(key)] = true
+				}
+			}
+		}
+
+		return nil
+	})
+	logErr(err)
+
+	return keys
+}
+
+// check if output `vout` of transaction `txID` is in the UTXO set
+func (u UTXOSet) IsUnspent(txID []byte, vout int) bool {
+	unspent := false
+	db := u.Blockchain.db
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		outsBytes := b.Get(txID)
+		if outsBytes == nil {
+			return nil
+		}
+
+		for _, outIdx := range DeserializeOutputs(outsBytes).Indexes {
+			if outIdx == vout {
+				unspent = true
+			}
+		}
+		return nil
+	})
+	logErr(err)
+
+	return unspent
+}
+
+// find the unspent HTLC output of transaction `txID`
+//
+// returns: (index of the output in the transaction, output)
+func (u UTXOSet) FindHTLC(txID []byte) (int, TXOutput, error) {
+	var htlcIdx int
+	var htlcOut *TXOutput
+	db := u.Blockchain.db
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		outsBytes := b.Get(txID)
+		if outsBytes == nil {
+			return nil
+		}
+
+		outs := DeserializeOutputs(outsBytes)
+		for i, out := range outs.Outputs {
+			if out.HTLC != nil {
+				htlcIdx = outs.Indexes[i]
+				htlcOut = &outs.Outputs[i]
+			}
+		}
+		return nil
+	})
+	logErr(err)
+
+	if htlcOut == nil {
+		return 0, TXOutput{}, errors.New("HTLC is not found or already spent")
+	}
+	return htlcIdx, *htlcOut, nil
+}
+
 // return the number of transaction in UTXO set from database
 func (u UTXOSet) CountTransactions() int {
 	db := u.Blockchain.db
@@ -93,7 +222,7 @@ func (u UTXOSet) CountTransactions() int {
 }
 
 // Rebuild UTXO database: clear UTXO database and build a new one in which
-// UTXOs in blockchain (memory) are saved
+// UTXOs in blockchain (memory) are saved. The address index is rebuilt too.
 func (u UTXOSet) Reindex() {
 	db := u.Blockchain.db
 	bucketName := []byte(utxoBucket)
@@ -126,9 +255,13 @@ func (u UTXOSet) Reindex() {
 
 		return nil
 	})
+	logErr(err)
+
+	AddressIndex{u.Blockchain}.Reindex()
 }
 
-// update UTXO set into database from latest block
+// update UTXO set into database from latest block, and add its transactions
+// to the address index
 // `block` should be the latest block
 func (u UTXOSet) Update(block *Block) {
 	db := u.Blockchain.db
@@ -143,12 +276,13 @@ func (u UTXOSet) Update(block *Block) {
 					outsBytes := b.Get(vin.Txid)          // find UTXOs of transaction whose ID is referenced in `vin` from database
 					outs := DeserializeOutputs(outsBytes) // `outs`: tTxID->[no1, no2, ...]. Here tx
 
-					for outIdx, out := range outs.Outputs { // `outIdx` is index of output `out` in transaction which referenced in `vin`
+					for i, out := range outs.Outputs {
+						outIdx := outs.Indexes[i] // `outIdx` is index of output `out` in transaction which referenced in `vin`
 						if outIdx != vin.Vout {
 							// `outIdx`==vin.Vout means that output `out` has
 							// been spent, and we don't add it into updated UTXO
 							// set
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
+							updatedOuts.Add(outIdx, out)
 						}
 					}
 
@@ -168,15 +302,22 @@ func (u UTXOSet) Update(block *Block) {
 			// In latest block `block`, all outputs in each transactions are
 			// UTXOs.
 			newOutputs := TXOutputs{}
-			for _, out := range tx.Vout {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
+			for outIdx, out := range tx.Vout {
+				if !out.IsWitnessCommitment() { // it can't be spent
+					newOutputs.Add(outIdx, out)
+				}
 			}
 
-			err := b.Put(tx.ID, newOutputs.Serialize())
-			logErr(err)
+			if len(newOutputs.Outputs) > 0 {
+				err := b.Put(tx.ID, newOutputs.Serialize())
+				logErr(err)
+			}
 		}
 
 		return nil
 	})
 	logErr(err)
+
+	AddressIndex{u.Blockchain}.Update(block)
+	Mempool{u.Blockchain}.Update(block)
 }
@@ -2,46 +2,65 @@ package main
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
 	"crypto/sha256"
+	"errors"
 
+	"github.com/btcsuite/btcd/btcec/v2"
 	"golang.org/x/crypto/ripemd160"
 )
 
 const (
 	addressChecksumLen = 4
-	prefix             = byte(0x00)
+	wifCompressed      = byte(0x01) // WIF suffix: the public key is compressed
 )
 
 type Wallet struct {
-	PrivateKey ecdsa.PrivateKey
-	PublicKey  []byte
+	PrivateKey []byte // 32-byte secp256k1 private key
+	PublicKey  []byte // 33-byte compressed public key
+	Schnorr    bool   // coins are locked to the x-only public key instead of its hash
+	Bech32     bool   // the address is encoded in bech32 (bech32m for Schnorr) instead of Base58Check
+	Path       string // BIP32 derivation path from the wallet seed, empty for a random or imported key
 }
 
-func NewWallet() *Wallet {
+func NewWallet(schnorr bool) *Wallet {
 	private, public := newKeyPair()
-	wallet := Wallet{private, public}
+	wallet := Wallet{private, public, schnorr, false, ""}
 
 	return &wallet
 }
 
 // returns wallet address
 //
-// address = base58encode(v +  checksum(v)), v = prefix + pubKeyHash
+// address = base58encode(v +  checksum(v)), v = network prefix + pubKeyHash
+//
+// or, for a bech32 wallet, hrp + "1" + base32(version + pubKeyHash) + checksum
 //
 // see https://jeiwan.cc/posts/building-blockchain-in-go-part-5/
 func (w Wallet) GetAddress() []byte {
-	pubKeyHash := HashPubKey(w.PublicKey)
+	if w.Bech32 {
+		return []byte(encodeBech32Address(w.LockingKey()))
+	}
+	return []byte(encodeAddress(w.LockingKey()))
+}
 
-	versionedPayload := append([]byte{prefix}, pubKeyHash...)
+// return what outputs paid to the wallet are locked with: the public key
+// hash, or the x-only public key for a Schnorr wallet
+func (w Wallet) LockingKey() []byte {
+	if w.Schnorr {
+		return w.XOnlyPubKey()
+	}
+	return HashPubKey(w.PublicKey)
+}
+
+// encode `payload` (a public key hash, or an x-only public key) into an address
+func encodeAddress(payload []byte) string {
+	versionedPayload := append([]byte{chainParams.AddressPrefix}, payload...)
 	checksum := checksum(versionedPayload)
 
 	fullPayload := append(versionedPayload, checksum...)
 	address := Base58Encode(fullPayload)
 
-	return address
+	return string(address)
 }
 
 // hash public key
@@ -55,13 +74,69 @@ func HashPubKey(pubKey []byte) []byte {
 
 	return publicRIPEMD160
 }
-func newKeyPair() (ecdsa.PrivateKey, []byte) {
-	curve := elliptic.P256()
-	private, err := ecdsa.GenerateKey(curve, rand.Reader)
+
+// generate a secp256k1 key pair, the same curve as Bitcoin
+//
+// returns: (32-byte private key, 33-byte compressed public key)
+//
+// A compressed public key is the X coordinate prefixed by 0x02 or 0x03,
+// telling whether Y is even or odd. Y can be computed from X and the curve.
+func newKeyPair() ([]byte, []byte) {
+	private, err := btcec.NewPrivateKey()
 	logErr(err)
-	pubKey := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	pubKey := private.PubKey().SerializeCompressed()
+
+	return private.Serialize(), pubKey
+}
+
+// encode the private key in Wallet Import Format
+//
+// WIF = base58encode(v + checksum(v)), v = 0x80 + private key + 0x01
+func (w Wallet) WIF() string {
+	versionedPayload := append([]byte{chainParams.WIFPrefix}, w.PrivateKey...)
+	versionedPayload = append(versionedPayload, wifCompressed)
+	checksum := checksum(versionedPayload)
+
+	fullPayload := append(versionedPayload, checksum...)
+	return string(Base58Encode(fullPayload))
+}
 
-	return *private, pubKey
+// decode a private key in Wallet Import Format for a compressed public key
+func DecodeWIF(wif string) ([]byte, error) {
+	payload := Base58Decode([]byte(wif))
+	if len(payload) != 1+32+1+addressChecksumLen {
+		return nil, errors.New("WIF has a wrong length, only keys of compressed public keys are supported")
+	}
+
+	versionedPayload := payload[:len(payload)-addressChecksumLen]
+	if !bytes.Equal(payload[len(versionedPayload):], checksum(versionedPayload)) {
+		return nil, errors.New("WIF checksum is wrong")
+	}
+	if versionedPayload[0] != chainParams.WIFPrefix || versionedPayload[33] != wifCompressed {
+		return nil, errors.New("WIF is not a private key of a compressed public key")
+	}
+
+	private := versionedPayload[1:33]
+	var key btcec.ModNScalar
+	if overflow := key.SetByteSlice(private); overflow || key.IsZero() {
+		return nil, errors.New("WIF private key is out of range")
+	}
+
+	return private, nil
+}
+
+// return the payload of `address`, in Base58Check or bech32: a public key
+// hash, or an x-only public key
+func decodeAddress(address string) []byte {
+	if isBech32Address(address) {
+		payload, err := decodeBech32Address(address)
+		logErr(err)
+		return payload
+	}
+
+	payload := Base58Decode([]byte(address))
+
+	return payload[1 : len(payload)-addressChecksumLen]
 }
 
 // generate a checksum for a public key
@@ -74,11 +149,19 @@ func checksum(payload []byte) []byte {
 
 // ValidateAddress check if address if valid
 func ValidateAddress(address string) bool {
+	if isBech32Address(address) {
+		_, err := decodeBech32Address(address)
+		return err == nil
+	}
+
 	pubKeyHash := Base58Decode([]byte(address))
+	if len(pubKeyHash) <= 1+addressChecksumLen {
+		return false
+	}
 	actualChecksum := pubKeyHash[len(pubKeyHash)-addressChecksumLen:]
 	version := pubKeyHash[0]
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-addressChecksumLen]
 	targetChecksum := checksum(append([]byte{version}, pubKeyHash...))
 
-	return bytes.Compare(actualChecksum, targetChecksum) == 0
+	return version == chainParams.AddressPrefix && bytes.Compare(actualChecksum, targetChecksum) == 0
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultAccount   = "default" // account 0, which every HD wallet has
+	importedAccount  = "imported"
+	watchOnlyAccount = "watch-only"
+)
+
+// add account `name` at the next BIP44 account index
+func (ws *Wallets) CreateAccount(name string) (uint32, error) {
+	if _, err := ws.AccountIndex(name); err == nil || name == importedAccount || name == watchOnlyAccount {
+		return 0, fmt.Errorf("account %q already exists", name)
+	}
+
+	index := uint32(0)
+	for _, i := range ws.accountIndexes() {
+		if i >= index {
+			index = i + 1
+		}
+	}
+	if index >= HardenedKeyStart {
+		return 0, errors.New("no account index left")
+	}
+
+	ws.Accounts[name] = index
+	return index, nil
+}
+
+// return the BIP44 account index of account `name`
+func (ws *Wallets) AccountIndex(name string) (uint32, error) {
+	if name == defaultAccount {
+		return 0, nil
+	}
+	if index, ok := ws.Accounts[name]; ok {
+		return index, nil
+	}
+	return 0, fmt.Errorf("account %q doesn't exist, create it with createaccount", name)
+}
+
+// return the BIP44 index of every account, named or holding a key, in
+// ascending order
+func (ws *Wallets) accountIndexes() []uint32 {
+	seen := map[uint32]bool{0: true}
+	for _, index := range ws.Accounts {
+		seen[index] = true
+	}
+	for _, wallet := range ws.Wallets {
+		if index, ok := pathAccount(wallet.Path); ok {
+			seen[index] = true
+		}
+	}
+
+	var indexes []uint32
+	for index := range seen {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	return indexes
+}
+
+// return the name of the account which `addr` belongs to. A key which isn't
+// derived from the seed is in the "imported" account, and a watched address
+// in the "watch-only" account.
+func (ws *Wallets) AddressAccount(addr string) string {
+	addr = normalizeAddress(addr)
+	if ws.WatchOnly[addr] != nil {
+		return watchOnlyAccount
+	}
+	wallet := ws.Wallets[addr]
+	if wallet == nil {
+		return ""
+	}
+	index, ok := pathAccount(wallet.Path)
+	if !ok {
+		return importedAccount
+	}
+
+	return ws.accountName(index)
+}
+
+// return the name of account `index`
+func (ws *Wallets) accountName(index uint32) string {
+	if index == 0 {
+		return defaultAccount
+	}
+	for name, i := range ws.Accounts {
+		if i == index {
+			return name
+		}
+	}
+	return fmt.Sprintf("account %d", index) // found by Scan, its name isn't known
+}
+
+// return the account index of BIP44 or BIP86 derivation path `path`
+func pathAccount(path string) (uint32, bool) {
+	parts := strings.Split(path, "/")
+	if len(parts) != 6 || !strings.HasSuffix(parts[3], "'") {
+		return 0, false
+	}
+	index, err := strconv.ParseUint(strings.TrimSuffix(parts[3], "'"), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+
+	return uint32(index), true
+}
+
+// return the address which the change of a transaction spending from `addr`
+// goes to: a new address of the change chain of its account, in the same
+// format, or `addr` itself if it isn't derived from the seed
+func (ws *Wallets) ChangeAddress(addr string) string {
+	addr = normalizeAddress(addr)
+	wallet := ws.Wallets[addr]
+	if wallet == nil || ws.Seed == nil {
+		return addr
+	}
+	account, ok := pathAccount(wallet.Path)
+	if !ok {
+		return addr
+	}
+
+	chain := changeChain(account, wallet.Schnorr)
+	change := ws.deriveWallet(chain, ws.NextIndex[chain], wallet.Schnorr)
+	change.Bech32 = wallet.Bech32
+	ws.NextIndex[chain]++
+	changeAddr := fmt.Sprintf("%s", change.GetAddress())
+
+	ws.Wallets[changeAddr] = change
+	return changeAddr
+}
+
+// label `addr`, which must be in the wallet. An empty label removes it.
+func (ws *Wallets) SetLabel(addr, label string) error {
+	addr = normalizeAddress(addr)
+	if ws.Wallets[addr] == nil && ws.WatchOnly[addr] == nil {
+		return errors.New("the address is not in the wallet")
+	}
+
+	if label == "" {
+		delete(ws.Labels, addr)
+	} else {
+		ws.Labels[addr] = label
+	}
+	return nil
+}
+
+// AccountAddresses is an account and its addresses
+type AccountAddresses struct {
+	Name      string
+	Addresses []string
+}
+
+// return the addresses of `ws` grouped by account: the default account, the
+// other accounts by index, then the imported and watch-only addresses. The
+// addresses of an account are sorted.
+func (ws *Wallets) GroupByAccount() []AccountAddresses {
+	groups := make(map[string][]string)
+	for addr := range ws.Wallets {
+		account := ws.AddressAccount(addr)
+		groups[account] = append(groups[account], addr)
+	}
+	for addr := range ws.WatchOnly {
+		groups[watchOnlyAccount] = append(groups[watchOnlyAccount], addr)
+	}
+
+	var names []string
+	for _, index := range ws.accountIndexes() {
+		names = append(names, ws.accountName(index))
+	}
+	names = append(names, importedAccount, watchOnlyAccount)
+
+	var accounts []AccountAddresses
+	for _, name := range names {
+		addresses := groups[name]
+		if len(addresses) == 0 && (name == importedAccount || name == watchOnlyAccount) {
+			continue
+		}
+		sort.Strings(addresses)
+		accounts = append(accounts, AccountAddresses{name, addresses})
+	}
+
+	return accounts
+}
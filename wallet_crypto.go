@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// walletpassphrase keeps the wallet key in this file until it expires,
+	// so that the following commands can sign
+	unlockFile = "wallet.unlock"
+
+	walletKeyLen  = 32 // AES-256
+	walletSaltLen = 16
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+)
+
+var errWalletLocked = errors.New("wallet is locked, unlock it with walletpassphrase")
+
+// WalletEncryption holds the encrypted secrets of a wallet file. The key is
+// derived from the passphrase with scrypt.
+type WalletEncryption struct {
+	Salt    []byte
+	N, R, P int // scrypt parameters
+	Nonce   []byte
+	Secrets []byte // walletSecrets sealed with AES-256-GCM
+}
+
+// the parts of Wallets which are encrypted. Addresses and public keys stay in
+// plaintext, so balances can be read while the wallet is locked.
+type walletSecrets struct {
+	Seed        []byte
+	Mnemonic    string
+	PrivateKeys map[string][]byte // address -> private key
+}
+
+// unlock session written by walletpassphrase
+type walletUnlock struct {
+	Key    []byte
+	Expiry int64 // unix time
+}
+
+// check if the wallet is encrypted and its secrets aren't available
+func (ws *Wallets) IsLocked() bool {
+	return ws.Encryption != nil && ws.key == nil
+}
+
+// encrypt the secrets of `ws` with `passphrase` when it's saved
+func (ws *Wallets) Encrypt(passphrase string) error {
+	if ws.Encryption != nil {
+		return errors.New("wallet is already encrypted")
+	}
+
+	salt := make([]byte, walletSaltLen)
+	_, err := rand.Read(salt)
+	logErr(err)
+
+	encryption := &WalletEncryption{salt, scryptN, scryptR, scryptP, nil, nil}
+	ws.key = encryption.deriveKey(passphrase)
+	ws.Encryption = encryption
+
+	return nil
+}
+
+// decrypt the secrets of `ws` with `passphrase`
+func (ws *Wallets) Unlock(passphrase string) error {
+	if ws.Encryption == nil {
+		return errors.New("wallet is not encrypted")
+	}
+
+	return ws.unlockWithKey(ws.Encryption.deriveKey(passphrase))
+}
+
+// decrypt the secrets of `ws` with the derived `key`
+func (ws *Wallets) unlockWithKey(key []byte) error {
+	plaintext, err := newWalletCipher(key).Open(nil, ws.Encryption.Nonce, ws.Encryption.Secrets, nil)
+	if err != nil {
+		return errors.New("passphrase is incorrect")
+	}
+
+	var secrets walletSecrets
+	decoder := gob.NewDecoder(bytes.NewReader(plaintext))
+	err = decoder.Decode(&secrets)
+	logErr(err)
+
+	ws.Seed = secrets.Seed
+	ws.Mnemonic = secrets.Mnemonic
+	for addr, wallet := range ws.Wallets {
+		wallet.PrivateKey = secrets.PrivateKeys[addr]
+	}
+	ws.key = key
+
+	return nil
+}
+
+// encrypt the current secrets of `ws` into `ws.Encryption`
+func (ws *Wallets) seal() {
+	secrets := walletSecrets{ws.Seed, ws.Mnemonic, make(map[string][]byte)}
+	for addr, wallet := range ws.Wallets {
+		secrets.PrivateKeys[addr] = wallet.PrivateKey
+	}
+
+	var plaintext bytes.Buffer
+	encoder := gob.NewEncoder(&plaintext)
+	err := encoder.Encode(secrets)
+	logErr(err)
+
+	aead := newWalletCipher(ws.key)
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	logErr(err)
+
+	ws.Encryption.Nonce = nonce
+	ws.Encryption.Secrets = aead.Seal(nil, nonce, plaintext.Bytes(), nil)
+}
+
+// return a copy of `ws` without the secrets, which is what an encrypted
+// wallet file stores in plaintext
+func (ws Wallets) withoutSecrets() Wallets {
+	public := ws
+	public.Seed = nil
+	public.Mnemonic = ""
+	public.Wallets = make(map[string]*Wallet)
+
+	for addr, wallet := range ws.Wallets {
+		w := *wallet
+		w.PrivateKey = nil
+		public.Wallets[addr] = &w
+	}
+
+	return public
+}
+
+// derive the wallet key from `passphrase`
+func (e *WalletEncryption) deriveKey(passphrase string) []byte {
+	key, err := scrypt.Key([]byte(passphrase), e.Salt, e.N, e.R, e.P, walletKeyLen)
+	logErr(err)
+
+	return key
+}
+
+func newWalletCipher(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	logErr(err)
+	aead, err := cipher.NewGCM(block)
+	logErr(err)
+
+	return aead
+}
+
+// keep the key of the unlocked `ws` in the unlock file for `seconds`
+func (ws *Wallets) writeUnlockFile(seconds int) {
+	var content bytes.Buffer
+
+	unlock := walletUnlock{ws.key, time.Now().Unix() + int64(seconds)}
+	encoder := gob.NewEncoder(&content)
+	err := encoder.Encode(unlock)
+	logErr(err)
+
+	ensureDataDir()
+	err = writePrivateFile(dataFile(unlockFile), content.Bytes())
+	logErr(err)
+}
+
+// return the key from the unlock file, or nil if there is none. An expired
+// file is removed.
+func readUnlockFile() []byte {
+	content, err := ioutil.ReadFile(dataFile(unlockFile))
+	if err != nil {
+		return nil
+	}
+
+	var unlock walletUnlock
+	decoder := gob.NewDecoder(bytes.NewReader(content))
+	err = decoder.Decode(&unlock)
+	if err != nil || len(unlock.Key) != walletKeyLen || time.Now().Unix() >= unlock.Expiry {
+		removeUnlockFile()
+		return nil
+	}
+
+	return unlock.Key
+}
+
+// lock the wallet for the following commands
+func removeUnlockFile() {
+	err := os.Remove(dataFile(unlockFile))
+	if err != nil && !os.IsNotExist(err) {
+		logErr(err)
+	}
+}
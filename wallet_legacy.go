@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/gob"
+	"math/big"
+)
+
+// legacyWallet is the wallet format before secp256k1: a P256 key pair whose
+// public key is X.Bytes() + Y.Bytes()
+type legacyWallet struct {
+	PrivateKey ecdsa.PrivateKey
+	PublicKey  []byte
+}
+
+type legacyWallets struct {
+	Wallets map[string]*legacyWallet
+}
+
+// legacyP256Curve decodes the curve which older Go versions wrote into the
+// gob-encoded ecdsa keys. Newer versions can't gob-encode the curve at all.
+type legacyP256Curve struct {
+	*elliptic.CurveParams
+}
+
+func init() {
+	gob.RegisterName("crypto/elliptic.p256Curve", legacyP256Curve{})
+}
+
+// decode a P256 wallet file and convert its keys into the current format.
+// The keys keep their addresses, so coins received by them stay spendable.
+func migrateLegacyWallets(fileContent []byte) (map[string]*Wallet, error) {
+	var legacy legacyWallets
+
+	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
+	err := decoder.Decode(&legacy)
+	if err != nil {
+		return nil, err
+	}
+
+	wallets := make(map[string]*Wallet)
+	for addr, lw := range legacy.Wallets {
+		privKey := lw.PrivateKey.D.FillBytes(make([]byte, 32))
+		wallets[addr] = &Wallet{privKey, lw.PublicKey, false, false, ""}
+	}
+
+	return wallets, nil
+}
+
+// sign `hash` with a P256 private key, returning a DER-encoded signature
+func signLegacy(privKey, hash []byte) []byte {
+	curve := elliptic.P256()
+	key := ecdsa.PrivateKey{}
+	key.Curve = curve
+	key.D = new(big.Int).SetBytes(privKey)
+	key.X, key.Y = curve.ScalarBaseMult(privKey)
+
+	signature, err := ecdsa.SignASN1(rand.Reader, &key, hash)
+	logErr(err)
+
+	return signature
+}
+
+// check a DER-encoded signature made by a P256 key
+func verifyLegacy(pubKey, hash, signature []byte) bool {
+	key := parseLegacyPubKey(pubKey)
+	if key == nil {
+		return false
+	}
+
+	return ecdsa.VerifyASN1(key, hash, signature)
+}
+
+// split X.Bytes() + Y.Bytes() back into a P256 public key. X or Y is shorter
+// than 32 bytes when it has leading zeros, so try every split point which
+// gives a point on the curve.
+func parseLegacyPubKey(pubKey []byte) *ecdsa.PublicKey {
+	curve := elliptic.P256()
+	splits := []int{len(pubKey) / 2}
+	for i := 1; i < len(pubKey); i++ {
+		splits = append(splits, i)
+	}
+
+	for _, i := range splits {
+		x := new(big.Int).SetBytes(pubKey[:i])
+		y := new(big.Int).SetBytes(pubKey[i:])
+		if curve.IsOnCurve(x, y) {
+			return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// WatchOnly is an address tracked without its private key: its balance and
+// UTXOs can be listed, and unsigned transactions spending from it built.
+type WatchOnly struct {
+	PubKey []byte // compressed public key, nil if imported as an address
+	XPub   string // extended public key the address is derived from, empty if imported as an address
+	Path   string // derivation path below `XPub`, e.g. "m/0/5"
+}
+
+// add watch-only `addr`
+func (ws *Wallets) ImportAddress(addr string) error {
+	addr = normalizeAddress(addr)
+	if ws.Wallets[addr] != nil {
+		return errors.New("the wallet already holds the key of this address")
+	}
+	if ws.WatchOnly[addr] != nil {
+		return errors.New("the address is already watched")
+	}
+
+	ws.WatchOnly[addr] = &WatchOnly{nil, "", ""}
+	return nil
+}
+
+// add extended public key `xpub` of an account, and watch its receiving and
+// change addresses up to `gapLimit` unused addresses after the last one
+// found in `usedKeys`. With `schnorr` the addresses are x-only public keys.
+//
+// returns the number of addresses added
+func (ws *Wallets) ImportXPub(xpub string, schnorr bool, usedKeys map[string]bool) (int, error) {
+	key, err := ParseExtendedKey(xpub)
+	if err != nil {
+		return 0, err
+	}
+	if key.Private {
+		return 0, errors.New("give the extended public key, a watch-only wallet holds no private keys")
+	}
+	if _, ok := ws.XPubs[xpub]; ok {
+		return 0, errors.New("the extended public key is already watched")
+	}
+
+	ws.XPubs[xpub] = schnorr
+	return ws.scanXPub(xpub, usedKeys), nil
+}
+
+// derive the receiving and change addresses of watched `xpub` until
+// `gapLimit` addresses in a row are unused, and watch all of them, so that
+// payments to the next unused addresses are seen too
+//
+// returns the number of addresses added
+func (ws *Wallets) scanXPub(xpub string, usedKeys map[string]bool) int {
+	key, err := ParseExtendedKey(xpub)
+	logErr(err)
+	schnorr := ws.XPubs[xpub]
+	found := 0
+
+	for _, chain := range []uint32{0, 1} {
+		chainKey, err := key.Child(chain)
+		logErr(err)
+		unused := 0
+
+		for i := uint32(0); unused < gapLimit; i++ {
+			child, err := chainKey.Child(i)
+			if err == errInvalidChild {
+				continue
+			}
+			logErr(err)
+
+			wallet := Wallet{nil, child.Key, schnorr, false, ""}
+			if usedKeys[hex.EncodeToString(wallet.LockingKey())] {
+				unused = 0
+			} else {
+				unused++
+			}
+
+			addr := fmt.Sprintf("%s", wallet.GetAddress())
+			if ws.Wallets[addr] == nil && ws.WatchOnly[addr] == nil {
+				path := fmt.Sprintf("m/%d/%d", chain, i)
+				ws.WatchOnly[addr] = &WatchOnly{child.Key, xpub, path}
+				found++
+			}
+		}
+	}
+
+	return found
+}
+
+// return the public key of `addr` if the wallet knows it, with or without
+// the private key
+func (ws *Wallets) GetPubKey(addr string) []byte {
+	addr = normalizeAddress(addr)
+	if wallet := ws.Wallets[addr]; wallet != nil {
+		return wallet.PublicKey
+	}
+	if watched := ws.WatchOnly[addr]; watched != nil {
+		return watched.PubKey
+	}
+	return nil
+}
+
+// sign the inputs of `tx` whose keys are in `ws`, filling in their public
+// keys. An input whose key is missing is left as it is.
+//
+// returns the number of inputs signed
+func (ws *Wallets) SignTransaction(tx *Transaction, bc *Blockchain) int {
+	signed := 0
+
+	for inID, vin := range tx.Vin {
+		prevTx, err := bc.FindTransaction(vin.Txid)
+		if err != nil || vin.Vout < 0 || vin.Vout >= len(prevTx.Vout) {
+			continue
+		}
+		prevOut := prevTx.Vout[vin.Vout]
+		if prevOut.HTLC != nil {
+			continue
+		}
+
+		for _, wallet := range ws.Wallets {
+			if wallet.PrivateKey != nil && prevOut.IsLockedWithKey(wallet.LockingKey()) {
+				tx.Vin[inID].Witness.PubKey = wallet.PublicKey
+				bc.SignTransactionInput(tx, inID, *wallet, SigHashAll)
+				signed++
+				break
+			}
+		}
+	}
+
+	return signed
+}
@@ -2,33 +2,118 @@ package main
 
 import (
 	"bytes"
-	"crypto/elliptic"
+	"crypto/rand"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
 )
 
+// Wallets holds the keys of the wallet file. Keys are derived from `Seed`
+// (BIP32), so a backup of the seed is enough to recover every address.
 type Wallets struct {
-	Wallets map[string]*Wallet
+	Wallets   map[string]*Wallet
+	Seed      []byte            // nil for a wallet file written before HD wallets
+	NextIndex map[string]uint32 // next child index of each derivation chain
+	Mnemonic  string            // BIP39 phrase of `Seed`, empty for a seed made before mnemonics
+	WatchOnly map[string]*WatchOnly
+	XPubs     map[string]bool   // watched extended public key -> its addresses are x-only keys
+	Accounts  map[string]uint32 // account name -> BIP44 account index, except the default account 0
+	Labels    map[string]string // address -> label
+
+	Encryption *WalletEncryption // nil for a plaintext wallet file
+	key        []byte            // decrypts `Encryption` while the wallet is unlocked
 }
 
 const (
 	walletFile = "wallet.dat"
+	gapLimit   = 20 // a scan stops after this many unused addresses in a row
 )
 
 func NewWallets() (*Wallets, error) {
+	wallets := emptyWallets()
+	err := wallets.LoadFromFile()
+
+	return &wallets, err
+}
+
+// return Wallets without keys
+func emptyWallets() Wallets {
 	wallets := Wallets{}
 
 	wallets.Wallets = make(map[string]*Wallet)
-	err := wallets.LoadFromFile()
+	wallets.NextIndex = make(map[string]uint32)
+	wallets.WatchOnly = make(map[string]*WatchOnly)
+	wallets.XPubs = make(map[string]bool)
+	wallets.Accounts = make(map[string]uint32)
+	wallets.Labels = make(map[string]string)
 
-	return &wallets, err
+	return wallets
+}
+
+// derivation path of account `account`: BIP44 for public key hash
+// addresses, BIP86 for x-only public keys
+func accountPath(account uint32, schnorr bool) string {
+	if schnorr {
+		return fmt.Sprintf("m/86'/0'/%d'", account)
+	}
+	return fmt.Sprintf("m/44'/0'/%d'", account)
 }
 
-// add a Wallet to `ws`
-func (ws *Wallets) CreateWallet() string {
-	wallet := NewWallet()
+// derivation chain of the receiving addresses of account `account`
+func receiveChain(account uint32, schnorr bool) string {
+	return accountPath(account, schnorr) + "/0"
+}
+
+// derivation chain of the change addresses of account `account`
+func changeChain(account uint32, schnorr bool) string {
+	return accountPath(account, schnorr) + "/1"
+}
+
+// rebuild `Wallets` from `mnemonic` and `passphrase`. The keys are found
+// by Scan.
+func RestoreWallets(mnemonic, passphrase string) (*Wallets, error) {
+	if _, err := MnemonicToEntropy(mnemonic); err != nil {
+		return nil, err
+	}
+
+	wallets := emptyWallets()
+	wallets.Mnemonic = strings.Join(strings.Fields(mnemonic), " ")
+	wallets.Seed = MnemonicToSeed(wallets.Mnemonic, passphrase)
+
+	return &wallets, nil
+}
+
+// generate a random mnemonic and the seed it gives with `passphrase`
+func (ws *Wallets) NewSeed(passphrase string) {
+	entropy := make([]byte, mnemonicEntropyLen)
+	_, err := rand.Read(entropy)
+	logErr(err)
+
+	ws.Mnemonic, err = NewMnemonic(entropy)
+	logErr(err)
+	ws.Seed = MnemonicToSeed(ws.Mnemonic, passphrase)
+}
+
+// add a Wallet to `ws`, derived from the seed at the next index of the
+// receiving chain of account `account`. The seed is generated with the first
+// wallet. A Schnorr wallet locks coins to its x-only public key, and a bech32
+// wallet has a bech32 (or bech32m) address instead of a Base58Check one.
+func (ws *Wallets) CreateWallet(account uint32, schnorr, bech32 bool) string {
+	if ws.Seed == nil {
+		ws.NewSeed("")
+	}
+
+	chain := receiveChain(account, schnorr)
+	wallet := ws.deriveWallet(chain, ws.NextIndex[chain], schnorr)
+	wallet.Bech32 = bech32
+	ws.NextIndex[chain]++
 	addr := fmt.Sprintf("%s", wallet.GetAddress())
 
 	ws.Wallets[addr] = wallet
@@ -36,6 +121,132 @@ func (ws *Wallets) CreateWallet() string {
 	return addr
 }
 
+// derive the key at index `i` of derivation chain `chain` from the seed
+func (ws *Wallets) deriveWallet(chain string, i uint32, schnorr bool) *Wallet {
+	master, err := NewMasterKey(ws.Seed)
+	logErr(err)
+
+	path := fmt.Sprintf("%s/%d", chain, i)
+	key, err := master.DerivePath(path)
+	logErr(err)
+
+	return &Wallet{key.Key, key.PubKey(), schnorr, false, path}
+}
+
+// return the extended public key of account `account`, from which its
+// addresses can be derived without the private keys
+func (ws *Wallets) AccountXPub(account uint32, schnorr bool) (string, error) {
+	if ws.IsLocked() {
+		return "", errWalletLocked
+	}
+	if ws.Seed == nil {
+		return "", errors.New("wallet has no seed, create a wallet first")
+	}
+
+	master, err := NewMasterKey(ws.Seed)
+	logErr(err)
+	accountKey, err := master.DerivePath(accountPath(account, schnorr))
+	logErr(err)
+
+	return accountKey.Neuter().String(), nil
+}
+
+// derive the receiving and change addresses of every account of the seed
+// until `gapLimit` addresses in a row are unused, and add the used ones to
+// `ws`. The accounts after the known ones are discovered as BIP44 says. `usedKeys` holds the
+// hex-encoded locking keys of the outputs to look for, e.g. from
+// UTXOSet.FindLockingKeys. Watched extended public keys are scanned too.
+//
+// returns the number of addresses added
+func (ws *Wallets) Scan(usedKeys map[string]bool) int {
+	found := 0
+
+	for xpub := range ws.XPubs {
+		found += ws.scanXPub(xpub, usedKeys)
+	}
+	if ws.Seed == nil {
+		return found
+	}
+
+	indexes := ws.accountIndexes()
+	for _, account := range indexes {
+		found += ws.scanAccount(account, usedKeys)
+	}
+	// BIP44 account discovery: an account after the known ones is looked
+	// for only if the one before it is used
+	for account := indexes[len(indexes)-1] + 1; account < HardenedKeyStart; account++ {
+		added := ws.scanAccount(account, usedKeys)
+		if added == 0 {
+			break
+		}
+		found += added
+	}
+
+	return found
+}
+
+// scan the receiving and change chains of account `account`
+//
+// returns the number of addresses added
+func (ws *Wallets) scanAccount(account uint32, usedKeys map[string]bool) int {
+	found := 0
+
+	for _, schnorr := range []bool{false, true} {
+		found += ws.scanChain(receiveChain(account, schnorr), schnorr, usedKeys)
+		found += ws.scanChain(changeChain(account, schnorr), schnorr, usedKeys)
+	}
+
+	return found
+}
+
+// derive the addresses of derivation chain `chain` until `gapLimit`
+// addresses in a row are unused, and add the used ones to `ws`
+func (ws *Wallets) scanChain(chain string, schnorr bool, usedKeys map[string]bool) int {
+	found := 0
+	unused := 0
+
+	for i := uint32(0); unused < gapLimit; i++ {
+		wallet := ws.deriveWallet(chain, i, schnorr)
+		if !usedKeys[hex.EncodeToString(wallet.LockingKey())] {
+			unused++
+			continue
+		}
+		unused = 0
+
+		addr := fmt.Sprintf("%s", wallet.GetAddress())
+		if ws.Wallets[addr] == nil {
+			ws.Wallets[addr] = wallet
+			found++
+		}
+		if i >= ws.NextIndex[chain] {
+			ws.NextIndex[chain] = i + 1
+		}
+	}
+
+	return found
+}
+
+// add the Wallet of `privateKey`, which isn't derived from the seed. A
+// watch-only address of the key gets its private key. With `schnorr` the
+// address is the x-only public key.
+func (ws *Wallets) ImportPrivateKey(privateKey []byte, schnorr bool) (string, error) {
+	if ws.IsLocked() {
+		return "", errWalletLocked
+	}
+
+	_, pubKey := btcec.PrivKeyFromBytes(privateKey)
+	wallet := &Wallet{privateKey, pubKey.SerializeCompressed(), schnorr, false, ""}
+	addr := fmt.Sprintf("%s", wallet.GetAddress())
+	if ws.Wallets[addr] != nil {
+		return "", errors.New("the wallet already holds this key")
+	}
+
+	delete(ws.WatchOnly, addr)
+	ws.Wallets[addr] = wallet
+
+	return addr, nil
+}
+
 // return all addresses stored in *ws*
 func (ws *Wallets) GetAddresses() []string {
 	var addresses []string
@@ -49,38 +260,101 @@ func (ws *Wallets) GetAddresses() []string {
 
 // return a Wallet by addr
 func (ws Wallets) GetWallet(addr string) Wallet {
-	return *ws.Wallets[addr]
+	return *ws.Wallets[normalizeAddress(addr)]
 }
 
-// loads Wallets from data file
+// return the address of the wallet whose public key hashes to `pubKeyHash`,
+// in whatever encoding it has, or "" if there is none
+func (ws Wallets) FindAddress(pubKeyHash []byte) string {
+	for addr, wallet := range ws.Wallets {
+		if bytes.Equal(HashPubKey(wallet.PublicKey), pubKeyHash) {
+			return addr
+		}
+	}
+
+	return ""
+}
+
+// loads Wallets from data file. A P256 wallet file written by an older
+// version is migrated, and the old file is kept as `wallet.dat.p256`.
+//
+// An encrypted wallet is unlocked if walletpassphrase was run and hasn't
+// expired, otherwise it has no private keys and no seed.
 func (ws *Wallets) LoadFromFile() error {
-	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
+	if _, err := os.Stat(dataFile(walletFile)); os.IsNotExist(err) {
 		return err
 	}
 
-	fileContent, err := ioutil.ReadFile(walletFile)
+	fileContent, err := ioutil.ReadFile(dataFile(walletFile))
 	logErr(err)
 
 	var wallets Wallets
-	gob.Register(elliptic.P256())
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
 	err = decoder.Decode(&wallets)
-	logErr(err)
+	if err != nil {
+		legacy, legacyErr := migrateLegacyWallets(fileContent)
+		if legacyErr != nil {
+			log.Panic(err)
+		}
+
+		err = writePrivateFile(dataFile(walletFile)+".p256", fileContent)
+		logErr(err)
+		wallets.Wallets = legacy
+		wallets.SaveToFile()
+		fmt.Printf("Migrated %d P256 keys in %s\n", len(legacy), dataFile(walletFile))
+	}
+
+	// key the wallets by their current address: an older version encoded
+	// addresses with several leading zero bytes wrongly
+	for _, wallet := range wallets.Wallets {
+		ws.Wallets[fmt.Sprintf("%s", wallet.GetAddress())] = wallet
+	}
+	wallets.Wallets = ws.Wallets
 
-	ws.Wallets = wallets.Wallets
+	// maps missing from an older wallet file
+	if wallets.NextIndex == nil {
+		wallets.NextIndex = ws.NextIndex
+	}
+	if wallets.WatchOnly == nil {
+		wallets.WatchOnly = ws.WatchOnly
+	}
+	if wallets.XPubs == nil {
+		wallets.XPubs = ws.XPubs
+	}
+	if wallets.Accounts == nil {
+		wallets.Accounts = ws.Accounts
+	}
+	if wallets.Labels == nil {
+		wallets.Labels = ws.Labels
+	}
+	*ws = wallets
+
+	if ws.Encryption != nil {
+		if key := readUnlockFile(); key != nil {
+			ws.unlockWithKey(key)
+		}
+	}
 
 	return nil
 }
 
+// save `ws` into the data file. The secrets of an encrypted wallet are saved
+// encrypted, or kept as they are while it's locked.
 func (ws Wallets) SaveToFile() {
 	var content bytes.Buffer
 
-	gob.Register(elliptic.P256())
+	if ws.Encryption != nil {
+		if ws.key != nil {
+			ws.seal()
+		}
+		ws = ws.withoutSecrets()
+	}
+
 	encoder := gob.NewEncoder(&content)
 	err := encoder.Encode(ws)
 	logErr(err)
 
-	err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
+	ensureDataDir()
+	err = writePrivateFile(dataFile(walletFile), content.Bytes())
 	logErr(err)
-
 }